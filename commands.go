@@ -0,0 +1,254 @@
+package main
+
+import (
+	"camagru/internal/database"
+	"camagru/internal/models"
+	"camagru/internal/oidc/mockidp"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+func runCommand(args []string) int {
+	var run func(storage *database.Storage, args []string) int
+	switch args[0] {
+	case "migrate":
+		run = runMigrate
+	case "fsck":
+		run = runFsck
+	case "backup":
+		run = runBackup
+	case "role":
+		run = runRole
+	case "restore":
+		return runRestore(args[1:])
+	case "mock-idp":
+		return runMockIdP(args[1:])
+	default:
+		fmt.Printf("Unknown command %q\n", args[0])
+		return 2
+	}
+
+	storage, err := openStorage()
+	if err != nil {
+		fmt.Printf("Storage error: %v\n", err)
+		return 1
+	}
+	defer storage.Close()
+	return run(storage, args[1:])
+}
+
+func runMigrate(storage *database.Storage, args []string) int {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "list pending migrations without applying them")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	applied, err := storage.Migrate(*dryRun)
+	if err != nil {
+		fmt.Printf("Migration failed: %v\n", err)
+		return 1
+	}
+	if len(applied) == 0 {
+		fmt.Println("Schema is up to date")
+		return 0
+	}
+	for _, line := range applied {
+		if *dryRun {
+			fmt.Printf("Would apply %s\n", line)
+		} else {
+			fmt.Printf("Applied %s\n", line)
+		}
+	}
+	return 0
+}
+
+func runFsck(storage *database.Storage, args []string) int {
+	flags := flag.NewFlagSet("fsck", flag.ContinueOnError)
+	repair := flags.Bool("repair", false, "delete orphans, quarantine stray uploads and bump ID counters")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	localUploads := os.Getenv("BLOB_BACKEND") != "s3"
+	if !localUploads {
+		fmt.Println("Skipping upload file checks: images are in the S3 blob store")
+	}
+	report, err := storage.Fsck(*repair, localUploads)
+	if err != nil {
+		fmt.Printf("Check failed: %v\n", err)
+		return 1
+	}
+	if report.Clean() {
+		fmt.Println("No inconsistencies found")
+		return 0
+	}
+
+	for _, id := range report.OrphanImages {
+		fmt.Printf("orphan image %d: owner no longer exists\n", id)
+	}
+	for _, id := range report.OrphanLikes {
+		fmt.Printf("orphan like %d: image or user no longer exists\n", id)
+	}
+	for _, id := range report.OrphanComments {
+		fmt.Printf("orphan comment %d: image or user no longer exists\n", id)
+	}
+	for _, id := range report.OrphanSessions {
+		fmt.Printf("orphan session %d: user no longer exists\n", id)
+	}
+	for _, id := range report.OrphanTokens {
+		fmt.Printf("orphan API token %d: user no longer exists\n", id)
+	}
+	for _, id := range report.OrphanInvites {
+		fmt.Printf("orphan invite %d: creator no longer exists\n", id)
+	}
+	for _, id := range report.MissingFiles {
+		fmt.Printf("image %d: upload file is missing\n", id)
+	}
+	for _, name := range report.StrayFiles {
+		fmt.Printf("stray upload %s: no image record\n", name)
+	}
+	for _, line := range report.Counters {
+		fmt.Printf("ids.json: %s\n", line)
+	}
+
+	if report.Repaired {
+		fmt.Println("Repaired")
+		return 0
+	}
+	fmt.Println("Run with -repair to fix")
+	return 1
+}
+
+// runRole sets a user's role. It is how the first admin of an instance is
+// appointed. Like the other commands that open the data directory, it
+// refuses to run while the server is up, so stop the server first.
+func runRole(storage *database.Storage, args []string) int {
+	flags := flag.NewFlagSet("role", flag.ContinueOnError)
+	username := flags.String("user", "", "username or email of the account")
+	role := flags.String("role", models.RoleAdmin, "role to give: user, moderator or admin")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *username == "" {
+		fmt.Println("Missing -user")
+		return 2
+	}
+
+	user, err := storage.GetUserByUsernameOrEmail(*username)
+	if err != nil {
+		fmt.Printf("No user %q\n", *username)
+		return 1
+	}
+	if err := storage.SetUserRole(user.ID, *role); err != nil {
+		fmt.Printf("Failed to set role: %v\n", err)
+		return 1
+	}
+	fmt.Printf("%s is now %s\n", user.Username, *role)
+	return 0
+}
+
+func runBackup(storage *database.Storage, args []string) int {
+	flags := flag.NewFlagSet("backup", flag.ContinueOnError)
+	output := flags.String("o", "", "archive to write (default: data/backups/backup-<time>.tar.gz)")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	path, err := writeBackup(storage, *output)
+	if err != nil {
+		fmt.Printf("Backup failed: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Backup written to %s\n", path)
+	fmt.Println("token.key is not included; keep a copy of it somewhere safe, as restoring needs it")
+	if os.Getenv("BLOB_BACKEND") == "s3" {
+		fmt.Println("Images in the S3 blob store are not included; back up the bucket separately")
+	}
+	return 0
+}
+
+func runRestore(args []string) int {
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	input := flags.String("i", "", "archive written by the backup command")
+	newKey := flags.Bool("new-token-key", false, "restore without the backup's token.key, signing everyone out and invalidating API tokens and emailed links")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *input == "" {
+		fmt.Println("restore: -i is required")
+		return 2
+	}
+
+	if err := lockDataDir(); err != nil {
+		fmt.Printf("Restore failed: %v\n", err)
+		return 1
+	}
+	err := database.RestoreBackup(dataDir, *input, *newKey)
+	if errors.Is(err, database.ErrTokenKeyMismatch) {
+		fmt.Printf("Restore failed: %v\n", err)
+		fmt.Printf("Copy the token.key from the server the backup was made on into %s,\n", dataDir)
+		fmt.Println("or pass -new-token-key to restore anyway and invalidate every session, API token and emailed link")
+		return 1
+	}
+	if err != nil {
+		fmt.Printf("Restore failed: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Restored %s into %s\n", *input, dataDir)
+	return 0
+}
+
+// runMockIdP serves a stand-in OpenID provider for trying out OIDC sign-in
+// locally. Point OIDC_ISSUER at its address and OIDC_CLIENT_ID at -client.
+func runMockIdP(args []string) int {
+	flags := flag.NewFlagSet("mock-idp", flag.ContinueOnError)
+	addr := flags.String("addr", "localhost:9090", "address to listen on")
+	clientID := flags.String("client", "camagru", "client ID to accept")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	idp, err := mockidp.New("http://"+*addr, *clientID)
+	if err != nil {
+		fmt.Printf("Mock IdP failed: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Mock IdP listening on %s\n", idp.Issuer)
+	if err := http.ListenAndServe(*addr, idp); err != nil {
+		fmt.Printf("Mock IdP failed: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func writeBackup(storage *database.Storage, path string) (string, error) {
+	if path == "" {
+		dir := filepath.Join(dataDir, "backups")
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return "", err
+		}
+		path = filepath.Join(dir, "backup-"+time.Now().Format("20060102-150405")+".tar.gz")
+	}
+
+	tmp := path + ".partial"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return "", err
+	}
+	if err := storage.Backup(f); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return path, os.Rename(tmp, path)
+}
@@ -2,6 +2,6 @@ module camagru
 
 go 1.21
 
-require (
-	golang.org/x/crypto v0.15.0
-)
+require golang.org/x/crypto v0.15.0
+
+require golang.org/x/sys v0.14.0 // indirect
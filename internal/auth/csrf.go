@@ -1,26 +1,87 @@
 package auth
 
 import (
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
 	"net/http"
 	"strings"
 )
 
+const (
+	CSRFHeader = "X-CSRF-Token"
+	csrfField  = "csrf_token"
+	// csrfCookie identifies a browser that has no session yet, so that
+	// login and registration forms have something to bind their token to.
+	csrfCookie = "csrf_id"
+)
+
+// csrfKey signs CSRF tokens. It only lives as long as the process; pages
+// fetch a fresh token when they load, and csrf.js retries once when a
+// token is rejected after a restart.
+var csrfKey = func() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return key
+}()
+
+// CSRFMiddleware rejects state-changing requests whose CSRF token, sent in
+// the X-CSRF-Token header or a csrf_token form field, does not match the
+// caller's session (or, before sign-in, its csrf_id cookie). Requests
+// authenticated with a bearer token are exempt: a browser never attaches
+// one on its own, so it cannot be forged from another site.
 func CSRFMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if r.Method == "GET" {
+		if r.Method == "GET" || r.Method == "HEAD" || r.Method == "OPTIONS" {
 			next(w, r)
 			return
 		}
-		if strings.HasPrefix(r.URL.Path, "/api/") {
+		if strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
 			next(w, r)
 			return
 		}
+
+		token := r.Header.Get(CSRFHeader)
+		if token == "" {
+			token = r.FormValue(csrfField)
+		}
+		binding := csrfBinding(r)
+		if binding == "" || !hmac.Equal([]byte(token), []byte(csrfToken(binding))) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("X-CSRF-Invalid", "true")
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"success":false,"message":"Invalid or missing CSRF token"}` + "\n"))
+			return
+		}
 		next(w, r)
 	}
 }
 
+// CSRFToken returns the token the caller must send with state-changing
+// requests, first giving the browser a csrf_id cookie if it has neither
+// that nor a session.
+func CSRFToken(w http.ResponseWriter, r *http.Request) (string, error) {
+	binding := csrfBinding(r)
+	if binding == "" {
+		id, err := GenerateCSRFToken()
+		if err != nil {
+			return "", err
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     csrfCookie,
+			Value:    id,
+			Path:     "/",
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+		binding = "anon:" + id
+	}
+	return csrfToken(binding), nil
+}
+
 func GenerateCSRFToken() (string, error) {
 	bytes := make([]byte, 32)
 	if _, err := rand.Read(bytes); err != nil {
@@ -28,3 +89,19 @@ func GenerateCSRFToken() (string, error) {
 	}
 	return hex.EncodeToString(bytes), nil
 }
+
+func csrfBinding(r *http.Request) string {
+	if cookie, err := r.Cookie("session"); err == nil && cookie.Value != "" {
+		return "session:" + cookie.Value
+	}
+	if cookie, err := r.Cookie(csrfCookie); err == nil && cookie.Value != "" {
+		return "anon:" + cookie.Value
+	}
+	return ""
+}
+
+func csrfToken(binding string) string {
+	mac := hmac.New(sha256.New, csrfKey)
+	mac.Write([]byte(binding))
+	return hex.EncodeToString(mac.Sum(nil))
+}
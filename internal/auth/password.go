@@ -0,0 +1,244 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	AlgorithmArgon2id = "argon2id"
+	AlgorithmBcrypt   = "bcrypt"
+
+	argon2SaltLen = 16
+	argon2KeyLen  = 32
+)
+
+// PasswordConfig selects how new password hashes are made. Existing hashes
+// made with other settings still verify, and CheckPassword reports them as
+// outdated.
+type PasswordConfig struct {
+	Algorithm string
+	// Argon2Memory is in KiB.
+	Argon2Memory  uint32
+	Argon2Time    uint32
+	Argon2Threads uint8
+	BcryptCost    int
+	// Pepper is a server-side secret mixed into every password before it
+	// is hashed, so that a leaked data directory alone is not enough to
+	// attack the hashes. Changing it invalidates every peppered hash.
+	Pepper string
+}
+
+// DefaultPasswordConfig follows the OWASP recommendation for argon2id.
+var DefaultPasswordConfig = PasswordConfig{
+	Algorithm:     AlgorithmArgon2id,
+	Argon2Memory:  64 * 1024,
+	Argon2Time:    3,
+	Argon2Threads: 2,
+	BcryptCost:    12,
+}
+
+var (
+	passwordMu     sync.RWMutex
+	passwordConfig = DefaultPasswordConfig
+)
+
+// SetPasswordConfig replaces the settings used by HashPassword and
+// CheckPassword.
+func SetPasswordConfig(config PasswordConfig) error {
+	switch config.Algorithm {
+	case AlgorithmArgon2id:
+		if config.Argon2Memory < 8*uint32(config.Argon2Threads) || config.Argon2Time < 1 || config.Argon2Threads < 1 {
+			return fmt.Errorf("invalid argon2id parameters")
+		}
+	case AlgorithmBcrypt:
+		if config.BcryptCost < bcrypt.MinCost || config.BcryptCost > bcrypt.MaxCost {
+			return fmt.Errorf("bcrypt cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+	default:
+		return fmt.Errorf("unknown password hashing algorithm %q", config.Algorithm)
+	}
+
+	passwordMu.Lock()
+	passwordConfig = config
+	passwordMu.Unlock()
+	return nil
+}
+
+func currentPasswordConfig() PasswordConfig {
+	passwordMu.RLock()
+	defer passwordMu.RUnlock()
+	return passwordConfig
+}
+
+// HashPassword hashes password with the configured algorithm. The result is
+// a PHC-style string that records the algorithm, its parameters and whether
+// the pepper was applied:
+//
+//	$argon2id$v=19$m=65536,t=3,p=2,k=1$<salt>$<hash>
+//	$bcrypt-sha256$v=1,k=1$<bcrypt hash>
+//
+// Passwords are HMAC-SHA256'd before bcrypt sees them, both to apply the
+// pepper and because bcrypt ignores everything past 72 bytes.
+func HashPassword(password string) (string, error) {
+	config := currentPasswordConfig()
+	peppered := config.Pepper != ""
+
+	if config.Algorithm == AlgorithmBcrypt {
+		hash, err := bcrypt.GenerateFromPassword(prehash(password, config.Pepper), config.BcryptCost)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("$bcrypt-sha256$v=1,k=%d$%s", boolInt(peppered), hash), nil
+	}
+
+	salt := make([]byte, argon2SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey(pepper(password, config.Pepper), salt, config.Argon2Time, config.Argon2Memory, config.Argon2Threads, argon2KeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d,k=%d$%s$%s",
+		argon2.Version, config.Argon2Memory, config.Argon2Time, config.Argon2Threads, boolInt(peppered),
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// CheckPassword reports whether password matches hash and, if it does,
+// whether hash should be replaced by a fresh HashPassword because it was
+// made with an older format, other parameters or a different pepper
+// setting. Plain bcrypt hashes from before the versioned format are
+// always outdated.
+func CheckPassword(password, hash string) (ok bool, outdated bool) {
+	config := currentPasswordConfig()
+
+	switch {
+	case strings.HasPrefix(hash, "$argon2id$"):
+		return checkArgon2id(password, hash, config)
+	case strings.HasPrefix(hash, "$bcrypt-sha256$"):
+		return checkBcryptSHA256(password, hash, config)
+	case strings.HasPrefix(hash, "$2"):
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+			return false, false
+		}
+		return true, true
+	}
+	return false, false
+}
+
+func checkArgon2id(password, hash string, config PasswordConfig) (bool, bool) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[2] != "v="+strconv.Itoa(argon2.Version) {
+		return false, false
+	}
+	params, ok := parseParams(parts[3])
+	if !ok {
+		return false, false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, false
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(want) == 0 {
+		return false, false
+	}
+	secret, ok := pepperFor(params["k"], config)
+	if !ok || params["m"] == 0 || params["t"] == 0 || params["p"] == 0 || params["p"] > 255 {
+		return false, false
+	}
+
+	got := argon2.IDKey(pepper(password, secret), salt, uint32(params["t"]), uint32(params["m"]), uint8(params["p"]), uint32(len(want)))
+	if subtle.ConstantTimeCompare(got, want) != 1 {
+		return false, false
+	}
+
+	outdated := config.Algorithm != AlgorithmArgon2id ||
+		uint32(params["m"]) != config.Argon2Memory ||
+		uint32(params["t"]) != config.Argon2Time ||
+		uint8(params["p"]) != config.Argon2Threads ||
+		(params["k"] == 1) != (config.Pepper != "")
+	return true, outdated
+}
+
+func checkBcryptSHA256(password, hash string, config PasswordConfig) (bool, bool) {
+	parts := strings.SplitN(hash, "$", 4)
+	if len(parts) != 4 {
+		return false, false
+	}
+	params, ok := parseParams(parts[2])
+	if !ok || params["v"] != 1 {
+		return false, false
+	}
+	secret, ok := pepperFor(params["k"], config)
+	if !ok {
+		return false, false
+	}
+
+	stored := []byte(parts[3])
+	if bcrypt.CompareHashAndPassword(stored, prehash(password, secret)) != nil {
+		return false, false
+	}
+
+	cost, err := bcrypt.Cost(stored)
+	outdated := err != nil ||
+		config.Algorithm != AlgorithmBcrypt ||
+		cost != config.BcryptCost ||
+		(params["k"] == 1) != (config.Pepper != "")
+	return true, outdated
+}
+
+// parseParams reads a comma-separated list of name=number pairs.
+func parseParams(s string) (map[string]int, bool) {
+	params := make(map[string]int)
+	for _, field := range strings.Split(s, ",") {
+		name, value, found := strings.Cut(field, "=")
+		n, err := strconv.Atoi(value)
+		if !found || err != nil || n < 0 {
+			return nil, false
+		}
+		params[name] = n
+	}
+	return params, true
+}
+
+// pepperFor returns the pepper a hash was made with. A peppered hash cannot
+// be checked once the pepper is no longer configured.
+func pepperFor(k int, config PasswordConfig) (string, bool) {
+	if k == 0 {
+		return "", true
+	}
+	return config.Pepper, config.Pepper != ""
+}
+
+func pepper(password, secret string) []byte {
+	if secret == "" {
+		return []byte(password)
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(password))
+	return mac.Sum(nil)
+}
+
+// prehash turns a password of any length into 44 bytes that bcrypt can
+// take whole. The digest is base64-encoded because bcrypt stops at a NUL.
+func prehash(password, secret string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(password))
+	return []byte(base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
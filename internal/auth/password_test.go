@@ -0,0 +1,194 @@
+package auth
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// cheapConfig hashes fast enough for tests.
+var cheapConfig = PasswordConfig{
+	Algorithm:     AlgorithmArgon2id,
+	Argon2Memory:  1024,
+	Argon2Time:    1,
+	Argon2Threads: 1,
+	BcryptCost:    bcrypt.MinCost,
+}
+
+// usePasswordConfig switches to config for the rest of the test.
+func usePasswordConfig(t *testing.T, config PasswordConfig) {
+	t.Helper()
+	previous := currentPasswordConfig()
+	if err := SetPasswordConfig(config); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { SetPasswordConfig(previous) })
+}
+
+func mustHash(t *testing.T, password string) string {
+	t.Helper()
+	hash, err := HashPassword(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+func TestArgon2idPHCRoundTrip(t *testing.T) {
+	usePasswordConfig(t, cheapConfig)
+
+	hash := mustHash(t, "correct horse")
+	format := regexp.MustCompile(`^\$argon2id\$v=19\$m=1024,t=1,p=1,k=0\$[A-Za-z0-9+/]{22}\$[A-Za-z0-9+/]{43}$`)
+	if !format.MatchString(hash) {
+		t.Fatalf("hash %q is not in PHC format", hash)
+	}
+	if ok, outdated := CheckPassword("correct horse", hash); !ok || outdated {
+		t.Fatalf("CheckPassword = %v, %v", ok, outdated)
+	}
+	if ok, _ := CheckPassword("correct horse!", hash); ok {
+		t.Fatal("wrong password accepted")
+	}
+	if other := mustHash(t, "correct horse"); other == hash {
+		t.Fatal("two hashes share a salt")
+	}
+}
+
+func TestOutdatedHashes(t *testing.T) {
+	usePasswordConfig(t, cheapConfig)
+	argon := mustHash(t, "correct horse")
+
+	tests := []struct {
+		name   string
+		change func(config *PasswordConfig)
+	}{
+		{"memory", func(c *PasswordConfig) { c.Argon2Memory = 2048 }},
+		{"passes", func(c *PasswordConfig) { c.Argon2Time = 2 }},
+		{"threads", func(c *PasswordConfig) { c.Argon2Threads = 2 }},
+		{"pepper added", func(c *PasswordConfig) { c.Pepper = "secret" }},
+		{"algorithm", func(c *PasswordConfig) { c.Algorithm = AlgorithmBcrypt }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := cheapConfig
+			test.change(&config)
+			usePasswordConfig(t, config)
+
+			// The old hash still works, but should be replaced...
+			if ok, outdated := CheckPassword("correct horse", argon); !ok || !outdated {
+				t.Fatalf("old hash: CheckPassword = %v, %v", ok, outdated)
+			}
+			// ...by one that is not.
+			if ok, outdated := CheckPassword("correct horse", mustHash(t, "correct horse")); !ok || outdated {
+				t.Fatalf("new hash: CheckPassword = %v, %v", ok, outdated)
+			}
+		})
+	}
+
+	t.Run("legacy bcrypt", func(t *testing.T) {
+		legacy, err := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok, outdated := CheckPassword("correct horse", string(legacy)); !ok || !outdated {
+			t.Fatalf("CheckPassword = %v, %v", ok, outdated)
+		}
+	})
+}
+
+func TestBcryptSHA256(t *testing.T) {
+	config := cheapConfig
+	config.Algorithm = AlgorithmBcrypt
+	usePasswordConfig(t, config)
+
+	hash := mustHash(t, "correct horse")
+	if !strings.HasPrefix(hash, "$bcrypt-sha256$v=1,k=0$$2a$04$") {
+		t.Fatalf("hash = %q", hash)
+	}
+	if ok, outdated := CheckPassword("correct horse", hash); !ok || outdated {
+		t.Fatalf("CheckPassword = %v, %v", ok, outdated)
+	}
+
+	// Plain bcrypt would ignore everything past 72 bytes.
+	long := strings.Repeat("a", 100)
+	hash = mustHash(t, long)
+	if ok, _ := CheckPassword(long[:99]+"b", hash); ok {
+		t.Fatal("a password differing after byte 72 was accepted")
+	}
+	if ok, _ := CheckPassword(long, hash); !ok {
+		t.Fatal("long password rejected")
+	}
+}
+
+func TestPepper(t *testing.T) {
+	for _, algorithm := range []string{AlgorithmArgon2id, AlgorithmBcrypt} {
+		t.Run(algorithm, func(t *testing.T) {
+			config := cheapConfig
+			config.Algorithm = algorithm
+			config.Pepper = "pepper-one"
+			usePasswordConfig(t, config)
+
+			hash := mustHash(t, "correct horse")
+			if !strings.Contains(hash, "k=1") {
+				t.Fatalf("hash %q does not record the pepper", hash)
+			}
+			if ok, outdated := CheckPassword("correct horse", hash); !ok || outdated {
+				t.Fatalf("CheckPassword = %v, %v", ok, outdated)
+			}
+
+			// The hash is useless without the pepper it was made with.
+			config.Pepper = "pepper-two"
+			usePasswordConfig(t, config)
+			if ok, _ := CheckPassword("correct horse", hash); ok {
+				t.Fatal("accepted with another pepper")
+			}
+			config.Pepper = ""
+			usePasswordConfig(t, config)
+			if ok, _ := CheckPassword("correct horse", hash); ok {
+				t.Fatal("accepted without the pepper")
+			}
+		})
+	}
+}
+
+func TestMalformedHashes(t *testing.T) {
+	usePasswordConfig(t, cheapConfig)
+	valid := mustHash(t, "correct horse")
+	parts := strings.Split(valid, "$")
+
+	for _, hash := range []string{
+		"",
+		"correct horse",
+		"$argon2id$",
+		strings.Replace(valid, "v=19", "v=16", 1),
+		strings.Replace(valid, "m=1024", "m=0", 1),
+		strings.Replace(valid, "p=1", "p=300", 1),
+		strings.Replace(valid, "t=1", "t=x", 1),
+		strings.Join(parts[:5], "$") + "$",
+		strings.Join(parts[:4], "$") + "$!!!$" + parts[5],
+		"$bcrypt-sha256$v=2,k=0$$2a$04$abc",
+		"$scrypt$whatever",
+	} {
+		if ok, _ := CheckPassword("correct horse", hash); ok {
+			t.Errorf("%q accepted", hash)
+		}
+	}
+}
+
+func TestSetPasswordConfigValidates(t *testing.T) {
+	before := currentPasswordConfig()
+	for _, config := range []PasswordConfig{
+		{Algorithm: "md5"},
+		{Algorithm: AlgorithmArgon2id, Argon2Memory: 4, Argon2Time: 1, Argon2Threads: 1},
+		{Algorithm: AlgorithmArgon2id, Argon2Memory: 1024, Argon2Time: 0, Argon2Threads: 1},
+		{Algorithm: AlgorithmBcrypt, BcryptCost: bcrypt.MaxCost + 1},
+	} {
+		if err := SetPasswordConfig(config); err == nil {
+			t.Errorf("%+v accepted", config)
+		}
+	}
+	if got := currentPasswordConfig(); got != before {
+		t.Fatalf("config changed to %+v", got)
+	}
+}
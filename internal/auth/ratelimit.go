@@ -0,0 +1,121 @@
+package auth
+
+import (
+	"sync"
+	"time"
+)
+
+// LimiterConfig describes how a Limiter reacts to repeated attempts.
+type LimiterConfig struct {
+	// Free is the number of attempts allowed before any delay applies.
+	Free int
+	// Backoff is the delay after the first attempt past Free. It doubles
+	// with each further attempt, up to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// LockoutAfter attempts block the key for Lockout. Zero disables
+	// lockout. Once a lockout ends, counting starts over.
+	LockoutAfter int
+	Lockout      time.Duration
+	// Window is how long a key must stay quiet before its attempts are
+	// forgotten.
+	Window time.Duration
+}
+
+// Limiter counts attempts per key (an IP address, an account, ...) and
+// blocks keys that make too many, with exponential backoff and an optional
+// temporary lockout. It is safe for concurrent use.
+type Limiter struct {
+	config    LimiterConfig
+	mu        sync.Mutex
+	entries   map[string]*limiterEntry
+	lastPrune time.Time
+}
+
+type limiterEntry struct {
+	attempts     int
+	last         time.Time
+	blockedUntil time.Time
+	// locked is set while blockedUntil is the end of a lockout rather
+	// than of a backoff delay.
+	locked bool
+}
+
+func NewLimiter(config LimiterConfig) *Limiter {
+	return &Limiter{config: config, entries: make(map[string]*limiterEntry)}
+}
+
+// Check reports whether key may make an attempt now. If not, it returns how
+// long the caller has to wait.
+func (l *Limiter) Check(key string) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.prune(now)
+	entry, exists := l.entries[key]
+	if !exists || !now.Before(entry.blockedUntil) {
+		return 0, true
+	}
+	return entry.blockedUntil.Sub(now), false
+}
+
+// Record counts an attempt against key and returns true if this attempt
+// triggered a lockout.
+func (l *Limiter) Record(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	entry, exists := l.entries[key]
+	if !exists || now.Sub(entry.last) > l.config.Window || (entry.locked && !now.Before(entry.blockedUntil)) {
+		entry = &limiterEntry{}
+		l.entries[key] = entry
+	}
+	entry.attempts++
+	entry.last = now
+
+	if l.config.LockoutAfter > 0 && entry.attempts == l.config.LockoutAfter {
+		entry.blockedUntil = now.Add(l.config.Lockout)
+		entry.locked = true
+		return true
+	}
+	if l.config.LockoutAfter > 0 && entry.attempts > l.config.LockoutAfter {
+		// Attempts made by ignoring the lockout extend it.
+		entry.blockedUntil = now.Add(l.config.Lockout)
+		return false
+	}
+	if over := entry.attempts - l.config.Free; over > 0 {
+		delay := l.config.Backoff
+		for i := 1; i < over && delay < l.config.MaxBackoff; i++ {
+			delay *= 2
+		}
+		if delay > l.config.MaxBackoff {
+			delay = l.config.MaxBackoff
+		}
+		entry.blockedUntil = now.Add(delay)
+	}
+	return false
+}
+
+// Reset forgets every attempt made by key.
+func (l *Limiter) Reset(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.entries, key)
+}
+
+// prune drops keys that have been quiet for longer than the window and are
+// no longer blocked, at most once a minute. Callers hold l.mu.
+func (l *Limiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < time.Minute {
+		return
+	}
+	l.lastPrune = now
+	for key, entry := range l.entries {
+		if now.Sub(entry.last) > l.config.Window && !now.Before(entry.blockedUntil) {
+			delete(l.entries, key)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+// checkWait fails the test unless key is blocked for about want.
+func checkWait(t *testing.T, l *Limiter, key string, want time.Duration) {
+	t.Helper()
+	wait, ok := l.Check(key)
+	if want == 0 {
+		if !ok {
+			t.Fatalf("blocked for %v, want allowed", wait)
+		}
+		return
+	}
+	if ok || wait > want || wait < want-time.Second {
+		t.Fatalf("Check = %v, %v; want blocked for %v", wait, ok, want)
+	}
+}
+
+func TestLimiterBackoff(t *testing.T) {
+	l := NewLimiter(LimiterConfig{
+		Free:       2,
+		Backoff:    time.Minute,
+		MaxBackoff: 4 * time.Minute,
+		Window:     time.Hour,
+	})
+
+	for i, want := range []time.Duration{
+		0, 0, // free
+		time.Minute,
+		2 * time.Minute,
+		4 * time.Minute,
+		4 * time.Minute, // capped
+	} {
+		if l.Record("ip") {
+			t.Fatalf("attempt %d locked out", i+1)
+		}
+		checkWait(t, l, "ip", want)
+	}
+	checkWait(t, l, "other", 0)
+
+	l.Reset("ip")
+	checkWait(t, l, "ip", 0)
+}
+
+func TestLimiterLockout(t *testing.T) {
+	l := NewLimiter(LimiterConfig{
+		Free:         1,
+		Backoff:      time.Second,
+		MaxBackoff:   time.Second,
+		LockoutAfter: 3,
+		Lockout:      time.Hour,
+		Window:       time.Hour,
+	})
+
+	l.Record("account")
+	l.Record("account")
+	checkWait(t, l, "account", time.Second)
+	if !l.Record("account") {
+		t.Fatal("third attempt did not lock the account out")
+	}
+	checkWait(t, l, "account", time.Hour)
+
+	// Attempts that ignore the lockout extend it, but do not report a
+	// second lockout.
+	if l.Record("account") {
+		t.Fatal("a lockout was reported twice")
+	}
+	checkWait(t, l, "account", time.Hour)
+}
+
+func TestLimiterForgetsAfterWindow(t *testing.T) {
+	l := NewLimiter(LimiterConfig{
+		Free:         2,
+		Backoff:      time.Millisecond,
+		MaxBackoff:   time.Millisecond,
+		LockoutAfter: 3,
+		Lockout:      time.Hour,
+		Window:       20 * time.Millisecond,
+	})
+
+	l.Record("ip")
+	l.Record("ip")
+	time.Sleep(30 * time.Millisecond)
+	// Counting starts over, so this is a free attempt rather than the
+	// one that locks the key out.
+	if l.Record("ip") {
+		t.Fatal("locked out by attempts outside the window")
+	}
+	checkWait(t, l, "ip", 0)
+}
+
+func TestLimiterStartsOverAfterLockout(t *testing.T) {
+	l := NewLimiter(LimiterConfig{
+		Free:         1,
+		Backoff:      time.Millisecond,
+		MaxBackoff:   time.Millisecond,
+		LockoutAfter: 3,
+		Lockout:      20 * time.Millisecond,
+		Window:       time.Hour,
+	})
+
+	for i := 0; i < 3; i++ {
+		l.Record("account")
+	}
+	time.Sleep(30 * time.Millisecond)
+	checkWait(t, l, "account", 0)
+
+	// The failures before the lockout no longer count, so the next one is
+	// free again instead of locking the key out at once.
+	if l.Record("account") {
+		t.Fatal("locked out again by the first attempt after the lockout")
+	}
+	checkWait(t, l, "account", 0)
+	l.Record("account")
+	if !l.Record("account") {
+		t.Fatal("a fresh run of failures did not lock the key out")
+	}
+}
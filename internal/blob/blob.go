@@ -0,0 +1,62 @@
+package blob
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+var ErrNotFound = errors.New("blob not found")
+
+// Store holds uploaded and composed images. Keys are flat names chosen by
+// the store on Put; callers keep the key (or the URL built from it) and use
+// it to read, serve or delete the blob later.
+type Store interface {
+	Put(data []byte, contentType string) (string, error)
+	Get(key string) ([]byte, string, error)
+	Delete(key string) error
+	URL(key string) string
+}
+
+// contentKey names data after its SHA-256, so identical content always
+// lands on the same key and two writes never collide.
+func contentKey(data []byte, contentType string) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]) + extension(contentType)
+}
+
+func extension(contentType string) string {
+	switch contentType {
+	case "image/jpeg":
+		return ".jpg"
+	case "image/png":
+		return ".png"
+	case "image/gif":
+		return ".gif"
+	case "image/webp":
+		return ".webp"
+	}
+	return ""
+}
+
+// ContentType guesses the content type of a key from its extension.
+func ContentType(key string) string {
+	switch {
+	case strings.HasSuffix(key, ".jpg"), strings.HasSuffix(key, ".jpeg"):
+		return "image/jpeg"
+	case strings.HasSuffix(key, ".png"):
+		return "image/png"
+	case strings.HasSuffix(key, ".gif"):
+		return "image/gif"
+	case strings.HasSuffix(key, ".webp"):
+		return "image/webp"
+	}
+	return "application/octet-stream"
+}
+
+// validKey rejects anything that is not a single path element, so a key
+// taken from a URL can never reach outside the store.
+func validKey(key string) bool {
+	return key != "" && !strings.HasPrefix(key, ".") && !strings.ContainsAny(key, `/\`)
+}
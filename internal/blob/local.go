@@ -0,0 +1,81 @@
+package blob
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// LocalStore keeps blobs as files in a single directory and serves them
+// under urlPrefix.
+type LocalStore struct {
+	dir       string
+	urlPrefix string
+}
+
+func NewLocalStore(dir, urlPrefix string) (*LocalStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &LocalStore{dir: dir, urlPrefix: urlPrefix}, nil
+}
+
+func (l *LocalStore) Put(data []byte, contentType string) (string, error) {
+	key := contentKey(data, contentType)
+	path := filepath.Join(l.dir, key)
+	if _, err := os.Stat(path); err == nil {
+		return key, nil
+	}
+
+	tmp, err := os.CreateTemp(l.dir, ".put-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+func (l *LocalStore) Get(key string) ([]byte, string, error) {
+	if !validKey(key) {
+		return nil, "", ErrNotFound
+	}
+	data, err := os.ReadFile(filepath.Join(l.dir, key))
+	if os.IsNotExist(err) {
+		return nil, "", ErrNotFound
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return data, ContentType(key), nil
+}
+
+func (l *LocalStore) Delete(key string) error {
+	if !validKey(key) {
+		return ErrNotFound
+	}
+	err := os.Remove(filepath.Join(l.dir, key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (l *LocalStore) URL(key string) string {
+	return l.urlPrefix + key
+}
@@ -7,12 +7,37 @@ import (
 	"strings"
 )
 
+// defaultEnvContent is written to a missing .env. Keep it in step with
+// .env.example, which explains each setting.
 const defaultEnvContent = `PORT=8080
 SMTP_HOST=mailhog
 SMTP_PORT=1025
 SMTP_USER=
 SMTP_PASS=
 FROM_EMAIL=noreply@camagru.local
+STORAGE_BACKEND=json
+BLOB_BACKEND=local
+S3_ENDPOINT=
+S3_REGION=
+S3_BUCKET=
+S3_ACCESS_KEY=
+S3_SECRET_KEY=
+LOCKOUT_EMAIL=true
+PASSWORD_HASH=argon2id
+ARGON2_MEMORY=65536
+ARGON2_TIME=3
+ARGON2_THREADS=2
+BCRYPT_COST=12
+PASSWORD_PEPPER=
+UNVERIFIED_PURGE_DAYS=0
+OIDC_ISSUER=
+OIDC_CLIENT_ID=
+OIDC_CLIENT_SECRET=
+OIDC_REDIRECT_URL=http://localhost:8080/login/oidc/callback
+OIDC_SCOPES=openid email profile
+OIDC_NAME=Single Sign-On
+REGISTRATION_MODE=open
+EMAIL_DOMAINS=
 `
 
 func LoadEnv(filename string) error {
@@ -0,0 +1,147 @@
+package database
+
+import (
+	"camagru/internal/models"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ListUsers returns one page of the users whose username or email contains
+// query, ignoring case, in ID order, along with the number of matches.
+func (s *Storage) ListUsers(query string, page, limit int) ([]models.User, int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	query = strings.ToLower(query)
+	var matches []*userRecord
+	for _, user := range s.data.users {
+		if query == "" ||
+			strings.Contains(strings.ToLower(user.Username), query) ||
+			strings.Contains(strings.ToLower(user.Email), query) {
+			matches = append(matches, user)
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i].ID < matches[j].ID
+	})
+
+	offset := (page - 1) * limit
+	result := make([]models.User, 0, limit)
+	for i := offset; i < len(matches) && i < offset+limit; i++ {
+		result = append(result, *userModel(matches[i]))
+	}
+
+	return result, len(matches), nil
+}
+
+// MarkUserVerified verifies an account without its verification link.
+func (s *Storage) MarkUserVerified(userID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, exists := s.data.users[userID]
+	if !exists {
+		return fmt.Errorf("user not found")
+	}
+
+	updated := *user
+	updated.Verified = true
+	updated.VerificationToken = ""
+	updated.VerificationExpires = nil
+	updated.VerificationSentAt = nil
+
+	t := s.begin()
+	t.put(usersFile, userID, &updated)
+	return t.commit()
+}
+
+// SetUserSuspended suspends or reinstates an account. Suspending it also
+// ends all of its sessions.
+func (s *Storage) SetUserSuspended(userID int, suspended bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, exists := s.data.users[userID]
+	if !exists {
+		return fmt.Errorf("user not found")
+	}
+
+	updated := *user
+	updated.Suspended = suspended
+
+	t := s.begin()
+	t.put(usersFile, userID, &updated)
+	if suspended {
+		for id := range s.data.idx.sessionsByUser[userID] {
+			t.remove(sessionsFile, id)
+		}
+	}
+	return t.commit()
+}
+
+func (s *Storage) SetUserRole(userID int, role string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch role {
+	case models.RoleUser, models.RoleModerator, models.RoleAdmin:
+	default:
+		return fmt.Errorf("unknown role %q", role)
+	}
+
+	user, exists := s.data.users[userID]
+	if !exists {
+		return fmt.Errorf("user not found")
+	}
+
+	updated := *user
+	updated.Role = role
+
+	t := s.begin()
+	t.put(usersFile, userID, &updated)
+	return t.commit()
+}
+
+func (s *Storage) DeleteComment(commentID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.data.comments[commentID]; !exists {
+		return fmt.Errorf("comment not found")
+	}
+
+	t := s.begin()
+	t.remove(commentsFile, commentID)
+	return t.commit()
+}
+
+func (s *Storage) GetStats() (*models.Stats, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stats := &models.Stats{
+		Users:     len(s.data.users),
+		Images:    len(s.data.images),
+		Comments:  len(s.data.comments),
+		Likes:     len(s.data.likes),
+		Sessions:  len(s.data.sessions),
+		APITokens: len(s.data.tokens),
+	}
+	for _, user := range s.data.users {
+		if user.Verified {
+			stats.VerifiedUsers++
+		}
+		if user.Suspended {
+			stats.SuspendedUsers++
+		}
+		switch user.Role {
+		case models.RoleModerator:
+			stats.Moderators++
+		case models.RoleAdmin:
+			stats.Admins++
+		}
+	}
+
+	return stats, nil
+}
@@ -0,0 +1,131 @@
+package database
+
+import (
+	"camagru/internal/models"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// apiTokenRecord is a personal access token. Only the keyed hash of the
+// token is stored.
+type apiTokenRecord struct {
+	ID        int        `json:"id"`
+	UserID    int        `json:"user_id"`
+	Name      string     `json:"name"`
+	TokenHash string     `json:"token_hash"`
+	Scopes    []string   `json:"scopes"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at"`
+	LastUsed  *time.Time `json:"last_used"`
+}
+
+func apiTokenModel(token *apiTokenRecord) *models.APIToken {
+	return &models.APIToken{
+		ID:        token.ID,
+		UserID:    token.UserID,
+		Name:      token.Name,
+		Scopes:    append([]string(nil), token.Scopes...),
+		CreatedAt: token.CreatedAt,
+		ExpiresAt: token.ExpiresAt,
+		LastUsed:  token.LastUsed,
+	}
+}
+
+func (s *Storage) CreateAPIToken(userID int, name, token string, scopes []string, expiresAt *time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.data.users[userID]; !exists {
+		return 0, fmt.Errorf("user not found")
+	}
+
+	t := s.begin()
+	counters, err := t.ids()
+	if err != nil {
+		return 0, err
+	}
+
+	counters.APITokenID++
+	tokenID := counters.APITokenID
+
+	t.put(tokensFile, tokenID, &apiTokenRecord{
+		ID:        tokenID,
+		UserID:    userID,
+		Name:      name,
+		TokenHash: s.hashToken(token),
+		Scopes:    append([]string(nil), scopes...),
+		CreatedAt: time.Now(),
+		ExpiresAt: expiresAt,
+	})
+
+	if err := t.commit(); err != nil {
+		return 0, err
+	}
+
+	return tokenID, nil
+}
+
+func (s *Storage) GetAPITokenByToken(token string) (*models.APIToken, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if token == "" {
+		return nil, fmt.Errorf("token not found")
+	}
+	id, exists := s.data.idx.apiTokenByHash[s.hashToken(token)]
+	if !exists {
+		return nil, fmt.Errorf("token not found")
+	}
+
+	return apiTokenModel(s.data.tokens[id]), nil
+}
+
+// GetUserAPITokens lists a user's tokens, newest first.
+func (s *Storage) GetUserAPITokens(userID int) ([]models.APIToken, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := make([]models.APIToken, 0, len(s.data.idx.apiTokensByUser[userID]))
+	for id := range s.data.idx.apiTokensByUser[userID] {
+		result = append(result, *apiTokenModel(s.data.tokens[id]))
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID > result[j].ID
+	})
+
+	return result, nil
+}
+
+func (s *Storage) TouchAPIToken(tokenID int, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token, exists := s.data.tokens[tokenID]
+	if !exists {
+		return fmt.Errorf("token not found")
+	}
+
+	updated := *token
+	updated.LastUsed = &at
+
+	t := s.begin()
+	t.put(tokensFile, tokenID, &updated)
+	return t.commit()
+}
+
+// DeleteAPIToken revokes one of the user's tokens.
+func (s *Storage) DeleteAPIToken(userID, tokenID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token, exists := s.data.tokens[tokenID]
+	if !exists || token.UserID != userID {
+		return fmt.Errorf("token not found")
+	}
+
+	t := s.begin()
+	t.remove(tokensFile, tokenID)
+	return t.commit()
+}
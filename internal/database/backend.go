@@ -0,0 +1,249 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const commitManifest = "commit.json"
+
+// A backend persists the resident dataset. readRaw and writeRaw expose every
+// collection plus schema.json in on-disk form, keyed by file name, so schema
+// migrations can see fields the current record types no longer know about.
+type backend interface {
+	load() (*dataset, error)
+	commit(d *dataset, ops []op) error
+	readRaw() (map[string]json.RawMessage, error)
+	writeRaw(files map[string]json.RawMessage) error
+	close() error
+}
+
+type fileBackend struct {
+	dir string
+}
+
+func newFileBackend(dir string) (*fileBackend, error) {
+	b := &fileBackend{dir: dir}
+	if err := b.recover(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (b *fileBackend) load() (*dataset, error) {
+	files, err := b.readRaw()
+	if err != nil {
+		return nil, err
+	}
+	return decodeDataset(files)
+}
+
+func (b *fileBackend) commit(d *dataset, ops []op) error {
+	files := make(map[string][]byte)
+	for _, o := range ops {
+		if _, done := files[o.collection]; done {
+			continue
+		}
+		data, err := json.MarshalIndent(d.collection(o.collection), "", "  ")
+		if err != nil {
+			return err
+		}
+		files[o.collection] = data
+	}
+	return b.writeFiles(files)
+}
+
+func (b *fileBackend) readRaw() (map[string]json.RawMessage, error) {
+	files := make(map[string]json.RawMessage)
+	for _, name := range append(collectionFiles, schemaFile) {
+		data, err := os.ReadFile(filepath.Join(b.dir, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(data) == 0 {
+			continue
+		}
+		files[name] = data
+	}
+	return files, nil
+}
+
+func (b *fileBackend) writeRaw(files map[string]json.RawMessage) error {
+	data := make(map[string][]byte, len(files))
+	for name, raw := range files {
+		data[name] = raw
+	}
+	return b.writeFiles(data)
+}
+
+func (b *fileBackend) close() error {
+	return nil
+}
+
+// writeFiles replaces every file in files or none of them. Each file is staged
+// next to its target, then a manifest naming the staged files is written
+// atomically. Once the manifest exists the commit is durable: renames that
+// do not complete now are rolled forward by recover on the next start.
+func (b *fileBackend) writeFiles(files map[string][]byte) error {
+	if len(files) == 1 {
+		for name, data := range files {
+			return writeFileAtomic(filepath.Join(b.dir, name), data)
+		}
+	}
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if err := writeFileSynced(b.tempPath(name), files[name]); err != nil {
+			b.discard(names)
+			return err
+		}
+	}
+
+	manifest, err := json.Marshal(names)
+	if err != nil {
+		b.discard(names)
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(b.dir, commitManifest), manifest); err != nil {
+		b.discard(names)
+		return err
+	}
+
+	return b.finish(names)
+}
+
+func (b *fileBackend) recover() error {
+	data, err := os.ReadFile(filepath.Join(b.dir, commitManifest))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		var names []string
+		if err := json.Unmarshal(data, &names); err != nil {
+			return err
+		}
+		if err := b.finish(names); err != nil {
+			return err
+		}
+	}
+
+	stale, err := filepath.Glob(filepath.Join(b.dir, "*.tmp"))
+	if err != nil {
+		return err
+	}
+	for _, path := range stale {
+		os.Remove(path)
+	}
+	return nil
+}
+
+func (b *fileBackend) finish(names []string) error {
+	for _, name := range names {
+		err := os.Rename(b.tempPath(name), filepath.Join(b.dir, name))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := syncDir(b.dir); err != nil {
+		return err
+	}
+	if err := os.Remove(filepath.Join(b.dir, commitManifest)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return syncDir(b.dir)
+}
+
+func (b *fileBackend) discard(names []string) {
+	for _, name := range names {
+		os.Remove(b.tempPath(name))
+	}
+}
+
+func (b *fileBackend) tempPath(name string) string {
+	return filepath.Join(b.dir, name+".tmp")
+}
+
+func decodeDataset(files map[string]json.RawMessage) (*dataset, error) {
+	d := newDataset()
+	for _, name := range collectionFiles {
+		raw, exists := files[name]
+		if !exists {
+			continue
+		}
+		if err := json.Unmarshal(raw, d.collection(name)); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return d, nil
+}
+
+func writeFileSynced(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := writeFileSynced(tmp, data); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+type memoryBackend struct{}
+
+func (memoryBackend) load() (*dataset, error) {
+	return newDataset(), nil
+}
+
+func (memoryBackend) commit(d *dataset, ops []op) error {
+	return nil
+}
+
+func (memoryBackend) readRaw() (map[string]json.RawMessage, error) {
+	return make(map[string]json.RawMessage), nil
+}
+
+func (memoryBackend) writeRaw(files map[string]json.RawMessage) error {
+	return nil
+}
+
+func (memoryBackend) close() error {
+	return nil
+}
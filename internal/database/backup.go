@@ -0,0 +1,296 @@
+package database
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const backupManifest = "manifest.json"
+
+type BackupManifest struct {
+	CreatedAt time.Time         `json:"created_at"`
+	Files     map[string]string `json:"files"`
+	// TokenKeyID identifies the token key the backup was made with, without
+	// revealing it. The key itself is not in the archive.
+	TokenKeyID string `json:"token_key_id,omitempty"`
+}
+
+// Backup writes a tar.gz of every collection, ids.json, schema.json and the
+// uploads directory to w, followed by a manifest of SHA-256 checksums. It
+// holds the storage read lock for the whole run, so the archive reflects a
+// single point in time.
+//
+// token.key is left out; see tokenKeyFile. Without it every stored token
+// hash is useless, so it has to be kept safe separately for sessions, API
+// tokens and emailed links to survive a restore.
+func (s *Storage) Backup(w io.Writer) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	files, err := s.backend.readRaw()
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	manifest := BackupManifest{
+		CreatedAt:  time.Now(),
+		Files:      make(map[string]string),
+		TokenKeyID: tokenKeyID(s.tokenKey),
+	}
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := writeTarEntry(tw, name, files[name], manifest.Files); err != nil {
+			return err
+		}
+	}
+
+	if s.dataDir != "" {
+		uploadsDir := filepath.Join(s.dataDir, "uploads")
+		entries, err := os.ReadDir(uploadsDir)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		for _, entry := range entries {
+			if !entry.Type().IsRegular() {
+				continue
+			}
+			data, err := os.ReadFile(filepath.Join(uploadsDir, entry.Name()))
+			if err != nil {
+				return err
+			}
+			if err := writeTarEntry(tw, "uploads/"+entry.Name(), data, manifest.Files); err != nil {
+				return err
+			}
+		}
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeTarEntry(tw, backupManifest, data, nil); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func writeTarEntry(tw *tar.Writer, name string, data []byte, sums map[string]string) error {
+	header := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: time.Now(),
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	if _, err := tw.Write(data); err != nil {
+		return err
+	}
+	if sums != nil {
+		sum := sha256.Sum256(data)
+		sums[name] = hex.EncodeToString(sum[:])
+	}
+	return nil
+}
+
+// RestoreBackup replaces the data in dataDir with the contents of a Backup
+// archive. The archive is unpacked into a staging directory and checked
+// against its manifest first; nothing in dataDir is touched unless every
+// file is present and matches. The replaced files are kept under
+// pre-restore-<time>/. The server must not be running.
+//
+// The token key the backup was made with must already be in dataDir, as
+// the archive does not hold it. If it is missing or another key is there,
+// RestoreBackup fails with ErrTokenKeyMismatch, unless newTokenKey is set:
+// then the restore goes ahead, the key in dataDir (if any) is set aside
+// with the replaced files and a new one is made on the next start, which
+// invalidates every session, API token and emailed link.
+func RestoreBackup(dataDir, archive string, newTokenKey bool) error {
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	stamp := time.Now().Format("20060102-150405")
+	staging := filepath.Join(dataDir, ".restore-"+stamp)
+	if err := os.MkdirAll(filepath.Join(staging, "uploads"), 0755); err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+
+	sums, manifest, err := unpackBackup(f, staging)
+	if err != nil {
+		return err
+	}
+	if manifest == nil {
+		return fmt.Errorf("archive has no %s", backupManifest)
+	}
+	for name, want := range manifest.Files {
+		got, exists := sums[name]
+		if !exists {
+			return fmt.Errorf("%s is listed in the manifest but missing from the archive", name)
+		}
+		if got != want {
+			return fmt.Errorf("%s: checksum mismatch", name)
+		}
+	}
+	for name := range sums {
+		if _, exists := manifest.Files[name]; !exists {
+			return fmt.Errorf("%s is not listed in the manifest", name)
+		}
+	}
+	keyMatches, err := tokenKeyMatches(dataDir, manifest.TokenKeyID)
+	if err != nil {
+		return err
+	}
+	if !keyMatches && !newTokenKey {
+		return ErrTokenKeyMismatch
+	}
+
+	previous := filepath.Join(dataDir, "pre-restore-"+stamp)
+	if err := os.MkdirAll(previous, 0755); err != nil {
+		return err
+	}
+	replaced := append([]string{"uploads", snapshotFile, journalFile, journalRotatedFile, commitManifest}, collectionFiles...)
+	replaced = append(replaced, schemaFile)
+	if !keyMatches {
+		replaced = append(replaced, tokenKeyFile)
+	}
+	for _, name := range replaced {
+		err := os.Rename(filepath.Join(dataDir, name), filepath.Join(previous, name))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	entries, err := os.ReadDir(staging)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := os.Rename(filepath.Join(staging, entry.Name()), filepath.Join(dataDir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return syncDir(dataDir)
+}
+
+// ErrTokenKeyMismatch is returned by RestoreBackup when the data directory
+// does not hold the token key the backup was made with.
+var ErrTokenKeyMismatch = errors.New(tokenKeyFile + " is missing or is not the one the backup was made with")
+
+// tokenKeyID returns a fingerprint of key, for telling keys apart in backup
+// manifests.
+func tokenKeyID(key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("camagru token key id"))
+	return hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+// tokenKeyMatches reports whether dataDir holds the token key with the
+// given id. Archives from before ids were recorded match any key.
+func tokenKeyMatches(dataDir, id string) (bool, error) {
+	if id == "" {
+		return true, nil
+	}
+	if _, err := os.Stat(filepath.Join(dataDir, tokenKeyFile)); os.IsNotExist(err) {
+		return false, nil
+	}
+	key, err := loadTokenKey(dataDir)
+	if err != nil {
+		return false, err
+	}
+	return tokenKeyID(key) == id, nil
+}
+
+func unpackBackup(r io.Reader, staging string) (map[string]string, *BackupManifest, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer gz.Close()
+
+	sums := make(map[string]string)
+	var manifest *BackupManifest
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if header.Typeflag != tar.TypeReg {
+			return nil, nil, fmt.Errorf("%s: unexpected entry type", header.Name)
+		}
+
+		name := path.Clean(header.Name)
+		if name == backupManifest {
+			manifest = &BackupManifest{}
+			if err := json.NewDecoder(tr).Decode(manifest); err != nil {
+				return nil, nil, fmt.Errorf("%s: %w", backupManifest, err)
+			}
+			continue
+		}
+		if !isBackupEntry(name) {
+			return nil, nil, fmt.Errorf("%s: unexpected file in archive", header.Name)
+		}
+
+		out, err := os.OpenFile(filepath.Join(staging, filepath.FromSlash(name)), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			return nil, nil, err
+		}
+		hash := sha256.New()
+		_, err = io.Copy(io.MultiWriter(out, hash), tr)
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		sums[name] = hex.EncodeToString(hash.Sum(nil))
+	}
+	return sums, manifest, nil
+}
+
+func isBackupEntry(name string) bool {
+	if strings.HasPrefix(name, "uploads/") {
+		base := strings.TrimPrefix(name, "uploads/")
+		return base != "" && !strings.Contains(base, "/") && base != ".." && base != "."
+	}
+	if name == schemaFile {
+		return true
+	}
+	for _, file := range collectionFiles {
+		if name == file {
+			return true
+		}
+	}
+	return false
+}
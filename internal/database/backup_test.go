@@ -0,0 +1,107 @@
+package database
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeTestBackup makes a storage in a new directory holding one user and
+// backs it up, returning the directory and the archive.
+func writeTestBackup(t *testing.T) (string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	s, err := NewStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.InitDB(); err != nil {
+		t.Fatal(err)
+	}
+	userID := createTestUser(t, s, "alice")
+	if _, err := s.CreateSession(userID, "alice-session", "", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	archive := filepath.Join(t.TempDir(), "backup.tar.gz")
+	f, err := os.Create(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := s.Backup(f); err != nil {
+		t.Fatal(err)
+	}
+	return dir, archive
+}
+
+func TestRestoreNeedsTheTokenKey(t *testing.T) {
+	dir, archive := writeTestBackup(t)
+
+	// Into the directory it came from, the key is already there.
+	if err := RestoreBackup(dir, archive, false); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetSessionByToken("alice-session"); err != nil {
+		t.Fatalf("session lost in the restore: %v", err)
+	}
+	s.Close()
+
+	// Elsewhere it has to be copied over first.
+	other := t.TempDir()
+	if err := RestoreBackup(other, archive, false); !errors.Is(err, ErrTokenKeyMismatch) {
+		t.Fatalf("restore without the key: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(other, usersFile)); !os.IsNotExist(err) {
+		t.Fatal("a refused restore wrote data")
+	}
+	if _, err := os.Stat(filepath.Join(other, tokenKeyFile)); !os.IsNotExist(err) {
+		t.Fatal("a refused restore made a token key")
+	}
+	key, err := os.ReadFile(filepath.Join(dir, tokenKeyFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(other, tokenKeyFile), key, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := RestoreBackup(other, archive, false); err != nil {
+		t.Fatalf("restore with the key copied over: %v", err)
+	}
+}
+
+func TestRestoreWithNewTokenKey(t *testing.T) {
+	_, archive := writeTestBackup(t)
+
+	// A directory holding another key.
+	other := t.TempDir()
+	s, err := NewStorage(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	if err := RestoreBackup(other, archive, false); !errors.Is(err, ErrTokenKeyMismatch) {
+		t.Fatalf("restore over another key: %v", err)
+	}
+
+	if err := RestoreBackup(other, archive, true); err != nil {
+		t.Fatal(err)
+	}
+	s, err = NewStorage(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err := s.GetUserByUsernameOrEmail("alice"); err != nil {
+		t.Fatalf("data not restored: %v", err)
+	}
+	if _, err := s.GetSessionByToken("alice-session"); err == nil {
+		t.Fatal("session survived a new token key")
+	}
+}
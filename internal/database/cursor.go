@@ -0,0 +1,91 @@
+package database
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// imageCursor is a position in the newest-first image order: the
+// created_at and ID of the last image a client has seen. Because it names
+// an image rather than an offset, images added since do not shift later
+// pages.
+type imageCursor struct {
+	createdAt time.Time
+	id        int
+}
+
+func cursorAt(img *imageRecord) imageCursor {
+	return imageCursor{createdAt: img.CreatedAt, id: img.ID}
+}
+
+// String encodes the cursor as an opaque token for clients.
+func (c imageCursor) String() string {
+	raw := fmt.Sprintf("%d:%d", c.createdAt.UnixNano(), c.id)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func parseImageCursor(token string) (imageCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return imageCursor{}, ErrInvalidCursor
+	}
+	var nanos int64
+	var id int
+	if _, err := fmt.Sscanf(string(raw), "%d:%d", &nanos, &id); err != nil || id <= 0 {
+		return imageCursor{}, ErrInvalidCursor
+	}
+	return imageCursor{createdAt: time.Unix(0, nanos), id: id}, nil
+}
+
+// precedes reports whether an image at c comes before img in newest-first
+// order. Images created at the same instant are ordered by descending ID.
+func (c imageCursor) precedes(img *imageRecord) bool {
+	if !c.createdAt.Equal(img.CreatedAt) {
+		return c.createdAt.After(img.CreatedAt)
+	}
+	return c.id > img.ID
+}
+
+func sortNewestFirst(images []*imageRecord) {
+	sort.Slice(images, func(i, j int) bool {
+		return cursorAt(images[i]).precedes(images[j])
+	})
+}
+
+// pageImages returns up to limit images from the newest-first order that
+// match keep and come after the cursor token, along with the cursor for the
+// following page. The next cursor is empty on the last page. Callers hold
+// s.mu.
+func (s *Storage) pageImages(token string, limit int, keep func(img *imageRecord) bool) ([]*imageRecord, string, error) {
+	var after *imageCursor
+	if token != "" {
+		c, err := parseImageCursor(token)
+		if err != nil {
+			return nil, "", err
+		}
+		after = &c
+	}
+
+	imageList := make([]*imageRecord, 0)
+	for _, img := range s.data.images {
+		if keep != nil && !keep(img) {
+			continue
+		}
+		if after != nil && !after.precedes(img) {
+			continue
+		}
+		imageList = append(imageList, img)
+	}
+	sortNewestFirst(imageList)
+
+	if limit <= 0 || len(imageList) <= limit {
+		return imageList, "", nil
+	}
+	imageList = imageList[:limit]
+	return imageList, cursorAt(imageList[limit-1]).String(), nil
+}
@@ -0,0 +1,97 @@
+package database
+
+import (
+	"encoding/base64"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestImageCursorRoundTrip(t *testing.T) {
+	c := imageCursor{createdAt: time.Unix(0, 1700000000123456789), id: 42}
+	got, err := parseImageCursor(c.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.createdAt.Equal(c.createdAt) || got.id != c.id {
+		t.Fatalf("got %+v, want %+v", got, c)
+	}
+}
+
+func TestParseImageCursorRejectsTampering(t *testing.T) {
+	encode := func(raw string) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(raw))
+	}
+	for _, token := range []string{
+		"not base64!",
+		encode("garbage"),
+		encode("1700000000:"),
+		encode(":42"),
+		encode("1700000000:0"),
+		encode("1700000000:-5"),
+		encode("x:42"),
+	} {
+		if _, err := parseImageCursor(token); err != ErrInvalidCursor {
+			t.Errorf("%q: got %v", token, err)
+		}
+	}
+}
+
+// pageIDs walks GetImagesByCursor from cursor to the end and returns the
+// IDs it saw.
+func pageIDs(t *testing.T, s *Storage, cursor string, limit int) []int {
+	t.Helper()
+	var ids []int
+	for {
+		images, next, err := s.GetImagesByCursor(cursor, limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, img := range images {
+			ids = append(ids, img.ID)
+		}
+		if next == "" {
+			return ids
+		}
+		cursor = next
+	}
+}
+
+func TestImagePaging(t *testing.T) {
+	s := NewMemoryStorage()
+	userID := createTestUser(t, s, "alice")
+	base := time.Now().Add(-time.Hour)
+	for id := 1; id <= 5; id++ {
+		created := base.Add(time.Duration(id) * time.Second)
+		if id == 4 {
+			// Created at the same instant as image 3.
+			created = base.Add(3 * time.Second)
+		}
+		s.data.images[id] = &imageRecord{ID: id, UserID: userID, CreatedAt: created}
+	}
+	s.data.ids.ImageID = 5
+
+	if ids := pageIDs(t, s, "", 2); !reflect.DeepEqual(ids, []int{5, 4, 3, 2, 1}) {
+		t.Fatalf("pages = %v", ids)
+	}
+
+	// A cursor stays valid after the image it names is deleted, and new
+	// images do not shift the pages after it.
+	_, cursor, err := s.GetImagesByCursor("", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteImage(4); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.CreateImage(userID, "/static/uploads/new.png"); err != nil {
+		t.Fatal(err)
+	}
+	if ids := pageIDs(t, s, cursor, 2); !reflect.DeepEqual(ids, []int{3, 2, 1}) {
+		t.Fatalf("pages after a stale cursor = %v", ids)
+	}
+
+	if _, _, err := s.GetImagesByCursor("bogus!", 2); err != ErrInvalidCursor {
+		t.Fatalf("tampered cursor: %v", err)
+	}
+}
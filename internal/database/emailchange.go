@@ -0,0 +1,138 @@
+package database
+
+import (
+	"camagru/internal/models"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrEmailUndoPending is returned for an email change requested while the
+// previous one can still be undone. Allowing it would replace the address
+// and link the undo restores, so the old owner could lose their way back.
+var ErrEmailUndoPending = errors.New("previous email change can still be undone")
+
+// undoPending reports whether user's last email change can still be undone.
+func undoPending(user *userRecord) bool {
+	return user.EmailUndoToken != "" &&
+		(user.EmailUndoExpires == nil || time.Now().Before(*user.EmailUndoExpires))
+}
+
+// SetPendingEmail records an email address the user wants to switch to. It
+// takes effect only once ConfirmEmailChange is called with token.
+func (s *Storage) SetPendingEmail(userID int, email, token string, expires time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, exists := s.data.users[userID]
+	if !exists {
+		return fmt.Errorf("user not found")
+	}
+	if undoPending(user) {
+		return ErrEmailUndoPending
+	}
+	if id, taken := s.data.idx.userByEmail[email]; taken && id != userID {
+		return fmt.Errorf("email already taken")
+	}
+
+	updated := *user
+	updated.PendingEmail = email
+	updated.EmailChangeToken = s.hashToken(token)
+	updated.EmailChangeExpires = &expires
+
+	t := s.begin()
+	t.put(usersFile, userID, &updated)
+	return t.commit()
+}
+
+// ConfirmEmailChange switches the holder of token to their pending email.
+// The old address is kept, together with undoToken, so that its owner can
+// revert the change until undoExpires. It returns the updated user and the
+// old address.
+func (s *Storage) ConfirmEmailChange(token, undoToken string, undoExpires time.Time) (*models.User, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if token == "" {
+		return nil, "", fmt.Errorf("invalid confirmation token")
+	}
+	userID, exists := s.data.idx.emailChangeByHash[s.hashToken(token)]
+	if !exists {
+		return nil, "", fmt.Errorf("invalid confirmation token")
+	}
+	user := s.data.users[userID]
+	if user.EmailChangeExpires != nil && time.Now().After(*user.EmailChangeExpires) {
+		return nil, "", fmt.Errorf("token expired")
+	}
+	// SetPendingEmail already refuses this, but an undo may have become
+	// pending since.
+	if undoPending(user) {
+		return nil, "", ErrEmailUndoPending
+	}
+	if id, taken := s.data.idx.userByEmail[user.PendingEmail]; taken && id != user.ID {
+		return nil, "", fmt.Errorf("email already taken")
+	}
+
+	updated := *user
+	updated.PreviousEmail = user.Email
+	updated.Email = user.PendingEmail
+	updated.PendingEmail = ""
+	updated.EmailChangeToken = ""
+	updated.EmailChangeExpires = nil
+	updated.EmailUndoToken = s.hashToken(undoToken)
+	updated.EmailUndoExpires = &undoExpires
+
+	t := s.begin()
+	t.put(usersFile, user.ID, &updated)
+	if err := t.commit(); err != nil {
+		return nil, "", err
+	}
+	return userModel(&updated), user.Email, nil
+}
+
+// UndoEmailChange puts back the address a confirmed email change replaced.
+// Whoever made the change may still be signed in, so every session of the
+// user is ended and their API tokens are revoked as well.
+func (s *Storage) UndoEmailChange(token string) (*models.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if token == "" {
+		return nil, fmt.Errorf("invalid undo token")
+	}
+	userID, exists := s.data.idx.emailUndoByHash[s.hashToken(token)]
+	if !exists {
+		return nil, fmt.Errorf("invalid undo token")
+	}
+	user := s.data.users[userID]
+	if user.EmailUndoExpires != nil && time.Now().After(*user.EmailUndoExpires) {
+		return nil, fmt.Errorf("token expired")
+	}
+	if id, taken := s.data.idx.userByEmail[user.PreviousEmail]; taken && id != user.ID {
+		return nil, fmt.Errorf("email already taken")
+	}
+
+	updated := *user
+	updated.Email = user.PreviousEmail
+	updated.PreviousEmail = ""
+	updated.PendingEmail = ""
+	updated.EmailChangeToken = ""
+	updated.EmailChangeExpires = nil
+	updated.EmailUndoToken = ""
+	updated.EmailUndoExpires = nil
+	updated.MagicLinkToken = ""
+	updated.MagicLinkExpires = nil
+
+	t := s.begin()
+	t.put(usersFile, user.ID, &updated)
+	for id := range s.data.idx.sessionsByUser[user.ID] {
+		t.remove(sessionsFile, id)
+	}
+	for id := range s.data.idx.apiTokensByUser[user.ID] {
+		t.remove(tokensFile, id)
+	}
+	if err := t.commit(); err != nil {
+		return nil, err
+	}
+	return userModel(&updated), nil
+}
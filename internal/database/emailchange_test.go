@@ -0,0 +1,93 @@
+package database
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestEmailChangeAndUndo(t *testing.T) {
+	s := NewMemoryStorage()
+	userID := createTestUser(t, s, "alice")
+	if _, err := s.CreateSession(userID, "alice-session", "", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.SetPendingEmail(userID, "new@example.com", "change", time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.ConfirmEmailChange("wrong", "undo", time.Now().Add(time.Hour)); err == nil {
+		t.Fatal("confirmed with the wrong token")
+	}
+	user, oldEmail, err := s.ConfirmEmailChange("change", "undo", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Email != "new@example.com" || oldEmail != "alice@example.com" {
+		t.Fatalf("confirmed %q, old %q", user.Email, oldEmail)
+	}
+	if _, _, err := s.ConfirmEmailChange("change", "undo", time.Now().Add(time.Hour)); err == nil {
+		t.Fatal("confirmation token used twice")
+	}
+	checkIndexes(t, s.data, "after confirming")
+
+	user, err = s.UndoEmailChange("undo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Email != "alice@example.com" {
+		t.Fatalf("undo restored %q", user.Email)
+	}
+	if _, err := s.GetSessionByToken("alice-session"); err == nil {
+		t.Fatal("undo left a session behind")
+	}
+	if _, err := s.UndoEmailChange("undo"); err == nil {
+		t.Fatal("undo token used twice")
+	}
+	checkIndexes(t, s.data, "after undoing")
+}
+
+func TestEmailChangeWaitsForPendingUndo(t *testing.T) {
+	s := NewMemoryStorage()
+	userID := createTestUser(t, s, "alice")
+	if err := s.SetPendingEmail(userID, "second@example.com", "change1", time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	// A second change requested before the first is confirmed.
+	if err := s.SetPendingEmail(userID, "third@example.com", "change2", time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.ConfirmEmailChange("change2", "undo1", time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.SetPendingEmail(userID, "fourth@example.com", "change3", time.Now().Add(time.Hour)); !errors.Is(err, ErrEmailUndoPending) {
+		t.Fatalf("change during the undo window: %v", err)
+	}
+
+	// The first owner's link still brings back their address.
+	user, err := s.UndoEmailChange("undo1")
+	if err != nil || user.Email != "alice@example.com" {
+		t.Fatalf("undo: %+v, %v", user, err)
+	}
+	if err := s.SetPendingEmail(userID, "fourth@example.com", "change3", time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("change after the undo: %v", err)
+	}
+}
+
+func TestEmailChangeAfterUndoWindow(t *testing.T) {
+	s := NewMemoryStorage()
+	userID := createTestUser(t, s, "alice")
+	if err := s.SetPendingEmail(userID, "second@example.com", "change1", time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.ConfirmEmailChange("change1", "undo1", time.Now().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetPendingEmail(userID, "third@example.com", "change2", time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("change after the undo window: %v", err)
+	}
+	if _, err := s.UndoEmailChange("undo1"); err == nil {
+		t.Fatal("expired undo link worked")
+	}
+}
@@ -0,0 +1,227 @@
+package database
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const uploadsURLPrefix = "/static/uploads/"
+
+type FsckReport struct {
+	OrphanImages   []int
+	OrphanLikes    []int
+	OrphanComments []int
+	OrphanSessions []int
+	OrphanTokens   []int
+	OrphanInvites  []int
+	MissingFiles   []int
+	StrayFiles     []string
+	Counters       []string
+	Repaired       bool
+}
+
+func (r *FsckReport) Clean() bool {
+	return len(r.OrphanImages) == 0 && len(r.OrphanLikes) == 0 && len(r.OrphanComments) == 0 && len(r.OrphanSessions) == 0 &&
+		len(r.OrphanTokens) == 0 && len(r.OrphanInvites) == 0 && len(r.MissingFiles) == 0 && len(r.StrayFiles) == 0 && len(r.Counters) == 0
+}
+
+// Fsck looks for records and upload files that have drifted apart. With
+// repair set it deletes orphaned images, likes, comments, sessions, API
+// tokens and invites, drops image records whose file is gone, moves stray
+// uploads
+// into quarantine/ and raises ID counters that fell behind. Upload files
+// are only checked when checkUploads is set, as they live elsewhere with a
+// remote blob store. It holds the write lock throughout.
+func (s *Storage) Fsck(repair, checkUploads bool) (*FsckReport, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	report := &FsckReport{}
+	d := s.data
+	uploadsDir := filepath.Join(s.dataDir, "uploads")
+
+	// Images whose owner is gone are dropped, so their files count as
+	// stray unless another image shares them.
+	orphaned := make(map[int]bool)
+	for id, img := range d.images {
+		if _, exists := d.users[img.UserID]; !exists {
+			report.OrphanImages = append(report.OrphanImages, id)
+			orphaned[id] = true
+		}
+	}
+
+	referenced := make(map[string]bool)
+	if s.dataDir != "" && checkUploads {
+		for id, img := range d.images {
+			if orphaned[id] || !strings.HasPrefix(img.Path, uploadsURLPrefix) {
+				continue
+			}
+			name := strings.TrimPrefix(img.Path, uploadsURLPrefix)
+			referenced[name] = true
+			if _, err := os.Stat(filepath.Join(uploadsDir, name)); os.IsNotExist(err) {
+				report.MissingFiles = append(report.MissingFiles, id)
+			} else if err != nil {
+				return nil, err
+			}
+		}
+
+		entries, err := os.ReadDir(uploadsDir)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+			if !referenced[entry.Name()] {
+				report.StrayFiles = append(report.StrayFiles, entry.Name())
+			}
+		}
+	}
+
+	missing := make(map[int]bool)
+	for _, id := range report.MissingFiles {
+		missing[id] = true
+	}
+	for id := range orphaned {
+		missing[id] = true
+	}
+	for id, like := range d.likes {
+		if _, exists := d.images[like.ImageID]; !exists || missing[like.ImageID] {
+			report.OrphanLikes = append(report.OrphanLikes, id)
+		} else if _, exists := d.users[like.UserID]; !exists {
+			report.OrphanLikes = append(report.OrphanLikes, id)
+		}
+	}
+	for id, comment := range d.comments {
+		if _, exists := d.images[comment.ImageID]; !exists || missing[comment.ImageID] {
+			report.OrphanComments = append(report.OrphanComments, id)
+		} else if _, exists := d.users[comment.UserID]; !exists && comment.UserID != 0 {
+			report.OrphanComments = append(report.OrphanComments, id)
+		}
+	}
+
+	for id, session := range d.sessions {
+		if _, exists := d.users[session.UserID]; !exists {
+			report.OrphanSessions = append(report.OrphanSessions, id)
+		}
+	}
+	for id, token := range d.tokens {
+		if _, exists := d.users[token.UserID]; !exists {
+			report.OrphanTokens = append(report.OrphanTokens, id)
+		}
+	}
+	for id, invite := range d.invites {
+		if _, exists := d.users[invite.CreatedBy]; !exists {
+			report.OrphanInvites = append(report.OrphanInvites, id)
+		}
+	}
+
+	counters := d.ids
+	bump := func(name string, counter *int, highest int) {
+		if highest > *counter {
+			report.Counters = append(report.Counters, fmt.Sprintf("%s is %d but ID %d exists", name, *counter, highest))
+			*counter = highest
+		}
+	}
+	highest := 0
+	for id := range d.users {
+		highest = max(highest, id)
+	}
+	bump("user_id", &counters.UserID, highest)
+	highest = 0
+	for id := range d.images {
+		highest = max(highest, id)
+	}
+	bump("image_id", &counters.ImageID, highest)
+	highest = 0
+	for id := range d.likes {
+		highest = max(highest, id)
+	}
+	bump("like_id", &counters.LikeID, highest)
+	highest = 0
+	for id := range d.comments {
+		highest = max(highest, id)
+	}
+	bump("comment_id", &counters.CommentID, highest)
+	highest = 0
+	for id := range d.assets {
+		highest = max(highest, id)
+	}
+	bump("asset_id", &counters.AssetID, highest)
+	highest = 0
+	for id := range d.sessions {
+		highest = max(highest, id)
+	}
+	bump("session_id", &counters.SessionID, highest)
+	highest = 0
+	for id := range d.tokens {
+		highest = max(highest, id)
+	}
+	bump("api_token_id", &counters.APITokenID, highest)
+	highest = 0
+	for id := range d.invites {
+		highest = max(highest, id)
+	}
+	bump("invite_id", &counters.InviteID, highest)
+
+	sort.Ints(report.OrphanImages)
+	sort.Ints(report.OrphanLikes)
+	sort.Ints(report.OrphanComments)
+	sort.Ints(report.OrphanSessions)
+	sort.Ints(report.OrphanTokens)
+	sort.Ints(report.OrphanInvites)
+	sort.Ints(report.MissingFiles)
+	sort.Strings(report.StrayFiles)
+
+	if !repair || report.Clean() {
+		return report, nil
+	}
+
+	t := s.begin()
+	for _, id := range report.OrphanImages {
+		t.remove(imagesFile, id)
+	}
+	for _, id := range report.OrphanLikes {
+		t.remove(likesFile, id)
+	}
+	for _, id := range report.OrphanComments {
+		t.remove(commentsFile, id)
+	}
+	for _, id := range report.OrphanSessions {
+		t.remove(sessionsFile, id)
+	}
+	for _, id := range report.OrphanTokens {
+		t.remove(tokensFile, id)
+	}
+	for _, id := range report.OrphanInvites {
+		t.remove(invitesFile, id)
+	}
+	for _, id := range report.MissingFiles {
+		t.remove(imagesFile, id)
+	}
+	if len(report.Counters) > 0 {
+		t.counters = &counters
+	}
+	if err := t.commit(); err != nil {
+		return nil, err
+	}
+
+	if len(report.StrayFiles) > 0 {
+		quarantine := filepath.Join(s.dataDir, "quarantine")
+		if err := os.MkdirAll(quarantine, 0755); err != nil {
+			return nil, err
+		}
+		for _, name := range report.StrayFiles {
+			if err := os.Rename(filepath.Join(uploadsDir, name), filepath.Join(quarantine, name)); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	report.Repaired = true
+	return report, nil
+}
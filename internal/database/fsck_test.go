@@ -0,0 +1,74 @@
+package database
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFsckRepairsOrphanImages(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.InitDB(); err != nil {
+		t.Fatal(err)
+	}
+	aliceID := createTestUser(t, s, "alice")
+	bobID := createTestUser(t, s, "bob")
+	if err := os.MkdirAll(filepath.Join(dir, "uploads"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"alice.jpg", "bob.jpg"} {
+		if err := os.WriteFile(filepath.Join(dir, "uploads", name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	aliceImage, err := s.CreateImage(aliceID, uploadsURLPrefix+"alice.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobImage, err := s.CreateImage(bobID, uploadsURLPrefix+"bob.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CreateLike(bobID, aliceImage); err != nil {
+		t.Fatal(err)
+	}
+
+	// Alice's account disappears without her content, as a crash part way
+	// through an older, non-transactional delete could leave it.
+	s.mu.Lock()
+	tx := s.begin()
+	tx.remove(usersFile, aliceID)
+	err = tx.commit()
+	s.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := s.Fsck(true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(report.OrphanImages, []int{aliceImage}) || len(report.OrphanLikes) != 1 ||
+		!reflect.DeepEqual(report.StrayFiles, []string{"alice.jpg"}) || !report.Repaired {
+		t.Fatalf("report = %+v", report)
+	}
+	if _, err := s.GetImageByID(aliceImage); err == nil {
+		t.Fatal("orphan image left behind")
+	}
+	if _, err := s.GetImageByID(bobImage); err != nil {
+		t.Fatalf("bob's image: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "quarantine", "alice.jpg")); err != nil {
+		t.Fatalf("orphan image's file not quarantined: %v", err)
+	}
+
+	if report, err := s.Fsck(false, true); err != nil || !report.Clean() {
+		t.Fatalf("after repair: %+v, %v", report, err)
+	}
+}
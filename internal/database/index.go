@@ -0,0 +1,166 @@
+package database
+
+type likeKey struct {
+	userID  int
+	imageID int
+}
+
+// indexes are secondary lookups over the resident collections. They are
+// rebuilt on open and kept current by dataset.apply, so they never need to
+// be persisted.
+type indexes struct {
+	userByUsername    map[string]int
+	userByEmail       map[string]int
+	emailChangeByHash map[string]int
+	emailUndoByHash   map[string]int
+	likeByPair        map[likeKey]int
+	likesByImage      map[int]map[int]bool
+	commentsByImage   map[int]map[int]bool
+	sessionByToken    map[string]int
+	sessionsByUser    map[int]map[int]bool
+	apiTokenByHash    map[string]int
+	apiTokensByUser   map[int]map[int]bool
+	inviteByHash      map[string]int
+	invitesByUser     map[int]map[int]bool
+}
+
+func (d *dataset) reindex() {
+	d.idx = indexes{
+		userByUsername:    make(map[string]int),
+		userByEmail:       make(map[string]int),
+		emailChangeByHash: make(map[string]int),
+		emailUndoByHash:   make(map[string]int),
+		likeByPair:        make(map[likeKey]int),
+		likesByImage:      make(map[int]map[int]bool),
+		commentsByImage:   make(map[int]map[int]bool),
+		sessionByToken:    make(map[string]int),
+		sessionsByUser:    make(map[int]map[int]bool),
+		apiTokenByHash:    make(map[string]int),
+		apiTokensByUser:   make(map[int]map[int]bool),
+		inviteByHash:      make(map[string]int),
+		invitesByUser:     make(map[int]map[int]bool),
+	}
+	for _, user := range d.users {
+		d.indexUser(user)
+	}
+	for _, like := range d.likes {
+		d.indexLike(like)
+	}
+	for _, comment := range d.comments {
+		d.indexComment(comment)
+	}
+	for _, session := range d.sessions {
+		d.indexSession(session)
+	}
+	for _, token := range d.tokens {
+		d.indexAPIToken(token)
+	}
+	for _, invite := range d.invites {
+		d.indexInvite(invite)
+	}
+}
+
+func (d *dataset) indexUser(user *userRecord) {
+	d.idx.userByUsername[user.Username] = user.ID
+	d.idx.userByEmail[user.Email] = user.ID
+	if user.EmailChangeToken != "" {
+		d.idx.emailChangeByHash[user.EmailChangeToken] = user.ID
+	}
+	if user.EmailUndoToken != "" {
+		d.idx.emailUndoByHash[user.EmailUndoToken] = user.ID
+	}
+}
+
+func (d *dataset) unindexUser(user *userRecord) {
+	unindexString(d.idx.userByUsername, user.Username, user.ID)
+	unindexString(d.idx.userByEmail, user.Email, user.ID)
+	unindexString(d.idx.emailChangeByHash, user.EmailChangeToken, user.ID)
+	unindexString(d.idx.emailUndoByHash, user.EmailUndoToken, user.ID)
+}
+
+func (d *dataset) indexLike(like *likeRecord) {
+	d.idx.likeByPair[likeKey{like.UserID, like.ImageID}] = like.ID
+	addToSet(d.idx.likesByImage, like.ImageID, like.ID)
+}
+
+func (d *dataset) unindexLike(like *likeRecord) {
+	key := likeKey{like.UserID, like.ImageID}
+	if d.idx.likeByPair[key] == like.ID {
+		delete(d.idx.likeByPair, key)
+	}
+	removeFromSet(d.idx.likesByImage, like.ImageID, like.ID)
+}
+
+func (d *dataset) indexComment(comment *commentRecord) {
+	addToSet(d.idx.commentsByImage, comment.ImageID, comment.ID)
+}
+
+func (d *dataset) unindexComment(comment *commentRecord) {
+	removeFromSet(d.idx.commentsByImage, comment.ImageID, comment.ID)
+}
+
+func (d *dataset) indexSession(session *sessionRecord) {
+	d.idx.sessionByToken[session.TokenHash] = session.ID
+	addToSet(d.idx.sessionsByUser, session.UserID, session.ID)
+}
+
+func (d *dataset) unindexSession(session *sessionRecord) {
+	unindexString(d.idx.sessionByToken, session.TokenHash, session.ID)
+	removeFromSet(d.idx.sessionsByUser, session.UserID, session.ID)
+}
+
+func (d *dataset) indexAPIToken(token *apiTokenRecord) {
+	d.idx.apiTokenByHash[token.TokenHash] = token.ID
+	addToSet(d.idx.apiTokensByUser, token.UserID, token.ID)
+}
+
+func (d *dataset) unindexAPIToken(token *apiTokenRecord) {
+	unindexString(d.idx.apiTokenByHash, token.TokenHash, token.ID)
+	removeFromSet(d.idx.apiTokensByUser, token.UserID, token.ID)
+}
+
+func (d *dataset) indexInvite(invite *inviteRecord) {
+	d.idx.inviteByHash[invite.CodeHash] = invite.ID
+	addToSet(d.idx.invitesByUser, invite.CreatedBy, invite.ID)
+}
+
+func (d *dataset) unindexInvite(invite *inviteRecord) {
+	unindexString(d.idx.inviteByHash, invite.CodeHash, invite.ID)
+	removeFromSet(d.idx.invitesByUser, invite.CreatedBy, invite.ID)
+}
+
+func (d *dataset) userByUsernameOrEmail(usernameOrEmail string) (*userRecord, bool) {
+	if id, exists := d.idx.userByUsername[usernameOrEmail]; exists {
+		return d.users[id], true
+	}
+	if id, exists := d.idx.userByEmail[usernameOrEmail]; exists {
+		return d.users[id], true
+	}
+	return nil, false
+}
+
+func unindexString(index map[string]int, key string, id int) {
+	if current, exists := index[key]; exists && current == id {
+		delete(index, key)
+	}
+}
+
+func addToSet(index map[int]map[int]bool, key, id int) {
+	set, exists := index[key]
+	if !exists {
+		set = make(map[int]bool)
+		index[key] = set
+	}
+	set[id] = true
+}
+
+func removeFromSet(index map[int]map[int]bool, key, id int) {
+	set, exists := index[key]
+	if !exists {
+		return
+	}
+	delete(set, id)
+	if len(set) == 0 {
+		delete(index, key)
+	}
+}
@@ -0,0 +1,173 @@
+package database
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Sizes of the benchmark fixture, roughly an instance with 100k of each
+// kind of record.
+const (
+	fixtureUsers    = 1000
+	fixtureImages   = 10000
+	fixtureRecords  = 100000
+	fixturePageSize = 20
+)
+
+var fixture *Storage
+
+// benchStorage returns a memory storage holding the benchmark fixture. It is
+// built once and shared, so benchmarks must not change it.
+func benchStorage(b *testing.B) *Storage {
+	b.Helper()
+	if fixture != nil {
+		return fixture
+	}
+
+	s := NewMemoryStorage()
+	d := s.data
+	now := time.Now()
+	for id := 1; id <= fixtureUsers; id++ {
+		d.users[id] = &userRecord{
+			ID:       id,
+			Username: fmt.Sprintf("user%d", id),
+			Email:    fmt.Sprintf("user%d@example.com", id),
+			Verified: true,
+		}
+	}
+	for id := 1; id <= fixtureImages; id++ {
+		d.images[id] = &imageRecord{ID: id, UserID: id%fixtureUsers + 1, CreatedAt: now}
+	}
+	for id := 1; id <= fixtureRecords; id++ {
+		// Every user likes and comments on a hundred images, spread
+		// evenly over all of them.
+		userID := (id-1)/(fixtureRecords/fixtureUsers) + 1
+		imageID := (id*7919)%fixtureImages + 1
+		d.likes[id] = &likeRecord{ID: id, UserID: userID, ImageID: imageID, CreatedAt: now}
+		d.comments[id] = &commentRecord{
+			ID:        id,
+			ImageID:   imageID,
+			UserID:    userID,
+			Body:      "nice",
+			CreatedAt: now.Add(time.Duration(id) * time.Second),
+		}
+		d.sessions[id] = &sessionRecord{
+			ID:        id,
+			UserID:    userID,
+			TokenHash: s.hashToken(fmt.Sprintf("token%d", id)),
+			CreatedAt: now,
+			LastSeen:  now,
+		}
+	}
+	d.reindex()
+	fixture = s
+	return s
+}
+
+func BenchmarkLikeExists(b *testing.B) {
+	s := benchStorage(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.LikeExists(i%fixtureUsers+1, i%fixtureImages+1)
+	}
+}
+
+func BenchmarkGetLikedImageIDs(b *testing.B) {
+	s := benchStorage(b)
+	page := make([]int, fixturePageSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := range page {
+			page[j] = (i*fixturePageSize+j)%fixtureImages + 1
+		}
+		s.GetLikedImageIDs(i%fixtureUsers+1, page)
+	}
+}
+
+func BenchmarkGetCommentsByImageID(b *testing.B) {
+	s := benchStorage(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.GetCommentsByImageID(i%fixtureImages+1, fixturePageSize)
+	}
+}
+
+func BenchmarkGetSessionByToken(b *testing.B) {
+	s := benchStorage(b)
+	tokens := make([]string, 1024)
+	for i := range tokens {
+		tokens[i] = fmt.Sprintf("token%d", i*97%fixtureRecords+1)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := s.GetSessionByToken(tokens[i%len(tokens)]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// checkIndexes fails the test unless d's indexes match those rebuilt from
+// scratch over its collections.
+func checkIndexes(t *testing.T, d *dataset, when string) {
+	t.Helper()
+	fresh := *d
+	fresh.reindex()
+	if !reflect.DeepEqual(d.idx, fresh.idx) {
+		t.Fatalf("%s: indexes are stale\n got: %+v\nwant: %+v", when, d.idx, fresh.idx)
+	}
+}
+
+func TestApplyKeepsIndexesConsistent(t *testing.T) {
+	d := newDataset()
+	now := time.Now()
+	steps := []struct {
+		name string
+		op   op
+	}{
+		{"put user", op{usersFile, 1, &userRecord{ID: 1, Username: "alice", Email: "alice@example.com"}}},
+		{"put second user", op{usersFile, 2, &userRecord{ID: 2, Username: "bob", Email: "bob@example.com"}}},
+		{"rename user", op{usersFile, 1, &userRecord{ID: 1, Username: "alice2", Email: "alice2@example.com"}}},
+		{"change email", op{usersFile, 2, &userRecord{ID: 2, Username: "bob", Email: "bob@example.com", EmailChangeToken: "c1"}}},
+		{"confirm email", op{usersFile, 2, &userRecord{ID: 2, Username: "bob", Email: "bob2@example.com", EmailUndoToken: "u1"}}},
+		{"put like", op{likesFile, 1, &likeRecord{ID: 1, UserID: 1, ImageID: 10}}},
+		{"put second like", op{likesFile, 2, &likeRecord{ID: 2, UserID: 2, ImageID: 10}}},
+		{"move like", op{likesFile, 1, &likeRecord{ID: 1, UserID: 1, ImageID: 11}}},
+		{"put comment", op{commentsFile, 1, &commentRecord{ID: 1, ImageID: 10, UserID: 1, CreatedAt: now}}},
+		{"put session", op{sessionsFile, 1, &sessionRecord{ID: 1, UserID: 1, TokenHash: "s1"}}},
+		{"put second session", op{sessionsFile, 2, &sessionRecord{ID: 2, UserID: 1, TokenHash: "s2"}}},
+		{"put token", op{tokensFile, 1, &apiTokenRecord{ID: 1, UserID: 2, TokenHash: "t1"}}},
+		{"put invite", op{invitesFile, 1, &inviteRecord{ID: 1, CreatedBy: 1, CodeHash: "i1"}}},
+		{"remove like", op{likesFile, 2, nil}},
+		{"remove comment", op{commentsFile, 1, nil}},
+		{"remove session", op{sessionsFile, 1, nil}},
+		{"remove token", op{tokensFile, 1, nil}},
+		{"remove invite", op{invitesFile, 1, nil}},
+		{"remove user", op{usersFile, 2, nil}},
+		{"remove missing record", op{likesFile, 99, nil}},
+	}
+
+	var undo []op
+	for _, step := range steps {
+		prev, err := d.apply(step.op)
+		if err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		undo = append(undo, prev)
+		checkIndexes(t, d, step.name)
+	}
+
+	// Reverting part way and then entirely must leave the indexes as they
+	// were at each point.
+	d.revert(undo[13:])
+	checkIndexes(t, d, "revert removals")
+	if _, exists := d.idx.likeByPair[likeKey{2, 10}]; !exists {
+		t.Fatal("revert removals: like not restored")
+	}
+	d.revert(undo[:13])
+	checkIndexes(t, d, "revert all")
+	if len(d.users) != 0 || len(d.idx.userByUsername) != 0 || len(d.idx.sessionByToken) != 0 {
+		t.Fatalf("revert all: dataset not empty: %+v", d.idx)
+	}
+}
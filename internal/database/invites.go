@@ -0,0 +1,206 @@
+package database
+
+import (
+	"camagru/internal/models"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// ErrInvalidInvite is returned for invite codes that do not exist, have
+// expired, have been used up or were made by a suspended account.
+var ErrInvalidInvite = errors.New("invalid invite code")
+
+// inviteRecord is an invite code that lets up to MaxUses people register.
+// Only the keyed hash of the code is stored.
+type inviteRecord struct {
+	ID         int        `json:"id"`
+	CreatedBy  int        `json:"created_by"`
+	CodeHash   string     `json:"code_hash"`
+	MaxUses    int        `json:"max_uses"`
+	RedeemedBy []int      `json:"redeemed_by"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+}
+
+// inviteModel lists the accounts that used the invite by username; ones
+// that have since been deleted still count as uses but are not named.
+// Deleting an account does not give the use back: an invite could otherwise
+// let any number of people in, one after another.
+func (d *dataset) inviteModel(invite *inviteRecord) *models.Invite {
+	result := &models.Invite{
+		ID:         invite.ID,
+		CreatedBy:  invite.CreatedBy,
+		MaxUses:    invite.MaxUses,
+		Uses:       len(invite.RedeemedBy),
+		RedeemedBy: []string{},
+		CreatedAt:  invite.CreatedAt,
+		ExpiresAt:  invite.ExpiresAt,
+	}
+	if creator, exists := d.users[invite.CreatedBy]; exists {
+		result.Creator = creator.Username
+	}
+	for _, userID := range invite.RedeemedBy {
+		if user, exists := d.users[userID]; exists {
+			result.RedeemedBy = append(result.RedeemedBy, user.Username)
+		}
+	}
+	return result
+}
+
+// forgetRedemptions replaces userID with 0 in the invites the user
+// redeemed, as part of deleting them in t. The uses still count, but no
+// longer lead back to the account.
+func (d *dataset) forgetRedemptions(t *tx, userID int) {
+	for id, invite := range d.invites {
+		for i, redeemer := range invite.RedeemedBy {
+			if redeemer != userID {
+				continue
+			}
+			updated := *invite
+			updated.RedeemedBy = append([]int(nil), invite.RedeemedBy...)
+			updated.RedeemedBy[i] = 0
+			t.put(invitesFile, id, &updated)
+			break
+		}
+	}
+}
+
+func (s *Storage) CreateInvite(userID int, code string, maxUses int, expiresAt *time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.data.users[userID]; !exists {
+		return 0, fmt.Errorf("user not found")
+	}
+	if maxUses < 1 {
+		return 0, fmt.Errorf("invite must allow at least one use")
+	}
+
+	t := s.begin()
+	counters, err := t.ids()
+	if err != nil {
+		return 0, err
+	}
+
+	counters.InviteID++
+	inviteID := counters.InviteID
+
+	t.put(invitesFile, inviteID, &inviteRecord{
+		ID:         inviteID,
+		CreatedBy:  userID,
+		CodeHash:   s.hashToken(code),
+		MaxUses:    maxUses,
+		RedeemedBy: []int{},
+		CreatedAt:  time.Now(),
+		ExpiresAt:  expiresAt,
+	})
+
+	if err := t.commit(); err != nil {
+		return 0, err
+	}
+
+	return inviteID, nil
+}
+
+func (s *Storage) GetInviteByID(inviteID int) (*models.Invite, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	invite, exists := s.data.invites[inviteID]
+	if !exists {
+		return nil, fmt.Errorf("invite not found")
+	}
+
+	return s.data.inviteModel(invite), nil
+}
+
+// GetUserInvites lists the invites a user has made, newest first.
+func (s *Storage) GetUserInvites(userID int) ([]models.Invite, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := make([]models.Invite, 0, len(s.data.idx.invitesByUser[userID]))
+	for id := range s.data.idx.invitesByUser[userID] {
+		result = append(result, *s.data.inviteModel(s.data.invites[id]))
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID > result[j].ID
+	})
+
+	return result, nil
+}
+
+// ListInvites lists every user's invites, newest first.
+func (s *Storage) ListInvites() ([]models.Invite, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := make([]models.Invite, 0, len(s.data.invites))
+	for _, invite := range s.data.invites {
+		result = append(result, *s.data.inviteModel(invite))
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID > result[j].ID
+	})
+
+	return result, nil
+}
+
+func (s *Storage) DeleteInvite(inviteID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.data.invites[inviteID]; !exists {
+		return fmt.Errorf("invite not found")
+	}
+
+	t := s.begin()
+	t.remove(invitesFile, inviteID)
+	return t.commit()
+}
+
+// CreateInvitedUser is CreateUser for registrations that need an invite.
+// The invite is used up in the same transaction that creates the account,
+// so concurrent registrations cannot redeem it more often than it allows.
+func (s *Storage) CreateInvitedUser(username, email, passwordHash, verificationToken string, verificationExpires time.Time, inviteCode string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if inviteCode == "" {
+		return 0, ErrInvalidInvite
+	}
+	id, exists := s.data.idx.inviteByHash[s.hashToken(inviteCode)]
+	if !exists {
+		return 0, ErrInvalidInvite
+	}
+	invite := s.data.invites[id]
+	if invite.ExpiresAt != nil && time.Now().After(*invite.ExpiresAt) {
+		return 0, ErrInvalidInvite
+	}
+	if len(invite.RedeemedBy) >= invite.MaxUses {
+		return 0, ErrInvalidInvite
+	}
+	if creator, exists := s.data.users[invite.CreatedBy]; !exists || creator.Suspended {
+		return 0, ErrInvalidInvite
+	}
+
+	t := s.begin()
+	userID, err := s.putNewUser(t, username, email, passwordHash, verificationToken, verificationExpires)
+	if err != nil {
+		return 0, err
+	}
+
+	updated := *invite
+	updated.RedeemedBy = append(append([]int(nil), invite.RedeemedBy...), userID)
+	t.put(invitesFile, invite.ID, &updated)
+
+	if err := t.commit(); err != nil {
+		return 0, err
+	}
+
+	return userID, nil
+}
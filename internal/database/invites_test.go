@@ -0,0 +1,43 @@
+package database
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeletedUsersStillUseTheirInvite(t *testing.T) {
+	s := NewMemoryStorage()
+	creatorID := createTestUser(t, s, "alice")
+	inviteID, err := s.CreateInvite(creatorID, "code", 2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobID, err := s.CreateInvitedUser("bob", "bob@example.com", "hash", "", time.Now().Add(time.Hour), "code")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.CreateInvitedUser("carol", "carol@example.com", "hash", "", time.Now().Add(time.Hour), "code"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.DeleteUser(bobID, true); err != nil {
+		t.Fatal(err)
+	}
+	invite, err := s.GetInviteByID(inviteID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if invite.Uses != 2 || len(invite.RedeemedBy) != 1 || invite.RedeemedBy[0] != "carol" {
+		t.Fatalf("invite after deleting bob: %+v", invite)
+	}
+	for _, redeemer := range s.data.invites[inviteID].RedeemedBy {
+		if redeemer == bobID {
+			t.Fatal("invite still refers to bob's account")
+		}
+	}
+	// Deleting bob did not free a use for someone else.
+	if _, err := s.CreateInvitedUser("dave", "dave@example.com", "hash", "", time.Now().Add(time.Hour), "code"); err != ErrInvalidInvite {
+		t.Fatalf("used-up invite: %v", err)
+	}
+	checkIndexes(t, s.data, "after deleting bob")
+}
@@ -0,0 +1,508 @@
+package database
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	journalFile        = "journal.log"
+	journalRotatedFile = "journal.log.old"
+	snapshotFile       = "snapshot.json"
+
+	compactInterval  = 5 * time.Minute
+	compactThreshold = 4 << 20
+)
+
+type journalEntry struct {
+	Seq uint64           `json:"seq"`
+	Ops []journalEntryOp `json:"ops"`
+}
+
+type journalEntryOp struct {
+	Collection string          `json:"c"`
+	ID         int             `json:"id,omitempty"`
+	Record     json.RawMessage `json:"r,omitempty"`
+}
+
+type journalSnapshot struct {
+	Seq         uint64                     `json:"seq"`
+	Schema      int                        `json:"schema"`
+	Collections map[string]json.RawMessage `json:"collections"`
+}
+
+// journalBackend keeps the dataset as a snapshot plus an append-only log of
+// committed transactions. Each commit appends one line and fsyncs it, so the
+// cost of a write no longer depends on the size of the collections.
+type journalBackend struct {
+	dir     string
+	file    *os.File
+	size    int64
+	seq     uint64
+	schema  int
+	trigger chan struct{}
+	done    chan struct{}
+	// converted is set when opening seeded the journal from the JSON
+	// collection files.
+	converted bool
+
+	// filesMu keeps rotate from moving journal files while readRaw, which
+	// may run under the storage read lock, is reading them.
+	filesMu sync.Mutex
+}
+
+func NewJournalStorage(dataDir string) (*Storage, error) {
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return nil, err
+	}
+	j := &journalBackend{
+		dir:     dataDir,
+		trigger: make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	s, err := openStorage(dataDir, j)
+	if err != nil {
+		return nil, err
+	}
+	go s.compactLoop(j)
+	return s, nil
+}
+
+func (j *journalBackend) load() (*dataset, error) {
+	d, err := j.loadSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range []string{journalRotatedFile, journalFile} {
+		if err := j.replay(d, name); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := os.Stat(filepath.Join(j.dir, journalRotatedFile)); err == nil {
+		// A compaction was interrupted before its snapshot landed.
+		data, err := encodeSnapshot(d, j.seq, j.schema)
+		if err != nil {
+			return nil, err
+		}
+		if err := writeFileAtomic(filepath.Join(j.dir, snapshotFile), data); err != nil {
+			return nil, err
+		}
+		if err := os.Remove(filepath.Join(j.dir, journalRotatedFile)); err != nil {
+			return nil, err
+		}
+	}
+
+	file, err := os.OpenFile(filepath.Join(j.dir, journalFile), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	j.file = file
+	j.size = info.Size()
+	return d, nil
+}
+
+func (j *journalBackend) loadSnapshot() (*dataset, error) {
+	snap, err := j.readSnapshot()
+	if os.IsNotExist(err) {
+		return j.migrate()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	d, err := decodeDataset(snap.Collections)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", snapshotFile, err)
+	}
+	j.seq = snap.Seq
+	j.schema = snap.Schema
+	return d, nil
+}
+
+func (j *journalBackend) readSnapshot() (*journalSnapshot, error) {
+	data, err := os.ReadFile(filepath.Join(j.dir, snapshotFile))
+	if err != nil {
+		return nil, err
+	}
+	var snap journalSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return nil, fmt.Errorf("%s: %w", snapshotFile, err)
+	}
+	if snap.Collections == nil {
+		snap.Collections = make(map[string]json.RawMessage)
+	}
+	return &snap, nil
+}
+
+// migrate seeds the journal from the JSON collection files the first time a
+// data directory is opened with this backend. The files are copied into the
+// snapshot as they are, schema version included, so pending schema
+// migrations still see the original layout. The JSON files are left in place
+// untouched; from here on snapshot.json is the source of truth.
+func (j *journalBackend) migrate() (*dataset, error) {
+	if _, err := os.Stat(filepath.Join(j.dir, journalFile)); err == nil {
+		return newDataset(), nil
+	}
+
+	files, err := (&fileBackend{dir: j.dir}).readRaw()
+	if err != nil {
+		return nil, err
+	}
+	d, err := decodeDataset(files)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return d, nil
+	}
+
+	snap := journalSnapshot{Collections: make(map[string]json.RawMessage)}
+	for name, raw := range files {
+		if name == schemaFile {
+			var version schemaVersion
+			if err := json.Unmarshal(raw, &version); err != nil {
+				return nil, fmt.Errorf("%s: %w", schemaFile, err)
+			}
+			snap.Schema = version.Version
+			continue
+		}
+		snap.Collections[name] = raw
+	}
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(filepath.Join(j.dir, snapshotFile), data); err != nil {
+		return nil, err
+	}
+	j.schema = snap.Schema
+	j.converted = true
+	return d, nil
+}
+
+// ConvertedFromFiles reports whether opening the storage converted the JSON
+// collection files of the file backend into a journal.
+func (s *Storage) ConvertedFromFiles() bool {
+	j, ok := s.backend.(*journalBackend)
+	return ok && j.converted
+}
+
+func (j *journalBackend) replay(d *dataset, name string) error {
+	return j.readJournal(name, j.seq, func(entry *journalEntry) error {
+		for _, e := range entry.Ops {
+			o := op{collection: e.Collection, id: e.ID}
+			if e.Record != nil {
+				record, err := decodeRecord(e.Collection, e.Record)
+				if err != nil {
+					return err
+				}
+				o.record = record
+			}
+			if _, err := d.apply(o); err != nil {
+				return err
+			}
+		}
+		j.seq = entry.Seq
+		return nil
+	})
+}
+
+// readJournal calls fn for every entry in the named journal whose sequence
+// number is above after.
+func (j *journalBackend) readJournal(name string, after uint64, fn func(entry *journalEntry) error) error {
+	path := filepath.Join(j.dir, name)
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var offset int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(bytes.TrimSpace(line)) > 0 {
+				// A torn final line is a commit that never completed.
+				return os.Truncate(path, offset)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var entry journalEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return fmt.Errorf("%s: corrupt entry at offset %d: %w", name, offset, err)
+		}
+		offset += int64(len(line))
+		if entry.Seq <= after {
+			continue
+		}
+		if err := fn(&entry); err != nil {
+			return fmt.Errorf("%s: seq %d: %w", name, entry.Seq, err)
+		}
+	}
+}
+
+func (j *journalBackend) commit(d *dataset, ops []op) error {
+	entry := journalEntry{Seq: j.seq + 1, Ops: make([]journalEntryOp, 0, len(ops))}
+	for _, o := range ops {
+		e := journalEntryOp{Collection: o.collection, ID: o.id}
+		if o.record != nil {
+			raw, err := json.Marshal(o.record)
+			if err != nil {
+				return err
+			}
+			e.Record = raw
+		}
+		entry.Ops = append(entry.Ops, e)
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	if _, err := j.file.Write(line); err != nil {
+		j.file.Truncate(j.size)
+		return err
+	}
+	if err := j.file.Sync(); err != nil {
+		j.file.Truncate(j.size)
+		return err
+	}
+	j.seq = entry.Seq
+	j.size += int64(len(line))
+
+	if j.size >= compactThreshold {
+		select {
+		case j.trigger <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// readRaw folds the journal into the snapshot without decoding records, so
+// the result keeps fields that the current record types would drop.
+func (j *journalBackend) readRaw() (map[string]json.RawMessage, error) {
+	j.filesMu.Lock()
+	defer j.filesMu.Unlock()
+
+	snap, err := j.readSnapshot()
+	if os.IsNotExist(err) {
+		snap, err = &journalSnapshot{Collections: make(map[string]json.RawMessage)}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	collections := make(map[string]map[string]json.RawMessage)
+	fold := func(entry *journalEntry) error {
+		for _, e := range entry.Ops {
+			if e.Collection == idsFile {
+				snap.Collections[idsFile] = e.Record
+				continue
+			}
+			records, exists := collections[e.Collection]
+			if !exists {
+				records = make(map[string]json.RawMessage)
+				if raw, exists := snap.Collections[e.Collection]; exists {
+					if err := json.Unmarshal(raw, &records); err != nil {
+						return err
+					}
+				}
+				collections[e.Collection] = records
+			}
+			key := strconv.Itoa(e.ID)
+			if e.Record == nil {
+				delete(records, key)
+			} else {
+				records[key] = e.Record
+			}
+		}
+		return nil
+	}
+
+	for _, name := range []string{journalRotatedFile, journalFile} {
+		if err := j.readJournal(name, snap.Seq, fold); err != nil {
+			return nil, err
+		}
+	}
+
+	files := make(map[string]json.RawMessage)
+	for name, raw := range snap.Collections {
+		files[name] = raw
+	}
+	for name, records := range collections {
+		raw, err := json.Marshal(records)
+		if err != nil {
+			return nil, err
+		}
+		files[name] = raw
+	}
+	if snap.Schema > 0 {
+		raw, err := json.Marshal(schemaVersion{Version: snap.Schema})
+		if err != nil {
+			return nil, err
+		}
+		files[schemaFile] = raw
+	}
+	return files, nil
+}
+
+// writeRaw replaces the snapshot with files and empties the journal. The
+// schema version travels inside the snapshot so both change atomically.
+func (j *journalBackend) writeRaw(files map[string]json.RawMessage) error {
+	snap := journalSnapshot{Seq: j.seq, Collections: make(map[string]json.RawMessage)}
+	for name, raw := range files {
+		if name == schemaFile {
+			var version schemaVersion
+			if err := json.Unmarshal(raw, &version); err != nil {
+				return err
+			}
+			snap.Schema = version.Version
+			continue
+		}
+		snap.Collections[name] = raw
+	}
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(j.dir, snapshotFile), data); err != nil {
+		return err
+	}
+	j.schema = snap.Schema
+
+	if err := os.Remove(filepath.Join(j.dir, journalRotatedFile)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := j.file.Truncate(0); err != nil {
+		return err
+	}
+	j.size = 0
+	return nil
+}
+
+func (j *journalBackend) close() error {
+	select {
+	case <-j.done:
+		return nil
+	default:
+	}
+	close(j.done)
+	if j.file == nil {
+		return nil
+	}
+	return j.file.Close()
+}
+
+// rotate starts a fresh journal and returns a snapshot of d covering every
+// entry in the rotated one. It must not run concurrently with commit.
+func (j *journalBackend) rotate(d *dataset) ([]byte, error) {
+	j.filesMu.Lock()
+	defer j.filesMu.Unlock()
+
+	data, err := encodeSnapshot(d, j.seq, j.schema)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(filepath.Join(j.dir, journalRotatedFile)); err == nil {
+		return nil, fmt.Errorf("previous compaction did not finish")
+	}
+
+	path := filepath.Join(j.dir, journalFile)
+	if err := os.Rename(path, filepath.Join(j.dir, journalRotatedFile)); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syncDir(j.dir); err != nil {
+		file.Close()
+		return nil, err
+	}
+	j.file.Close()
+	j.file = file
+	j.size = 0
+	return data, nil
+}
+
+func (s *Storage) compactLoop(j *journalBackend) {
+	ticker := time.NewTicker(compactInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-j.done:
+			return
+		case <-ticker.C:
+		case <-j.trigger:
+		}
+		if err := s.compact(j); err != nil {
+			fmt.Printf("Journal compaction failed: %v\n", err)
+		}
+	}
+}
+
+// compact folds the journal into a new snapshot. The snapshot is written
+// before the read lock is released: otherwise a schema migration could
+// replace the snapshot through writeRaw in the meantime, and this older one
+// would land on top of it.
+func (s *Storage) compact(j *journalBackend) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	select {
+	case <-j.done:
+		return nil
+	default:
+	}
+	if j.size == 0 {
+		return nil
+	}
+	data, err := j.rotate(s.data)
+	if err != nil {
+		return err
+	}
+
+	// Hold filesMu as well, so that readRaw never sees the rotated journal
+	// gone without the snapshot that replaces it.
+	j.filesMu.Lock()
+	defer j.filesMu.Unlock()
+	if err := writeFileAtomic(filepath.Join(j.dir, snapshotFile), data); err != nil {
+		return err
+	}
+	return os.Remove(filepath.Join(j.dir, journalRotatedFile))
+}
+
+func encodeSnapshot(d *dataset, seq uint64, schema int) ([]byte, error) {
+	snap := journalSnapshot{Seq: seq, Schema: schema, Collections: make(map[string]json.RawMessage)}
+	for _, name := range collectionFiles {
+		raw, err := json.Marshal(d.collection(name))
+		if err != nil {
+			return nil, err
+		}
+		snap.Collections[name] = raw
+	}
+	return json.Marshal(snap)
+}
@@ -0,0 +1,87 @@
+package database
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func createTestUser(t *testing.T, s *Storage, username string) int {
+	t.Helper()
+	userID, err := s.CreateUser(username, username+"@example.com", "hash", "", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return userID
+}
+
+func TestJournalCompaction(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewJournalStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.InitDB(); err != nil {
+		t.Fatal(err)
+	}
+	createTestUser(t, s, "alice")
+
+	if err := s.compact(s.backend.(*journalBackend)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, journalRotatedFile)); !os.IsNotExist(err) {
+		t.Fatalf("rotated journal left behind: %v", err)
+	}
+	// Written after the snapshot, so only in the new journal.
+	createTestUser(t, s, "bob")
+	s.Close()
+
+	s, err = NewJournalStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for _, username := range []string{"alice", "bob"} {
+		if _, err := s.GetUserByUsernameOrEmail(username); err != nil {
+			t.Errorf("%s: %v", username, err)
+		}
+	}
+	if pending, err := s.Migrate(true); err != nil || len(pending) > 0 {
+		t.Fatalf("schema version lost: %v, %v", pending, err)
+	}
+}
+
+func TestJournalConvertsFileBackend(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.InitDB(); err != nil {
+		t.Fatal(err)
+	}
+	createTestUser(t, s, "alice")
+	s.Close()
+
+	s, err = NewJournalStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.ConvertedFromFiles() {
+		t.Fatal("first open did not report the conversion")
+	}
+	if _, err := s.GetUserByUsernameOrEmail("alice"); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	s, err = NewJournalStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if s.ConvertedFromFiles() {
+		t.Fatal("second open reported a conversion")
+	}
+}
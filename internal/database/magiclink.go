@@ -0,0 +1,60 @@
+package database
+
+import (
+	"camagru/internal/models"
+	"fmt"
+	"time"
+)
+
+// SetMagicLinkToken stores a sign-in link token for the user, replacing any
+// link sent before.
+func (s *Storage) SetMagicLinkToken(userID int, token string, expires time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, exists := s.data.users[userID]
+	if !exists {
+		return fmt.Errorf("user not found")
+	}
+
+	updated := *user
+	updated.MagicLinkToken = s.hashToken(token)
+	updated.MagicLinkExpires = &expires
+
+	t := s.begin()
+	t.put(usersFile, userID, &updated)
+	return t.commit()
+}
+
+// ConsumeMagicLink returns the user a sign-in link was sent to and uses the
+// link up, so that it works only once.
+func (s *Storage) ConsumeMagicLink(token string) (*models.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if token == "" {
+		return nil, fmt.Errorf("invalid sign-in link")
+	}
+	hashed := s.hashToken(token)
+	for _, user := range s.data.users {
+		if user.MagicLinkToken != hashed {
+			continue
+		}
+
+		updated := *user
+		updated.MagicLinkToken = ""
+		updated.MagicLinkExpires = nil
+
+		t := s.begin()
+		t.put(usersFile, user.ID, &updated)
+		if err := t.commit(); err != nil {
+			return nil, err
+		}
+		if user.MagicLinkDisabled || user.MagicLinkExpires == nil || time.Now().After(*user.MagicLinkExpires) {
+			return nil, fmt.Errorf("token expired")
+		}
+		return userModel(&updated), nil
+	}
+
+	return nil, fmt.Errorf("invalid sign-in link")
+}
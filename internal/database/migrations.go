@@ -0,0 +1,236 @@
+package database
+
+import (
+	"bytes"
+	"camagru/internal/models"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const schemaFile = "schema.json"
+
+type schemaVersion struct {
+	Version int `json:"version"`
+}
+
+// A migration rewrites the raw collection files from the layout of the
+// previous schema version to its own. Files are keyed by name (users.json,
+// ids.json, ...) and may be added, changed or deleted in place. The storage
+// is passed for keyed operations such as hashToken; its dataset must not be
+// used, as it still holds the old layout.
+type migration struct {
+	version     int
+	description string
+	up          func(s *Storage, files map[string]json.RawMessage) error
+}
+
+// migrations must stay sorted by version. Append new entries; never edit or
+// reorder ones that have shipped.
+var migrations = []migration{
+	{
+		version:     1,
+		description: "record the schema version of existing data directories",
+		up:          func(s *Storage, files map[string]json.RawMessage) error { return nil },
+	},
+	{
+		version:     2,
+		description: "store keyed hashes of session, verification and reset tokens",
+		up: func(s *Storage, files map[string]json.RawMessage) error {
+			return updateRecords(files, usersFile, func(record map[string]interface{}) error {
+				for _, field := range []string{"session_token", "verification_token", "reset_token"} {
+					token, _ := record[field].(string)
+					record[field] = s.hashToken(token)
+				}
+				return nil
+			})
+		},
+	},
+	{
+		version:     3,
+		description: "move session tokens from users.json into sessions.json",
+		up: func(s *Storage, files map[string]json.RawMessage) error {
+			var counters map[string]interface{}
+			if raw, exists := files[idsFile]; exists {
+				if err := json.Unmarshal(raw, &counters); err != nil {
+					return fmt.Errorf("%s: %w", idsFile, err)
+				}
+			} else {
+				counters = make(map[string]interface{})
+			}
+			nextID, _ := counters["session_id"].(float64)
+
+			now := time.Now()
+			sessions := make(map[int]*sessionRecord)
+			err := updateRecords(files, usersFile, func(record map[string]interface{}) error {
+				token, _ := record["session_token"].(string)
+				delete(record, "session_token")
+				if token == "" {
+					return nil
+				}
+				id, _ := record["id"].(json.Number)
+				userID, err := id.Int64()
+				if err != nil {
+					return fmt.Errorf("bad id: %w", err)
+				}
+				nextID++
+				sessions[int(nextID)] = &sessionRecord{
+					ID:        int(nextID),
+					UserID:    int(userID),
+					TokenHash: token,
+					CreatedAt: now,
+					LastSeen:  now,
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			counters["session_id"] = nextID
+			files[idsFile] = mustMarshal(counters)
+			files[sessionsFile] = mustMarshal(sessions)
+			return nil
+		},
+	},
+	{
+		version:     4,
+		description: "give every existing account the user role",
+		up: func(s *Storage, files map[string]json.RawMessage) error {
+			return updateRecords(files, usersFile, func(record map[string]interface{}) error {
+				if role, _ := record["role"].(string); role == "" {
+					record["role"] = models.RoleUser
+				}
+				return nil
+			})
+		},
+	},
+}
+
+func latestSchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// Migrate brings the stored data up to the latest schema version and returns
+// a line for each migration it ran. With dryRun set it only reports what it
+// would run. Before changing anything it copies the current files into
+// backups/ under the data directory.
+func (s *Storage) Migrate(dryRun bool) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	files, err := s.backend.readRaw()
+	if err != nil {
+		return nil, err
+	}
+
+	current := 0
+	if raw, exists := files[schemaFile]; exists {
+		var version schemaVersion
+		if err := json.Unmarshal(raw, &version); err != nil {
+			return nil, fmt.Errorf("%s: %w", schemaFile, err)
+		}
+		current = version.Version
+	} else if len(files) == 0 {
+		// A new data directory starts out at the latest layout.
+		if dryRun {
+			return nil, nil
+		}
+		return nil, s.backend.writeRaw(map[string]json.RawMessage{
+			schemaFile: mustMarshal(schemaVersion{Version: latestSchemaVersion()}),
+		})
+	}
+	if current > latestSchemaVersion() {
+		return nil, fmt.Errorf("data schema version %d is newer than this build supports (%d)", current, latestSchemaVersion())
+	}
+
+	var applied []string
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		applied = append(applied, fmt.Sprintf("v%d: %s", m.version, m.description))
+	}
+	if len(applied) == 0 || dryRun {
+		return applied, nil
+	}
+
+	if s.dataDir != "" {
+		if err := backupRaw(filepath.Join(s.dataDir, "backups"), current, files); err != nil {
+			return nil, fmt.Errorf("backup before migration: %w", err)
+		}
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		if err := m.up(s, files); err != nil {
+			return nil, fmt.Errorf("migration v%d: %w", m.version, err)
+		}
+	}
+	files[schemaFile] = mustMarshal(schemaVersion{Version: latestSchemaVersion()})
+
+	d, err := decodeDataset(files)
+	if err != nil {
+		return nil, fmt.Errorf("migrated data does not load: %w", err)
+	}
+	if err := s.backend.writeRaw(files); err != nil {
+		return nil, err
+	}
+	d.reindex()
+	s.data = d
+
+	return applied, nil
+}
+
+func backupRaw(dir string, version int, files map[string]json.RawMessage) error {
+	path := filepath.Join(dir, fmt.Sprintf("schema-v%d-%s", version, time.Now().Format("20060102-150405")))
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return err
+	}
+	for name, raw := range files {
+		if err := writeFileSynced(filepath.Join(path, name), raw); err != nil {
+			return err
+		}
+	}
+	return syncDir(path)
+}
+
+// updateRecords decodes every record of a collection into a generic map,
+// lets fn change it and stores the result back in files.
+func updateRecords(files map[string]json.RawMessage, name string, fn func(record map[string]interface{}) error) error {
+	raw, exists := files[name]
+	if !exists {
+		return nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	var records map[string]map[string]interface{}
+	if err := decoder.Decode(&records); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	for id, record := range records {
+		if err := fn(record); err != nil {
+			return fmt.Errorf("%s: record %s: %w", name, id, err)
+		}
+	}
+
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+	files[name] = data
+	return nil
+}
+
+func mustMarshal(v interface{}) json.RawMessage {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
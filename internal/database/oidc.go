@@ -0,0 +1,132 @@
+package database
+
+import (
+	"camagru/internal/models"
+	"fmt"
+	"time"
+)
+
+// GetUserByOIDCSubject finds the user linked to an identity at an OpenID
+// provider. subject combines the issuer with the provider's user ID.
+func (s *Storage) GetUserByOIDCSubject(subject string) (*models.User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if subject == "" {
+		return nil, fmt.Errorf("user not found")
+	}
+	for _, user := range s.data.users {
+		if user.OIDCSubject == subject {
+			return userModel(user), nil
+		}
+	}
+
+	return nil, fmt.Errorf("user not found")
+}
+
+// LinkOIDCSubject lets the user sign in through their identity provider
+// from now on. The provider has vouched for their email address, so the
+// account counts as verified.
+//
+// An account that was never verified may have been registered by someone
+// else who knew the address, so it is handed over clean: its password,
+// sessions, API tokens and every outstanding token are dropped in the same
+// transaction.
+func (s *Storage) LinkOIDCSubject(userID int, subject string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, exists := s.data.users[userID]
+	if !exists {
+		return fmt.Errorf("user not found")
+	}
+	for _, other := range s.data.users {
+		if other.OIDCSubject == subject && other.ID != userID {
+			return fmt.Errorf("identity already linked")
+		}
+	}
+
+	updated := *user
+	updated.OIDCSubject = subject
+	updated.Verified = true
+	updated.VerificationToken = ""
+	updated.VerificationExpires = nil
+	updated.VerificationSentAt = nil
+
+	t := s.begin()
+	if !user.Verified {
+		updated.PasswordHash = ""
+		updated.ResetToken = ""
+		updated.ResetExpires = nil
+		updated.MagicLinkToken = ""
+		updated.MagicLinkExpires = nil
+		updated.PendingEmail = ""
+		updated.EmailChangeToken = ""
+		updated.EmailChangeExpires = nil
+		updated.PreviousEmail = ""
+		updated.EmailUndoToken = ""
+		updated.EmailUndoExpires = nil
+		updated.TOTPSecret = ""
+		updated.TOTPPendingSecret = ""
+		updated.TOTPLastStep = 0
+		updated.RecoveryCodes = nil
+		for id := range s.data.idx.sessionsByUser[userID] {
+			t.remove(sessionsFile, id)
+		}
+		for id := range s.data.idx.apiTokensByUser[userID] {
+			t.remove(tokensFile, id)
+		}
+	}
+	t.put(usersFile, userID, &updated)
+	return t.commit()
+}
+
+// CreateOIDCUser creates an account for someone signing in through their
+// identity provider for the first time. It has no password. If the
+// provider did not verify the email address, verificationToken is set as
+// for CreateUser; otherwise it is empty and the account starts out
+// verified.
+func (s *Storage) CreateOIDCUser(username, email, subject, verificationToken string, verificationExpires time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, taken := s.data.idx.userByUsername[username]; taken {
+		return 0, fmt.Errorf("username already taken")
+	}
+	if _, taken := s.data.idx.userByEmail[email]; taken {
+		return 0, fmt.Errorf("email already taken")
+	}
+
+	t := s.begin()
+	counters, err := t.ids()
+	if err != nil {
+		return 0, err
+	}
+
+	counters.UserID++
+	userID := counters.UserID
+	now := time.Now()
+
+	user := &userRecord{
+		ID:                   userID,
+		Username:             username,
+		Email:                email,
+		Verified:             verificationToken == "",
+		CommentNotifications: true,
+		CreatedAt:            now,
+		Role:                 models.RoleUser,
+		OIDCSubject:          subject,
+	}
+	if verificationToken != "" {
+		user.VerificationToken = s.hashToken(verificationToken)
+		user.VerificationExpires = &verificationExpires
+		user.VerificationSentAt = &now
+	}
+	t.put(usersFile, userID, user)
+
+	if err := t.commit(); err != nil {
+		return 0, err
+	}
+
+	return userID, nil
+}
@@ -0,0 +1,154 @@
+package database
+
+import (
+	"camagru/internal/models"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// sessionRecord is one signed-in device. Only the keyed hash of its token
+// is stored.
+type sessionRecord struct {
+	ID        int       `json:"id"`
+	UserID    int       `json:"user_id"`
+	TokenHash string    `json:"token_hash"`
+	UserAgent string    `json:"user_agent"`
+	IP        string    `json:"ip"`
+	CreatedAt time.Time `json:"created_at"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+func sessionModel(session *sessionRecord) *models.Session {
+	return &models.Session{
+		ID:        session.ID,
+		UserID:    session.UserID,
+		UserAgent: session.UserAgent,
+		IP:        session.IP,
+		CreatedAt: session.CreatedAt,
+		LastSeen:  session.LastSeen,
+	}
+}
+
+func (s *Storage) CreateSession(userID int, token, userAgent, ip string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.data.users[userID]; !exists {
+		return 0, fmt.Errorf("user not found")
+	}
+
+	t := s.begin()
+	counters, err := t.ids()
+	if err != nil {
+		return 0, err
+	}
+
+	counters.SessionID++
+	sessionID := counters.SessionID
+
+	now := time.Now()
+	t.put(sessionsFile, sessionID, &sessionRecord{
+		ID:        sessionID,
+		UserID:    userID,
+		TokenHash: s.hashToken(token),
+		UserAgent: userAgent,
+		IP:        ip,
+		CreatedAt: now,
+		LastSeen:  now,
+	})
+
+	if err := t.commit(); err != nil {
+		return 0, err
+	}
+
+	return sessionID, nil
+}
+
+func (s *Storage) GetSessionByToken(token string) (*models.Session, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if token == "" {
+		return nil, fmt.Errorf("session not found")
+	}
+	id, exists := s.data.idx.sessionByToken[s.hashToken(token)]
+	if !exists {
+		return nil, fmt.Errorf("session not found")
+	}
+
+	return sessionModel(s.data.sessions[id]), nil
+}
+
+// GetUserSessions lists a user's sessions, most recently used first.
+func (s *Storage) GetUserSessions(userID int) ([]models.Session, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := make([]models.Session, 0, len(s.data.idx.sessionsByUser[userID]))
+	for id := range s.data.idx.sessionsByUser[userID] {
+		result = append(result, *sessionModel(s.data.sessions[id]))
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].LastSeen.After(result[j].LastSeen)
+	})
+
+	return result, nil
+}
+
+func (s *Storage) TouchSession(sessionID int, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, exists := s.data.sessions[sessionID]
+	if !exists {
+		return fmt.Errorf("session not found")
+	}
+
+	updated := *session
+	updated.LastSeen = at
+
+	t := s.begin()
+	t.put(sessionsFile, sessionID, &updated)
+	return t.commit()
+}
+
+func (s *Storage) DeleteSession(sessionID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.data.sessions[sessionID]; !exists {
+		return nil
+	}
+
+	t := s.begin()
+	t.remove(sessionsFile, sessionID)
+	return t.commit()
+}
+
+func (s *Storage) DeleteUserSessions(userID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t := s.begin()
+	for id := range s.data.idx.sessionsByUser[userID] {
+		t.remove(sessionsFile, id)
+	}
+	return t.commit()
+}
+
+// DeleteExpiredSessions removes every session created before createdBefore
+// or last used before seenBefore.
+func (s *Storage) DeleteExpiredSessions(createdBefore, seenBefore time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t := s.begin()
+	for id, session := range s.data.sessions {
+		if session.CreatedAt.Before(createdBefore) || session.LastSeen.Before(seenBefore) {
+			t.remove(sessionsFile, id)
+		}
+	}
+	return t.commit()
+}
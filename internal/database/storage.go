@@ -2,25 +2,62 @@ package database
 
 import (
 	"camagru/internal/models"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
-	"path/filepath"
 	"sort"
 	"sync"
 	"time"
 )
 
+var ErrVerificationExpired = errors.New("verification token expired")
+
 type Storage struct {
-	dataDir string
-	mu      sync.RWMutex
+	dataDir  string
+	backend  backend
+	data     *dataset
+	tokenKey []byte
+	mu       sync.RWMutex
 }
 
 func NewStorage(dataDir string) (*Storage, error) {
 	if err := os.MkdirAll(dataDir, 0755); err != nil {
 		return nil, err
 	}
-	return &Storage{dataDir: dataDir}, nil
+	b, err := newFileBackend(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	return openStorage(dataDir, b)
+}
+
+func NewMemoryStorage() *Storage {
+	key, err := newTokenKey()
+	if err != nil {
+		panic(err)
+	}
+	return &Storage{backend: memoryBackend{}, data: newDataset(), tokenKey: key}
+}
+
+func openStorage(dataDir string, b backend) (*Storage, error) {
+	key, err := loadTokenKey(dataDir)
+	if err != nil {
+		b.close()
+		return nil, err
+	}
+	d, err := b.load()
+	if err != nil {
+		b.close()
+		return nil, err
+	}
+	d.reindex()
+	return &Storage{dataDir: dataDir, backend: b, data: d, tokenKey: key}, nil
+}
+
+func (s *Storage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.backend.close()
 }
 
 type userRecord struct {
@@ -32,37 +69,63 @@ type userRecord struct {
 	VerificationToken    string     `json:"verification_token"`
 	ResetToken           string     `json:"reset_token"`
 	ResetExpires         *time.Time `json:"reset_expires"`
-	SessionToken         string     `json:"session_token"`
 	CommentNotifications bool       `json:"comment_notifications"`
 	CreatedAt            time.Time  `json:"created_at"`
+	// VerificationExpires is nil for tokens issued before verification
+	// links expired. VerificationSentAt is when the last one was sent.
+	VerificationExpires *time.Time `json:"verification_expires"`
+	VerificationSentAt  *time.Time `json:"verification_sent_at"`
+	// TOTPSecret is set once two-factor authentication is confirmed;
+	// TOTPPendingSecret holds a secret that has been issued but not yet
+	// confirmed with a code.
+	TOTPSecret        string   `json:"totp_secret"`
+	TOTPPendingSecret string   `json:"totp_pending_secret"`
+	TOTPLastStep      int64    `json:"totp_last_step"`
+	RecoveryCodes     []string `json:"recovery_codes"`
+	// PendingEmail waits for the user to confirm it through the link sent
+	// there. Once confirmed, the old address can undo the change for a
+	// while.
+	PendingEmail       string     `json:"pending_email"`
+	EmailChangeToken   string     `json:"email_change_token"`
+	EmailChangeExpires *time.Time `json:"email_change_expires"`
+	PreviousEmail      string     `json:"previous_email"`
+	EmailUndoToken     string     `json:"email_undo_token"`
+	EmailUndoExpires   *time.Time `json:"email_undo_expires"`
+	Role               string     `json:"role"`
+	Suspended          bool       `json:"suspended"`
+	// MagicLinkToken signs the user in once, without a password, until
+	// MagicLinkExpires. Users can opt out of such links altogether.
+	MagicLinkToken    string     `json:"magic_link_token"`
+	MagicLinkExpires  *time.Time `json:"magic_link_expires"`
+	MagicLinkDisabled bool       `json:"magic_link_disabled"`
+	// OIDCSubject links the account to an identity provider login, as
+	// "<issuer> <subject>". Accounts created that way have no password.
+	OIDCSubject string `json:"oidc_subject"`
 }
 
-func (s *Storage) getUsers() (map[int]*userRecord, error) {
-	path := filepath.Join(s.dataDir, "users.json")
-	data, err := os.ReadFile(path)
-	if os.IsNotExist(err) {
-		return make(map[int]*userRecord), nil
-	}
-	if err != nil {
-		return nil, err
-	}
-	var users map[int]*userRecord
-	if len(data) == 0 {
-		return make(map[int]*userRecord), nil
-	}
-	if err := json.Unmarshal(data, &users); err != nil {
-		return nil, err
-	}
-	return users, nil
-}
-
-func (s *Storage) saveUsers(users map[int]*userRecord) error {
-	path := filepath.Join(s.dataDir, "users.json")
-	data, err := json.MarshalIndent(users, "", "  ")
-	if err != nil {
-		return err
+func userModel(user *userRecord) *models.User {
+	return &models.User{
+		ID:                   user.ID,
+		Username:             user.Username,
+		Email:                user.Email,
+		PasswordHash:         user.PasswordHash,
+		Verified:             user.Verified,
+		VerificationToken:    user.VerificationToken,
+		VerificationExpires:  user.VerificationExpires,
+		VerificationSentAt:   user.VerificationSentAt,
+		ResetToken:           user.ResetToken,
+		ResetExpires:         user.ResetExpires,
+		CommentNotifications: user.CommentNotifications,
+		CreatedAt:            user.CreatedAt,
+		TOTPSecret:           user.TOTPSecret,
+		TOTPPendingSecret:    user.TOTPPendingSecret,
+		RecoveryCodesLeft:    len(user.RecoveryCodes),
+		PendingEmail:         user.PendingEmail,
+		Role:                 user.Role,
+		Suspended:            user.Suspended,
+		MagicLinkDisabled:    user.MagicLinkDisabled,
+		OIDCSubject:          user.OIDCSubject,
 	}
-	return os.WriteFile(path, data, 0644)
 }
 
 type imageRecord struct {
@@ -72,34 +135,6 @@ type imageRecord struct {
 	CreatedAt time.Time `json:"created_at"`
 }
 
-func (s *Storage) getImages() (map[int]*imageRecord, error) {
-	path := filepath.Join(s.dataDir, "images.json")
-	data, err := os.ReadFile(path)
-	if os.IsNotExist(err) {
-		return make(map[int]*imageRecord), nil
-	}
-	if err != nil {
-		return nil, err
-	}
-	var images map[int]*imageRecord
-	if len(data) == 0 {
-		return make(map[int]*imageRecord), nil
-	}
-	if err := json.Unmarshal(data, &images); err != nil {
-		return nil, err
-	}
-	return images, nil
-}
-
-func (s *Storage) saveImages(images map[int]*imageRecord) error {
-	path := filepath.Join(s.dataDir, "images.json")
-	data, err := json.MarshalIndent(images, "", "  ")
-	if err != nil {
-		return err
-	}
-	return os.WriteFile(path, data, 0644)
-}
-
 type likeRecord struct {
 	ID        int       `json:"id"`
 	UserID    int       `json:"user_id"`
@@ -107,33 +142,9 @@ type likeRecord struct {
 	CreatedAt time.Time `json:"created_at"`
 }
 
-func (s *Storage) getLikes() (map[int]*likeRecord, error) {
-	path := filepath.Join(s.dataDir, "likes.json")
-	data, err := os.ReadFile(path)
-	if os.IsNotExist(err) {
-		return make(map[int]*likeRecord), nil
-	}
-	if err != nil {
-		return nil, err
-	}
-	var likes map[int]*likeRecord
-	if len(data) == 0 {
-		return make(map[int]*likeRecord), nil
-	}
-	if err := json.Unmarshal(data, &likes); err != nil {
-		return nil, err
-	}
-	return likes, nil
-}
-
-func (s *Storage) saveLikes(likes map[int]*likeRecord) error {
-	path := filepath.Join(s.dataDir, "likes.json")
-	data, err := json.MarshalIndent(likes, "", "  ")
-	if err != nil {
-		return err
-	}
-	return os.WriteFile(path, data, 0644)
-}
+// deletedAuthor is shown for comments kept after their author deleted the
+// account; such comments have UserID 0.
+const deletedAuthor = "[deleted]"
 
 type commentRecord struct {
 	ID        int       `json:"id"`
@@ -143,114 +154,38 @@ type commentRecord struct {
 	CreatedAt time.Time `json:"created_at"`
 }
 
-func (s *Storage) getComments() (map[int]*commentRecord, error) {
-	path := filepath.Join(s.dataDir, "comments.json")
-	data, err := os.ReadFile(path)
-	if os.IsNotExist(err) {
-		return make(map[int]*commentRecord), nil
-	}
-	if err != nil {
-		return nil, err
-	}
-	var comments map[int]*commentRecord
-	if len(data) == 0 {
-		return make(map[int]*commentRecord), nil
-	}
-	if err := json.Unmarshal(data, &comments); err != nil {
-		return nil, err
-	}
-	return comments, nil
-}
-
-func (s *Storage) saveComments(comments map[int]*commentRecord) error {
-	path := filepath.Join(s.dataDir, "comments.json")
-	data, err := json.MarshalIndent(comments, "", "  ")
-	if err != nil {
-		return err
-	}
-	return os.WriteFile(path, data, 0644)
-}
-
 type assetRecord struct {
 	ID   int    `json:"id"`
 	Name string `json:"name"`
 	Path string `json:"path"`
 }
 
-func (s *Storage) getAssets() (map[int]*assetRecord, error) {
-	path := filepath.Join(s.dataDir, "assets.json")
-	data, err := os.ReadFile(path)
-	if os.IsNotExist(err) {
-		return make(map[int]*assetRecord), nil
-	}
-	if err != nil {
-		return nil, err
-	}
-	var assets map[int]*assetRecord
-	if len(data) == 0 {
-		return make(map[int]*assetRecord), nil
-	}
-	if err := json.Unmarshal(data, &assets); err != nil {
-		return nil, err
-	}
-	return assets, nil
-}
-
-func (s *Storage) saveAssets(assets map[int]*assetRecord) error {
-	path := filepath.Join(s.dataDir, "assets.json")
-	data, err := json.MarshalIndent(assets, "", "  ")
-	if err != nil {
-		return err
-	}
-	return os.WriteFile(path, data, 0644)
-}
-
 type idCounters struct {
-	UserID    int `json:"user_id"`
-	ImageID   int `json:"image_id"`
-	LikeID    int `json:"like_id"`
-	CommentID int `json:"comment_id"`
-	AssetID   int `json:"asset_id"`
-}
-
-func (s *Storage) getIDCounters() (*idCounters, error) {
-	path := filepath.Join(s.dataDir, "ids.json")
-	data, err := os.ReadFile(path)
-	if os.IsNotExist(err) {
-		return &idCounters{}, nil
-	}
-	if err != nil {
-		return nil, err
-	}
-	var counters idCounters
-	if len(data) == 0 {
-		return &idCounters{}, nil
-	}
-	if err := json.Unmarshal(data, &counters); err != nil {
-		return nil, err
-	}
-	return &counters, nil
+	UserID     int `json:"user_id"`
+	ImageID    int `json:"image_id"`
+	LikeID     int `json:"like_id"`
+	CommentID  int `json:"comment_id"`
+	AssetID    int `json:"asset_id"`
+	SessionID  int `json:"session_id"`
+	APITokenID int `json:"api_token_id"`
+	InviteID   int `json:"invite_id"`
 }
 
-func (s *Storage) saveIDCounters(counters *idCounters) error {
-	path := filepath.Join(s.dataDir, "ids.json")
-	data, err := json.MarshalIndent(counters, "", "  ")
+func (s *Storage) InitDB() error {
+	applied, err := s.Migrate(false)
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(path, data, 0644)
-}
+	for _, line := range applied {
+		fmt.Printf("Applied schema migration %s\n", line)
+	}
 
-func (s *Storage) InitDB() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	assets, err := s.getAssets()
-	if err != nil {
-		return err
-	}
-
+	assets := s.data.assets
 	if len(assets) == 0 {
-		counters, err := s.getIDCounters()
+		t := s.begin()
+		counters, err := t.ids()
 		if err != nil {
 			return err
 		}
@@ -268,19 +203,14 @@ func (s *Storage) InitDB() error {
 
 		for _, asset := range defaultAssets {
 			counters.AssetID++
-			assets[counters.AssetID] = &assetRecord{
+			t.put(assetsFile, counters.AssetID, &assetRecord{
 				ID:   counters.AssetID,
 				Name: asset.name,
 				Path: asset.path,
-			}
+			})
 		}
 
-		if err := s.saveAssets(assets); err != nil {
-			return err
-		}
-		if err := s.saveIDCounters(counters); err != nil {
-			return err
-		}
+		return t.commit()
 	}
 
 	return nil
@@ -290,211 +220,106 @@ func (s *Storage) GetUserByID(id int) (*models.User, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	users, err := s.getUsers()
-	if err != nil {
-		return nil, err
-	}
-
+	users := s.data.users
 	user, exists := users[id]
 	if !exists {
 		return nil, fmt.Errorf("user not found")
 	}
 
-	return &models.User{
-		ID:                   user.ID,
-		Username:             user.Username,
-		Email:                user.Email,
-		PasswordHash:         user.PasswordHash,
-		Verified:             user.Verified,
-		VerificationToken:    user.VerificationToken,
-		ResetToken:           user.ResetToken,
-		ResetExpires:         user.ResetExpires,
-		CommentNotifications: user.CommentNotifications,
-		CreatedAt:            user.CreatedAt,
-	}, nil
+	return userModel(user), nil
 }
 
 func (s *Storage) GetUserByUsernameOrEmail(usernameOrEmail string) (*models.User, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	users, err := s.getUsers()
-	if err != nil {
-		return nil, err
-	}
-
-	for _, user := range users {
-		if user.Username == usernameOrEmail || user.Email == usernameOrEmail {
-			return &models.User{
-				ID:                   user.ID,
-				Username:             user.Username,
-				Email:                user.Email,
-				PasswordHash:         user.PasswordHash,
-				Verified:             user.Verified,
-				VerificationToken:    user.VerificationToken,
-				ResetToken:           user.ResetToken,
-				ResetExpires:         user.ResetExpires,
-				CommentNotifications: user.CommentNotifications,
-				CreatedAt:            user.CreatedAt,
-			}, nil
-		}
-	}
-
-	return nil, fmt.Errorf("user not found")
-}
-
-func (s *Storage) GetUserBySessionToken(token string) (*models.User, error) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-
-	users, err := s.getUsers()
-	if err != nil {
-		return nil, err
-	}
-
-	for _, user := range users {
-		if user.SessionToken == token {
-			return &models.User{
-				ID:                   user.ID,
-				Username:             user.Username,
-				Email:                user.Email,
-				PasswordHash:         user.PasswordHash,
-				Verified:             user.Verified,
-				VerificationToken:    user.VerificationToken,
-				ResetToken:           user.ResetToken,
-				ResetExpires:         user.ResetExpires,
-				CommentNotifications: user.CommentNotifications,
-				CreatedAt:            user.CreatedAt,
-			}, nil
-		}
+	user, exists := s.data.userByUsernameOrEmail(usernameOrEmail)
+	if !exists {
+		return nil, fmt.Errorf("user not found")
 	}
 
-	return nil, fmt.Errorf("user not found")
+	return userModel(user), nil
 }
 
 func (s *Storage) UserExists(username, email string) (bool, bool, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	users, err := s.getUsers()
-	if err != nil {
-		return false, false, err
-	}
-
-	usernameExists := false
-	emailExists := false
-
-	for _, user := range users {
-		if user.Username == username {
-			usernameExists = true
-		}
-		if user.Email == email {
-			emailExists = true
-		}
-	}
+	_, usernameExists := s.data.idx.userByUsername[username]
+	_, emailExists := s.data.idx.userByEmail[email]
 
 	return usernameExists, emailExists, nil
 }
 
-func (s *Storage) CreateUser(username, email, passwordHash, verificationToken string) (int, error) {
+func (s *Storage) CreateUser(username, email, passwordHash, verificationToken string, verificationExpires time.Time) (int, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	users, err := s.getUsers()
+	t := s.begin()
+	userID, err := s.putNewUser(t, username, email, passwordHash, verificationToken, verificationExpires)
 	if err != nil {
 		return 0, err
 	}
 
-	counters, err := s.getIDCounters()
+	if err := t.commit(); err != nil {
+		return 0, err
+	}
+
+	return userID, nil
+}
+
+// putNewUser stages an unverified account with a password, as created by
+// registering, and returns its ID.
+func (s *Storage) putNewUser(t *tx, username, email, passwordHash, verificationToken string, verificationExpires time.Time) (int, error) {
+	counters, err := t.ids()
 	if err != nil {
 		return 0, err
 	}
 
 	counters.UserID++
 	userID := counters.UserID
+	now := time.Now()
 
-	users[userID] = &userRecord{
+	t.put(usersFile, userID, &userRecord{
 		ID:                   userID,
 		Username:             username,
 		Email:                email,
 		PasswordHash:         passwordHash,
 		Verified:             false,
-		VerificationToken:    verificationToken,
+		VerificationToken:    s.hashToken(verificationToken),
+		VerificationExpires:  &verificationExpires,
+		VerificationSentAt:   &now,
 		CommentNotifications: true,
-		CreatedAt:            time.Now(),
-	}
-
-	if err := s.saveUsers(users); err != nil {
-		return 0, err
-	}
-	if err := s.saveIDCounters(counters); err != nil {
-		return 0, err
-	}
+		CreatedAt:            now,
+		Role:                 models.RoleUser,
+	})
 
 	return userID, nil
 }
 
-func (s *Storage) UpdateUserSessionToken(userID int, token string) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	users, err := s.getUsers()
-	if err != nil {
-		return err
-	}
-
-	user, exists := users[userID]
-	if !exists {
-		return fmt.Errorf("user not found")
-	}
-
-	user.SessionToken = token
-	if err := s.saveUsers(users); err != nil {
-		return err
-	}
-
-	return nil
-}
-
-func (s *Storage) ClearUserSessionToken(token string) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	users, err := s.getUsers()
-	if err != nil {
-		return err
-	}
-
-	for _, user := range users {
-		if user.SessionToken == token {
-			user.SessionToken = ""
-			if err := s.saveUsers(users); err != nil {
-				return err
-			}
-			return nil
-		}
-	}
-
-	return nil
-}
-
 func (s *Storage) VerifyUser(token string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	users, err := s.getUsers()
-	if err != nil {
-		return err
+	if token == "" {
+		return fmt.Errorf("invalid verification token")
 	}
-
+	hashed := s.hashToken(token)
+	users := s.data.users
 	for _, user := range users {
-		if user.VerificationToken == token {
-			user.Verified = true
-			user.VerificationToken = ""
-			if err := s.saveUsers(users); err != nil {
-				return err
+		if user.VerificationToken == hashed {
+			if user.VerificationExpires != nil && time.Now().After(*user.VerificationExpires) {
+				return ErrVerificationExpired
 			}
-			return nil
+			updated := *user
+			updated.Verified = true
+			updated.VerificationToken = ""
+			updated.VerificationExpires = nil
+			updated.VerificationSentAt = nil
+
+			t := s.begin()
+			t.put(usersFile, user.ID, &updated)
+			return t.commit()
 		}
 	}
 
@@ -505,25 +330,14 @@ func (s *Storage) GetUserByVerificationToken(token string) (*models.User, error)
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	users, err := s.getUsers()
-	if err != nil {
-		return nil, err
+	if token == "" {
+		return nil, fmt.Errorf("user not found")
 	}
-
+	hashed := s.hashToken(token)
+	users := s.data.users
 	for _, user := range users {
-		if user.VerificationToken == token {
-			return &models.User{
-				ID:                   user.ID,
-				Username:             user.Username,
-				Email:                user.Email,
-				PasswordHash:         user.PasswordHash,
-				Verified:             user.Verified,
-				VerificationToken:    user.VerificationToken,
-				ResetToken:           user.ResetToken,
-				ResetExpires:         user.ResetExpires,
-				CommentNotifications: user.CommentNotifications,
-				CreatedAt:            user.CreatedAt,
-			}, nil
+		if user.VerificationToken == hashed {
+			return userModel(user), nil
 		}
 	}
 
@@ -534,147 +348,315 @@ func (s *Storage) SetPasswordResetToken(email string, token string, expires time
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	users, err := s.getUsers()
-	if err != nil {
-		return err
+	id, exists := s.data.idx.userByEmail[email]
+	if !exists {
+		return nil // Don't reveal if email exists
 	}
 
-	for _, user := range users {
-		if user.Email == email {
-			user.ResetToken = token
-			user.ResetExpires = &expires
-			if err := s.saveUsers(users); err != nil {
-				return err
-			}
-			return nil
-		}
+	updated := *s.data.users[id]
+	updated.ResetToken = s.hashToken(token)
+	updated.ResetExpires = &expires
+
+	t := s.begin()
+	t.put(usersFile, id, &updated)
+	return t.commit()
+}
+
+// SetVerificationToken replaces the user's pending verification token, so
+// that earlier links stop working, and records that a new one was sent.
+// Only its hash is kept, so resending a verification email needs a new
+// token.
+func (s *Storage) SetVerificationToken(userID int, token string, expires time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, exists := s.data.users[userID]
+	if !exists {
+		return fmt.Errorf("user not found")
 	}
 
-	return nil // Don't reveal if email exists
+	now := time.Now()
+	updated := *user
+	updated.VerificationToken = s.hashToken(token)
+	updated.VerificationExpires = &expires
+	updated.VerificationSentAt = &now
+
+	t := s.begin()
+	t.put(usersFile, userID, &updated)
+	return t.commit()
 }
 
 func (s *Storage) GetUserByResetToken(token string) (*models.User, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	users, err := s.getUsers()
-	if err != nil {
-		return nil, err
+	if token == "" {
+		return nil, fmt.Errorf("invalid reset token")
 	}
-
+	hashed := s.hashToken(token)
+	users := s.data.users
 	now := time.Now()
 	for _, user := range users {
-		if user.ResetToken == token {
+		if user.ResetToken == hashed {
 			if user.ResetExpires != nil && now.After(*user.ResetExpires) {
 				return nil, fmt.Errorf("token expired")
 			}
-			return &models.User{
-				ID:                   user.ID,
-				Username:             user.Username,
-				Email:                user.Email,
-				PasswordHash:         user.PasswordHash,
-				Verified:             user.Verified,
-				VerificationToken:    user.VerificationToken,
-				ResetToken:           user.ResetToken,
-				ResetExpires:         user.ResetExpires,
-				CommentNotifications: user.CommentNotifications,
-				CreatedAt:            user.CreatedAt,
-			}, nil
+			return userModel(user), nil
 		}
 	}
 
 	return nil, fmt.Errorf("invalid reset token")
 }
 
-func (s *Storage) UpdateUserPassword(userID int, passwordHash string) error {
+// UpdateUserPassword sets a new password hash. In the same change it
+// invalidates any outstanding reset token, revokes the user's API tokens
+// and ends every session of the user except keepSessionID (0 ends them
+// all).
+func (s *Storage) UpdateUserPassword(userID int, passwordHash string, keepSessionID int) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	users, err := s.getUsers()
-	if err != nil {
-		return err
-	}
-
+	users := s.data.users
 	user, exists := users[userID]
 	if !exists {
 		return fmt.Errorf("user not found")
 	}
 
-	user.PasswordHash = passwordHash
-	user.ResetToken = ""
-	user.ResetExpires = nil
+	t := s.begin()
+	s.changePassword(t, user, passwordHash, keepSessionID)
+	return t.commit()
+}
 
-	if err := s.saveUsers(users); err != nil {
-		return err
+// RehashPassword swaps the user's password hash for an equivalent one in a
+// newer format. It does nothing if the hash has changed since oldHash was
+// read, so that a concurrent password change is not undone, and unlike
+// UpdateUserPassword it leaves sessions and reset tokens alone.
+func (s *Storage) RehashPassword(userID int, oldHash, newHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, exists := s.data.users[userID]
+	if !exists {
+		return fmt.Errorf("user not found")
+	}
+	if user.PasswordHash != oldHash {
+		return nil
 	}
 
-	return nil
+	updated := *user
+	updated.PasswordHash = newHash
+
+	t := s.begin()
+	t.put(usersFile, userID, &updated)
+	return t.commit()
 }
 
-func (s *Storage) UpdateUser(userID int, username, email, passwordHash string) error {
+// ResetPassword sets a new password for the holder of a valid reset token
+// and uses the token up, so a reset link works only once. All of the user's
+// sessions are ended and their API tokens revoked.
+func (s *Storage) ResetPassword(token, passwordHash string) (*models.User, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	users, err := s.getUsers()
-	if err != nil {
-		return err
+	if token == "" {
+		return nil, fmt.Errorf("invalid reset token")
+	}
+	hashed := s.hashToken(token)
+	now := time.Now()
+	for _, user := range s.data.users {
+		if user.ResetToken != hashed {
+			continue
+		}
+		if user.ResetExpires != nil && now.After(*user.ResetExpires) {
+			return nil, fmt.Errorf("token expired")
+		}
+
+		t := s.begin()
+		s.changePassword(t, user, passwordHash, 0)
+		if err := t.commit(); err != nil {
+			return nil, err
+		}
+		return userModel(s.data.users[user.ID]), nil
 	}
 
+	return nil, fmt.Errorf("invalid reset token")
+}
+
+// changePassword stages a password change on t. API tokens are revoked
+// along with sessions, since whoever stole a session could have made one.
+// Callers hold s.mu.
+func (s *Storage) changePassword(t *tx, user *userRecord, passwordHash string, keepSessionID int) {
+	updated := *user
+	updated.PasswordHash = passwordHash
+	updated.ResetToken = ""
+	updated.ResetExpires = nil
+	updated.MagicLinkToken = ""
+	updated.MagicLinkExpires = nil
+	t.put(usersFile, user.ID, &updated)
+
+	for id := range s.data.idx.sessionsByUser[user.ID] {
+		if id != keepSessionID {
+			t.remove(sessionsFile, id)
+		}
+	}
+	for id := range s.data.idx.apiTokensByUser[user.ID] {
+		t.remove(tokensFile, id)
+	}
+}
+
+func (s *Storage) UpdateUser(userID int, username, email string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	users := s.data.users
 	user, exists := users[userID]
 	if !exists {
 		return fmt.Errorf("user not found")
 	}
 
+	updated := *user
 	if username != "" {
-		user.Username = username
+		updated.Username = username
 	}
 	if email != "" {
-		user.Email = email
+		updated.Email = email
 	}
-	if passwordHash != "" {
-		user.PasswordHash = passwordHash
+
+	t := s.begin()
+	t.put(usersFile, userID, &updated)
+	return t.commit()
+}
+
+// UpdateUserPreferences saves the user's settings. Turning sign-in links
+// off also invalidates any link already sent.
+func (s *Storage) UpdateUserPreferences(userID int, commentNotifications, magicLinks bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	users := s.data.users
+	user, exists := users[userID]
+	if !exists {
+		return fmt.Errorf("user not found")
 	}
 
-	if err := s.saveUsers(users); err != nil {
-		return err
+	updated := *user
+	updated.CommentNotifications = commentNotifications
+	updated.MagicLinkDisabled = !magicLinks
+	if !magicLinks {
+		updated.MagicLinkToken = ""
+		updated.MagicLinkExpires = nil
 	}
 
-	return nil
+	t := s.begin()
+	t.put(usersFile, userID, &updated)
+	return t.commit()
 }
 
-func (s *Storage) UpdateUserPreferences(userID int, commentNotifications bool) error {
+// DeleteUser removes a user together with their sessions, their images and
+// every like and comment on those images, and the likes they gave. Their comments on other
+// people's images are deleted too, or kept without an author when
+// anonymizeComments is set. It returns the paths of the deleted images so
+// the caller can remove the files.
+func (s *Storage) DeleteUser(userID int, anonymizeComments bool) ([]string, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	users, err := s.getUsers()
-	if err != nil {
-		return err
+	if _, exists := s.data.users[userID]; !exists {
+		return nil, fmt.Errorf("user not found")
 	}
 
-	user, exists := users[userID]
-	if !exists {
-		return fmt.Errorf("user not found")
+	t := s.begin()
+	t.remove(usersFile, userID)
+	for id := range s.data.idx.sessionsByUser[userID] {
+		t.remove(sessionsFile, id)
+	}
+	for id := range s.data.idx.apiTokensByUser[userID] {
+		t.remove(tokensFile, id)
 	}
+	for id := range s.data.idx.invitesByUser[userID] {
+		t.remove(invitesFile, id)
+	}
+	s.data.forgetRedemptions(t, userID)
 
-	user.CommentNotifications = commentNotifications
+	var paths []string
+	deletedImages := make(map[int]bool)
+	for id, img := range s.data.images {
+		if img.UserID != userID {
+			continue
+		}
+		deletedImages[id] = true
+		paths = append(paths, img.Path)
+		t.remove(imagesFile, id)
+	}
 
-	if err := s.saveUsers(users); err != nil {
-		return err
+	for id, like := range s.data.likes {
+		if like.UserID == userID || deletedImages[like.ImageID] {
+			t.remove(likesFile, id)
+		}
 	}
 
-	return nil
+	for id, comment := range s.data.comments {
+		if deletedImages[comment.ImageID] {
+			t.remove(commentsFile, id)
+			continue
+		}
+		if comment.UserID != userID {
+			continue
+		}
+		if anonymizeComments {
+			updated := *comment
+			updated.UserID = 0
+			t.put(commentsFile, id, &updated)
+		} else {
+			t.remove(commentsFile, id)
+		}
+	}
+
+	if err := t.commit(); err != nil {
+		return nil, err
+	}
+
+	return paths, nil
 }
 
-func (s *Storage) CreateImage(userID int, path string) (int, error) {
+// PurgeUnverifiedUsers deletes accounts created before createdBefore that
+// were never verified, freeing their usernames and email addresses. It
+// returns how many it removed.
+func (s *Storage) PurgeUnverifiedUsers(createdBefore time.Time) (int, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	images, err := s.getImages()
-	if err != nil {
+	purged := 0
+	t := s.begin()
+	for id, user := range s.data.users {
+		if user.Verified || !user.CreatedAt.Before(createdBefore) {
+			continue
+		}
+		// Unverified users cannot sign in, so sessions and tokens are all
+		// they could have left behind.
+		t.remove(usersFile, id)
+		for sessionID := range s.data.idx.sessionsByUser[id] {
+			t.remove(sessionsFile, sessionID)
+		}
+		for tokenID := range s.data.idx.apiTokensByUser[id] {
+			t.remove(tokensFile, tokenID)
+		}
+		s.data.forgetRedemptions(t, id)
+		purged++
+	}
+
+	if err := t.commit(); err != nil {
 		return 0, err
 	}
+	return purged, nil
+}
+
+func (s *Storage) CreateImage(userID int, path string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	counters, err := s.getIDCounters()
+	t := s.begin()
+	counters, err := t.ids()
 	if err != nil {
 		return 0, err
 	}
@@ -682,17 +664,14 @@ func (s *Storage) CreateImage(userID int, path string) (int, error) {
 	counters.ImageID++
 	imageID := counters.ImageID
 
-	images[imageID] = &imageRecord{
+	t.put(imagesFile, imageID, &imageRecord{
 		ID:        imageID,
 		UserID:    userID,
 		Path:      path,
 		CreatedAt: time.Now(),
-	}
+	})
 
-	if err := s.saveImages(images); err != nil {
-		return 0, err
-	}
-	if err := s.saveIDCounters(counters); err != nil {
+	if err := t.commit(); err != nil {
 		return 0, err
 	}
 
@@ -703,21 +682,13 @@ func (s *Storage) GetImageByID(id int) (*models.Image, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	images, err := s.getImages()
-	if err != nil {
-		return nil, err
-	}
-
+	images := s.data.images
 	image, exists := images[id]
 	if !exists {
 		return nil, fmt.Errorf("image not found")
 	}
 
-	users, err := s.getUsers()
-	if err != nil {
-		return nil, err
-	}
-
+	users := s.data.users
 	user, exists := users[image.UserID]
 	if !exists {
 		return nil, fmt.Errorf("user not found")
@@ -736,28 +707,14 @@ func (s *Storage) GetImagesPaginated(page, limit int) ([]models.Image, int, erro
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	images, err := s.getImages()
-	if err != nil {
-		return nil, 0, err
-	}
-
-	users, err := s.getUsers()
-	if err != nil {
-		return nil, 0, err
-	}
-
-	likes, err := s.getLikes()
-	if err != nil {
-		return nil, 0, err
-	}
+	images := s.data.images
+	users := s.data.users
 	imageList := make([]*imageRecord, 0, len(images))
 	for _, img := range images {
 		imageList = append(imageList, img)
 	}
 
-	sort.Slice(imageList, func(i, j int) bool {
-		return imageList[i].CreatedAt.After(imageList[j].CreatedAt)
-	})
+	sortNewestFirst(imageList)
 
 	total := len(imageList)
 	offset := (page - 1) * limit
@@ -780,12 +737,6 @@ func (s *Storage) GetImagesPaginated(page, limit int) ([]models.Image, int, erro
 		if !exists {
 			continue
 		}
-		likeCount := 0
-		for _, like := range likes {
-			if like.ImageID == img.ID {
-				likeCount++
-			}
-		}
 
 		result = append(result, models.Image{
 			ID:        img.ID,
@@ -793,35 +744,56 @@ func (s *Storage) GetImagesPaginated(page, limit int) ([]models.Image, int, erro
 			Path:      img.Path,
 			CreatedAt: img.CreatedAt,
 			Author:    user.Username,
-			Likes:     likeCount,
+			Likes:     len(s.data.idx.likesByImage[img.ID]),
 		})
 	}
 
 	return result, total, nil
 }
 
-func (s *Storage) GetUserImages(userID int, limit int) ([]models.Image, error) {
+// GetImagesByCursor returns up to limit gallery images after the given
+// cursor, newest first, and the cursor for the next page. An empty cursor
+// starts at the newest image; an empty next cursor means there are no more.
+func (s *Storage) GetImagesByCursor(cursor string, limit int) ([]models.Image, string, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	images, err := s.getImages()
+	imageList, next, err := s.pageImages(cursor, limit, nil)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
-	imageList := make([]*imageRecord, 0)
-	for _, img := range images {
-		if img.UserID == userID {
-			imageList = append(imageList, img)
+	users := s.data.users
+	result := make([]models.Image, 0, len(imageList))
+	for _, img := range imageList {
+		user, exists := users[img.UserID]
+		if !exists {
+			continue
 		}
+
+		result = append(result, models.Image{
+			ID:        img.ID,
+			UserID:    img.UserID,
+			Path:      img.Path,
+			CreatedAt: img.CreatedAt,
+			Author:    user.Username,
+			Likes:     len(s.data.idx.likesByImage[img.ID]),
+		})
 	}
 
-	sort.Slice(imageList, func(i, j int) bool {
-		return imageList[i].CreatedAt.After(imageList[j].CreatedAt)
-	})
+	return result, next, nil
+}
 
-	if limit > 0 && limit < len(imageList) {
-		imageList = imageList[:limit]
+// GetUserImages pages through a user's images like GetImagesByCursor.
+func (s *Storage) GetUserImages(userID int, cursor string, limit int) ([]models.Image, string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	imageList, next, err := s.pageImages(cursor, limit, func(img *imageRecord) bool {
+		return img.UserID == userID
+	})
+	if err != nil {
+		return nil, "", err
 	}
 
 	result := make([]models.Image, 0, len(imageList))
@@ -834,68 +806,49 @@ func (s *Storage) GetUserImages(userID int, limit int) ([]models.Image, error) {
 		})
 	}
 
-	return result, nil
+	return result, next, nil
 }
 
 func (s *Storage) DeleteImage(imageID int) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	images, err := s.getImages()
-	if err != nil {
-		return err
-	}
-
-	_, exists := images[imageID]
+	_, exists := s.data.images[imageID]
 	if !exists {
 		return fmt.Errorf("image not found")
 	}
 
-	delete(images, imageID)
-	likes, err := s.getLikes()
-	if err != nil {
-		return err
+	t := s.begin()
+	t.remove(imagesFile, imageID)
+	for id := range s.data.idx.likesByImage[imageID] {
+		t.remove(likesFile, id)
 	}
-
-	for id, like := range likes {
-		if like.ImageID == imageID {
-			delete(likes, id)
-		}
+	for id := range s.data.idx.commentsByImage[imageID] {
+		t.remove(commentsFile, id)
 	}
 
-	comments, err := s.getComments()
-	if err != nil {
-		return err
-	}
+	return t.commit()
+}
 
-	for id, comment := range comments {
-		if comment.ImageID == imageID {
-			delete(comments, id)
-		}
-	}
+// ImagePathInUse reports whether any image record still points at path.
+func (s *Storage) ImagePathInUse(path string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
-	if err := s.saveImages(images); err != nil {
-		return err
-	}
-	if err := s.saveLikes(likes); err != nil {
-		return err
-	}
-	if err := s.saveComments(comments); err != nil {
-		return err
+	for _, img := range s.data.images {
+		if img.Path == path {
+			return true, nil
+		}
 	}
 
-	return nil
+	return false, nil
 }
 
 func (s *Storage) GetImageOwner(imageID int) (int, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	images, err := s.getImages()
-	if err != nil {
-		return 0, err
-	}
-
+	images := s.data.images
 	img, exists := images[imageID]
 	if !exists {
 		return 0, fmt.Errorf("image not found")
@@ -908,35 +861,21 @@ func (s *Storage) LikeExists(userID, imageID int) (bool, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	likes, err := s.getLikes()
-	if err != nil {
-		return false, err
-	}
+	_, exists := s.data.idx.likeByPair[likeKey{userID, imageID}]
 
-	for _, like := range likes {
-		if like.UserID == userID && like.ImageID == imageID {
-			return true, nil
-		}
-	}
-
-	return false, nil
+	return exists, nil
 }
 
 func (s *Storage) CreateLike(userID, imageID int) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	likes, err := s.getLikes()
-	if err != nil {
-		return err
-	}
-	for _, like := range likes {
-		if like.UserID == userID && like.ImageID == imageID {
-			return fmt.Errorf("already liked")
-		}
+	if _, exists := s.data.idx.likeByPair[likeKey{userID, imageID}]; exists {
+		return fmt.Errorf("already liked")
 	}
 
-	counters, err := s.getIDCounters()
+	t := s.begin()
+	counters, err := t.ids()
 	if err != nil {
 		return err
 	}
@@ -944,40 +883,24 @@ func (s *Storage) CreateLike(userID, imageID int) error {
 	counters.LikeID++
 	likeID := counters.LikeID
 
-	likes[likeID] = &likeRecord{
+	t.put(likesFile, likeID, &likeRecord{
 		ID:        likeID,
 		UserID:    userID,
 		ImageID:   imageID,
 		CreatedAt: time.Now(),
-	}
-
-	if err := s.saveLikes(likes); err != nil {
-		return err
-	}
-	if err := s.saveIDCounters(counters); err != nil {
-		return err
-	}
+	})
 
-	return nil
+	return t.commit()
 }
 
 func (s *Storage) GetLikedImageIDs(userID int, imageIDs []int) (map[int]bool, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	likes, err := s.getLikes()
-	if err != nil {
-		return nil, err
-	}
-
 	result := make(map[int]bool)
-	for _, like := range likes {
-		if like.UserID == userID {
-			for _, imgID := range imageIDs {
-				if like.ImageID == imgID {
-					result[imgID] = true
-				}
-			}
+	for _, imgID := range imageIDs {
+		if _, exists := s.data.idx.likeByPair[likeKey{userID, imgID}]; exists {
+			result[imgID] = true
 		}
 	}
 
@@ -988,12 +911,8 @@ func (s *Storage) CreateComment(imageID, userID int, body string) (int, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	comments, err := s.getComments()
-	if err != nil {
-		return 0, err
-	}
-
-	counters, err := s.getIDCounters()
+	t := s.begin()
+	counters, err := t.ids()
 	if err != nil {
 		return 0, err
 	}
@@ -1001,18 +920,15 @@ func (s *Storage) CreateComment(imageID, userID int, body string) (int, error) {
 	counters.CommentID++
 	commentID := counters.CommentID
 
-	comments[commentID] = &commentRecord{
+	t.put(commentsFile, commentID, &commentRecord{
 		ID:        commentID,
 		ImageID:   imageID,
 		UserID:    userID,
 		Body:      body,
 		CreatedAt: time.Now(),
-	}
+	})
 
-	if err := s.saveComments(comments); err != nil {
-		return 0, err
-	}
-	if err := s.saveIDCounters(counters); err != nil {
+	if err := t.commit(); err != nil {
 		return 0, err
 	}
 
@@ -1023,21 +939,11 @@ func (s *Storage) GetCommentsByImageID(imageID int, limit int) ([]models.Comment
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	comments, err := s.getComments()
-	if err != nil {
-		return nil, err
-	}
-
-	users, err := s.getUsers()
-	if err != nil {
-		return nil, err
-	}
-
-	commentList := make([]*commentRecord, 0)
-	for _, comment := range comments {
-		if comment.ImageID == imageID {
-			commentList = append(commentList, comment)
-		}
+	users := s.data.users
+	commentIDs := s.data.idx.commentsByImage[imageID]
+	commentList := make([]*commentRecord, 0, len(commentIDs))
+	for id := range commentIDs {
+		commentList = append(commentList, s.data.comments[id])
 	}
 
 	sort.Slice(commentList, func(i, j int) bool {
@@ -1050,16 +956,20 @@ func (s *Storage) GetCommentsByImageID(imageID int, limit int) ([]models.Comment
 
 	result := make([]models.Comment, 0, len(commentList))
 	for _, comment := range commentList {
-		user, exists := users[comment.UserID]
-		if !exists {
-			continue
+		author := deletedAuthor
+		if comment.UserID != 0 {
+			user, exists := users[comment.UserID]
+			if !exists {
+				continue
+			}
+			author = user.Username
 		}
 
 		result = append(result, models.Comment{
 			ID:        comment.ID,
 			ImageID:   comment.ImageID,
 			UserID:    comment.UserID,
-			Author:    user.Username,
+			Author:    author,
 			Body:      comment.Body,
 			CreatedAt: comment.CreatedAt,
 		})
@@ -1068,15 +978,110 @@ func (s *Storage) GetCommentsByImageID(imageID int, limit int) ([]models.Comment
 	return result, nil
 }
 
-func (s *Storage) GetAssets() ([]models.Asset, error) {
+// GetUserActivity collects the user's images, the comments and likes they
+// gave, and the comments and likes left on their images.
+func (s *Storage) GetUserActivity(userID int) (*models.UserActivity, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	assets, err := s.getAssets()
-	if err != nil {
-		return nil, err
+	d := s.data
+	if _, exists := d.users[userID]; !exists {
+		return nil, fmt.Errorf("user not found")
 	}
 
+	author := func(id int) string {
+		if user, exists := d.users[id]; exists {
+			return user.Username
+		}
+		return deletedAuthor
+	}
+
+	activity := &models.UserActivity{
+		Images:           []models.Image{},
+		Comments:         []models.Comment{},
+		LikesGiven:       []models.Like{},
+		CommentsReceived: []models.Comment{},
+		LikesReceived:    []models.Like{},
+	}
+	owned := make(map[int]bool)
+	for _, img := range d.images {
+		if img.UserID != userID {
+			continue
+		}
+		owned[img.ID] = true
+		activity.Images = append(activity.Images, models.Image{
+			ID:        img.ID,
+			UserID:    img.UserID,
+			Path:      img.Path,
+			CreatedAt: img.CreatedAt,
+			Author:    author(img.UserID),
+			Likes:     len(d.idx.likesByImage[img.ID]),
+		})
+	}
+
+	for _, comment := range d.comments {
+		if comment.UserID != userID && !owned[comment.ImageID] {
+			continue
+		}
+		c := models.Comment{
+			ID:        comment.ID,
+			ImageID:   comment.ImageID,
+			UserID:    comment.UserID,
+			Author:    author(comment.UserID),
+			Body:      comment.Body,
+			CreatedAt: comment.CreatedAt,
+		}
+		if comment.UserID == userID {
+			activity.Comments = append(activity.Comments, c)
+		}
+		if owned[comment.ImageID] {
+			activity.CommentsReceived = append(activity.CommentsReceived, c)
+		}
+	}
+
+	for _, like := range d.likes {
+		if like.UserID != userID && !owned[like.ImageID] {
+			continue
+		}
+		l := models.Like{
+			ID:        like.ID,
+			UserID:    like.UserID,
+			ImageID:   like.ImageID,
+			Author:    author(like.UserID),
+			CreatedAt: like.CreatedAt,
+		}
+		if like.UserID == userID {
+			activity.LikesGiven = append(activity.LikesGiven, l)
+		}
+		if owned[like.ImageID] {
+			activity.LikesReceived = append(activity.LikesReceived, l)
+		}
+	}
+
+	sort.Slice(activity.Images, func(i, j int) bool {
+		return activity.Images[i].ID < activity.Images[j].ID
+	})
+	sort.Slice(activity.Comments, func(i, j int) bool {
+		return activity.Comments[i].ID < activity.Comments[j].ID
+	})
+	sort.Slice(activity.LikesGiven, func(i, j int) bool {
+		return activity.LikesGiven[i].ID < activity.LikesGiven[j].ID
+	})
+	sort.Slice(activity.CommentsReceived, func(i, j int) bool {
+		return activity.CommentsReceived[i].ID < activity.CommentsReceived[j].ID
+	})
+	sort.Slice(activity.LikesReceived, func(i, j int) bool {
+		return activity.LikesReceived[i].ID < activity.LikesReceived[j].ID
+	})
+
+	return activity, nil
+}
+
+func (s *Storage) GetAssets() ([]models.Asset, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	assets := s.data.assets
 	result := make([]models.Asset, 0, len(assets))
 	for _, asset := range assets {
 		result = append(result, models.Asset{
@@ -1097,11 +1102,7 @@ func (s *Storage) GetAssetByID(id int) (*models.Asset, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	assets, err := s.getAssets()
-	if err != nil {
-		return nil, err
-	}
-
+	assets := s.data.assets
 	asset, exists := assets[id]
 	if !exists {
 		return nil, fmt.Errorf("asset not found")
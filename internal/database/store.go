@@ -0,0 +1,93 @@
+package database
+
+import (
+	"camagru/internal/models"
+	"time"
+)
+
+type Store interface {
+	InitDB() error
+	Close() error
+
+	GetUserByID(id int) (*models.User, error)
+	GetUserByUsernameOrEmail(usernameOrEmail string) (*models.User, error)
+	UserExists(username, email string) (bool, bool, error)
+	CreateUser(username, email, passwordHash, verificationToken string, verificationExpires time.Time) (int, error)
+	VerifyUser(token string) error
+	GetUserByVerificationToken(token string) (*models.User, error)
+	SetVerificationToken(userID int, token string, expires time.Time) error
+	SetMagicLinkToken(userID int, token string, expires time.Time) error
+	ConsumeMagicLink(token string) (*models.User, error)
+	GetUserByOIDCSubject(subject string) (*models.User, error)
+	LinkOIDCSubject(userID int, subject string) error
+	CreateOIDCUser(username, email, subject, verificationToken string, verificationExpires time.Time) (int, error)
+	SetPasswordResetToken(email string, token string, expires time.Time) error
+	GetUserByResetToken(token string) (*models.User, error)
+	UpdateUserPassword(userID int, passwordHash string, keepSessionID int) error
+	RehashPassword(userID int, oldHash, newHash string) error
+	ResetPassword(token, passwordHash string) (*models.User, error)
+	UpdateUser(userID int, username, email string) error
+	SetPendingEmail(userID int, email, token string, expires time.Time) error
+	ConfirmEmailChange(token, undoToken string, undoExpires time.Time) (*models.User, string, error)
+	UndoEmailChange(token string) (*models.User, error)
+	UpdateUserPreferences(userID int, commentNotifications, magicLinks bool) error
+	DeleteUser(userID int, anonymizeComments bool) ([]string, error)
+	PurgeUnverifiedUsers(createdBefore time.Time) (int, error)
+	GetUserActivity(userID int) (*models.UserActivity, error)
+
+	SetPendingTOTPSecret(userID int, secret string) error
+	EnableTOTP(userID int, step int64, recoveryCodes []string) error
+	DisableTOTP(userID int) error
+	UseTOTPStep(userID int, step int64) error
+	UseRecoveryCode(userID int, code string) error
+	SetRecoveryCodes(userID int, recoveryCodes []string) error
+
+	CreateSession(userID int, token, userAgent, ip string) (int, error)
+	GetSessionByToken(token string) (*models.Session, error)
+	GetUserSessions(userID int) ([]models.Session, error)
+	TouchSession(sessionID int, at time.Time) error
+	DeleteSession(sessionID int) error
+	DeleteUserSessions(userID int) error
+	DeleteExpiredSessions(createdBefore, seenBefore time.Time) error
+
+	CreateAPIToken(userID int, name, token string, scopes []string, expiresAt *time.Time) (int, error)
+	GetAPITokenByToken(token string) (*models.APIToken, error)
+	GetUserAPITokens(userID int) ([]models.APIToken, error)
+	TouchAPIToken(tokenID int, at time.Time) error
+	DeleteAPIToken(userID, tokenID int) error
+
+	CreateInvite(userID int, code string, maxUses int, expiresAt *time.Time) (int, error)
+	GetInviteByID(inviteID int) (*models.Invite, error)
+	GetUserInvites(userID int) ([]models.Invite, error)
+	ListInvites() ([]models.Invite, error)
+	DeleteInvite(inviteID int) error
+	CreateInvitedUser(username, email, passwordHash, verificationToken string, verificationExpires time.Time, inviteCode string) (int, error)
+
+	CreateImage(userID int, path string) (int, error)
+	GetImageByID(id int) (*models.Image, error)
+	GetImagesPaginated(page, limit int) ([]models.Image, int, error)
+	GetImagesByCursor(cursor string, limit int) ([]models.Image, string, error)
+	GetUserImages(userID int, cursor string, limit int) ([]models.Image, string, error)
+	DeleteImage(imageID int) error
+	GetImageOwner(imageID int) (int, error)
+	ImagePathInUse(path string) (bool, error)
+
+	LikeExists(userID, imageID int) (bool, error)
+	CreateLike(userID, imageID int) error
+	GetLikedImageIDs(userID int, imageIDs []int) (map[int]bool, error)
+
+	CreateComment(imageID, userID int, body string) (int, error)
+	GetCommentsByImageID(imageID int, limit int) ([]models.Comment, error)
+
+	ListUsers(query string, page, limit int) ([]models.User, int, error)
+	MarkUserVerified(userID int) error
+	SetUserSuspended(userID int, suspended bool) error
+	SetUserRole(userID int, role string) error
+	DeleteComment(commentID int) error
+	GetStats() (*models.Stats, error)
+
+	GetAssets() ([]models.Asset, error)
+	GetAssetByID(id int) (*models.Asset, error)
+}
+
+var _ Store = (*Storage)(nil)
@@ -0,0 +1,81 @@
+package database
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// tokenKeyFile holds the key used to hash session, verification and reset
+// tokens. It lives beside the collections but is deliberately left out of
+// backups, so a copied backup holds no usable tokens. It has to be copied
+// separately; RestoreBackup refuses to restore without it.
+const tokenKeyFile = "token.key"
+
+// hashToken returns the keyed hash under which a token is stored and
+// looked up. The empty token hashes to the empty string so that "no token"
+// stays recognisable.
+func (s *Storage) hashToken(token string) string {
+	if token == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, s.tokenKey)
+	mac.Write([]byte(token))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s *Storage) hashTokens(tokens []string) []string {
+	hashed := make([]string, len(tokens))
+	for i, token := range tokens {
+		hashed[i] = s.hashToken(token)
+	}
+	return hashed
+}
+
+// loadTokenKey reads the token key from dataDir, creating it on first use.
+// Storage without a data directory gets a key that lasts for the process.
+func loadTokenKey(dataDir string) ([]byte, error) {
+	if dataDir == "" {
+		return newTokenKey()
+	}
+
+	path := filepath.Join(dataDir, tokenKeyFile)
+	data, err := os.ReadFile(path)
+	if err == nil {
+		key, err := hex.DecodeString(string(data))
+		if err != nil || len(key) < 32 {
+			return nil, fmt.Errorf("%s is corrupt", tokenKeyFile)
+		}
+		return key, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	key, err := newTokenKey()
+	if err != nil {
+		return nil, err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(hex.EncodeToString(key)), 0600); err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	return key, syncDir(dataDir)
+}
+
+func newTokenKey() ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
@@ -0,0 +1,136 @@
+package database
+
+import (
+	"fmt"
+)
+
+// SetPendingTOTPSecret stores a secret the user has been shown but has not
+// confirmed yet. Any earlier pending secret is replaced.
+func (s *Storage) SetPendingTOTPSecret(userID int, secret string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, exists := s.data.users[userID]
+	if !exists {
+		return fmt.Errorf("user not found")
+	}
+
+	updated := *user
+	updated.TOTPPendingSecret = secret
+
+	t := s.begin()
+	t.put(usersFile, userID, &updated)
+	return t.commit()
+}
+
+// EnableTOTP makes the pending secret active, recording step as already
+// used, and replaces the recovery codes. Only hashes of the codes are kept.
+func (s *Storage) EnableTOTP(userID int, step int64, recoveryCodes []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, exists := s.data.users[userID]
+	if !exists {
+		return fmt.Errorf("user not found")
+	}
+	if user.TOTPPendingSecret == "" {
+		return fmt.Errorf("no pending two-factor secret")
+	}
+
+	updated := *user
+	updated.TOTPSecret = user.TOTPPendingSecret
+	updated.TOTPPendingSecret = ""
+	updated.TOTPLastStep = step
+	updated.RecoveryCodes = s.hashTokens(recoveryCodes)
+
+	t := s.begin()
+	t.put(usersFile, userID, &updated)
+	return t.commit()
+}
+
+func (s *Storage) DisableTOTP(userID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, exists := s.data.users[userID]
+	if !exists {
+		return fmt.Errorf("user not found")
+	}
+
+	updated := *user
+	updated.TOTPSecret = ""
+	updated.TOTPPendingSecret = ""
+	updated.TOTPLastStep = 0
+	updated.RecoveryCodes = nil
+
+	t := s.begin()
+	t.put(usersFile, userID, &updated)
+	return t.commit()
+}
+
+// UseTOTPStep records that the code for step has been accepted. It fails if
+// that step or a later one was already used, so each code works only once.
+func (s *Storage) UseTOTPStep(userID int, step int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, exists := s.data.users[userID]
+	if !exists {
+		return fmt.Errorf("user not found")
+	}
+	if step <= user.TOTPLastStep {
+		return fmt.Errorf("code already used")
+	}
+
+	updated := *user
+	updated.TOTPLastStep = step
+
+	t := s.begin()
+	t.put(usersFile, userID, &updated)
+	return t.commit()
+}
+
+// UseRecoveryCode consumes one of the user's recovery codes.
+func (s *Storage) UseRecoveryCode(userID int, code string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, exists := s.data.users[userID]
+	if !exists {
+		return fmt.Errorf("user not found")
+	}
+
+	hashed := s.hashToken(code)
+	for i, candidate := range user.RecoveryCodes {
+		if hashed != "" && candidate == hashed {
+			updated := *user
+			updated.RecoveryCodes = make([]string, 0, len(user.RecoveryCodes)-1)
+			updated.RecoveryCodes = append(updated.RecoveryCodes, user.RecoveryCodes[:i]...)
+			updated.RecoveryCodes = append(updated.RecoveryCodes, user.RecoveryCodes[i+1:]...)
+
+			t := s.begin()
+			t.put(usersFile, userID, &updated)
+			return t.commit()
+		}
+	}
+
+	return fmt.Errorf("invalid recovery code")
+}
+
+// SetRecoveryCodes replaces the user's recovery codes.
+func (s *Storage) SetRecoveryCodes(userID int, recoveryCodes []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, exists := s.data.users[userID]
+	if !exists {
+		return fmt.Errorf("user not found")
+	}
+
+	updated := *user
+	updated.RecoveryCodes = s.hashTokens(recoveryCodes)
+
+	t := s.begin()
+	t.put(usersFile, userID, &updated)
+	return t.commit()
+}
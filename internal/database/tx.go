@@ -0,0 +1,277 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+const (
+	usersFile    = "users.json"
+	imagesFile   = "images.json"
+	likesFile    = "likes.json"
+	commentsFile = "comments.json"
+	assetsFile   = "assets.json"
+	sessionsFile = "sessions.json"
+	tokensFile   = "tokens.json"
+	invitesFile  = "invites.json"
+	idsFile      = "ids.json"
+)
+
+var collectionFiles = []string{usersFile, imagesFile, likesFile, commentsFile, assetsFile, sessionsFile, tokensFile, invitesFile, idsFile}
+
+type op struct {
+	collection string
+	id         int
+	record     interface{}
+}
+
+// tx stages changes to any number of collections and to ids.json. Nothing
+// is visible until commit, which applies every change to the resident
+// dataset and hands them to the backend as one unit; if the backend fails
+// the dataset is rolled back. A tx that is dropped without commit has no
+// effect. Callers must hold s.mu for writing.
+type tx struct {
+	s        *Storage
+	ops      []op
+	counters *idCounters
+}
+
+func (s *Storage) begin() *tx {
+	return &tx{s: s}
+}
+
+func (t *tx) put(collection string, id int, record interface{}) {
+	t.ops = append(t.ops, op{collection: collection, id: id, record: record})
+}
+
+func (t *tx) remove(collection string, id int) {
+	t.ops = append(t.ops, op{collection: collection, id: id})
+}
+
+func (t *tx) ids() (*idCounters, error) {
+	if t.counters == nil {
+		counters := t.s.data.ids
+		t.counters = &counters
+	}
+	return t.counters, nil
+}
+
+func (t *tx) commit() error {
+	ops := t.ops
+	if t.counters != nil {
+		ops = append(ops, op{collection: idsFile, record: t.counters})
+	}
+	if len(ops) == 0 {
+		return nil
+	}
+
+	undo := make([]op, 0, len(ops))
+	for _, o := range ops {
+		prev, err := t.s.data.apply(o)
+		if err != nil {
+			t.s.data.revert(undo)
+			return err
+		}
+		undo = append(undo, prev)
+	}
+
+	if err := t.s.backend.commit(t.s.data, ops); err != nil {
+		t.s.data.revert(undo)
+		return err
+	}
+	return nil
+}
+
+type dataset struct {
+	users    map[int]*userRecord
+	images   map[int]*imageRecord
+	likes    map[int]*likeRecord
+	comments map[int]*commentRecord
+	assets   map[int]*assetRecord
+	sessions map[int]*sessionRecord
+	tokens   map[int]*apiTokenRecord
+	invites  map[int]*inviteRecord
+	ids      idCounters
+	idx      indexes
+}
+
+func newDataset() *dataset {
+	d := &dataset{
+		users:    make(map[int]*userRecord),
+		images:   make(map[int]*imageRecord),
+		likes:    make(map[int]*likeRecord),
+		comments: make(map[int]*commentRecord),
+		assets:   make(map[int]*assetRecord),
+		sessions: make(map[int]*sessionRecord),
+		tokens:   make(map[int]*apiTokenRecord),
+		invites:  make(map[int]*inviteRecord),
+	}
+	d.reindex()
+	return d
+}
+
+// apply performs o and returns the op that undoes it.
+func (d *dataset) apply(o op) (op, error) {
+	undo := op{collection: o.collection, id: o.id}
+	switch o.collection {
+	case usersFile:
+		if prev, exists := d.users[o.id]; exists {
+			undo.record = prev
+			d.unindexUser(prev)
+		}
+		if o.record == nil {
+			delete(d.users, o.id)
+		} else {
+			user := o.record.(*userRecord)
+			d.users[o.id] = user
+			d.indexUser(user)
+		}
+	case imagesFile:
+		if prev, exists := d.images[o.id]; exists {
+			undo.record = prev
+		}
+		if o.record == nil {
+			delete(d.images, o.id)
+		} else {
+			d.images[o.id] = o.record.(*imageRecord)
+		}
+	case likesFile:
+		if prev, exists := d.likes[o.id]; exists {
+			undo.record = prev
+			d.unindexLike(prev)
+		}
+		if o.record == nil {
+			delete(d.likes, o.id)
+		} else {
+			like := o.record.(*likeRecord)
+			d.likes[o.id] = like
+			d.indexLike(like)
+		}
+	case commentsFile:
+		if prev, exists := d.comments[o.id]; exists {
+			undo.record = prev
+			d.unindexComment(prev)
+		}
+		if o.record == nil {
+			delete(d.comments, o.id)
+		} else {
+			comment := o.record.(*commentRecord)
+			d.comments[o.id] = comment
+			d.indexComment(comment)
+		}
+	case assetsFile:
+		if prev, exists := d.assets[o.id]; exists {
+			undo.record = prev
+		}
+		if o.record == nil {
+			delete(d.assets, o.id)
+		} else {
+			d.assets[o.id] = o.record.(*assetRecord)
+		}
+	case sessionsFile:
+		if prev, exists := d.sessions[o.id]; exists {
+			undo.record = prev
+			d.unindexSession(prev)
+		}
+		if o.record == nil {
+			delete(d.sessions, o.id)
+		} else {
+			session := o.record.(*sessionRecord)
+			d.sessions[o.id] = session
+			d.indexSession(session)
+		}
+	case tokensFile:
+		if prev, exists := d.tokens[o.id]; exists {
+			undo.record = prev
+			d.unindexAPIToken(prev)
+		}
+		if o.record == nil {
+			delete(d.tokens, o.id)
+		} else {
+			token := o.record.(*apiTokenRecord)
+			d.tokens[o.id] = token
+			d.indexAPIToken(token)
+		}
+	case invitesFile:
+		if prev, exists := d.invites[o.id]; exists {
+			undo.record = prev
+			d.unindexInvite(prev)
+		}
+		if o.record == nil {
+			delete(d.invites, o.id)
+		} else {
+			invite := o.record.(*inviteRecord)
+			d.invites[o.id] = invite
+			d.indexInvite(invite)
+		}
+	case idsFile:
+		prev := d.ids
+		undo.record = &prev
+		d.ids = *o.record.(*idCounters)
+	default:
+		return op{}, fmt.Errorf("unknown collection %q", o.collection)
+	}
+	return undo, nil
+}
+
+func (d *dataset) revert(undo []op) {
+	for i := len(undo) - 1; i >= 0; i-- {
+		d.apply(undo[i])
+	}
+}
+
+// collection returns the value stored in the named file, suitable for
+// json.Marshal and, being a pointer, json.Unmarshal.
+func (d *dataset) collection(name string) interface{} {
+	switch name {
+	case usersFile:
+		return &d.users
+	case imagesFile:
+		return &d.images
+	case likesFile:
+		return &d.likes
+	case commentsFile:
+		return &d.comments
+	case assetsFile:
+		return &d.assets
+	case sessionsFile:
+		return &d.sessions
+	case tokensFile:
+		return &d.tokens
+	case invitesFile:
+		return &d.invites
+	case idsFile:
+		return &d.ids
+	}
+	return nil
+}
+
+func decodeRecord(collection string, data json.RawMessage) (interface{}, error) {
+	var record interface{}
+	switch collection {
+	case usersFile:
+		record = &userRecord{}
+	case imagesFile:
+		record = &imageRecord{}
+	case likesFile:
+		record = &likeRecord{}
+	case commentsFile:
+		record = &commentRecord{}
+	case assetsFile:
+		record = &assetRecord{}
+	case sessionsFile:
+		record = &sessionRecord{}
+	case tokensFile:
+		record = &apiTokenRecord{}
+	case invitesFile:
+		record = &inviteRecord{}
+	case idsFile:
+		record = &idCounters{}
+	default:
+		return nil, fmt.Errorf("unknown collection %q", collection)
+	}
+	if err := json.Unmarshal(data, record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
@@ -0,0 +1,145 @@
+package database
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+var errBackend = errors.New("disk full")
+
+// failingBackend keeps nothing, like memoryBackend, but fails every commit
+// while fail is set.
+type failingBackend struct {
+	memoryBackend
+	fail bool
+}
+
+func (b *failingBackend) commit(d *dataset, ops []op) error {
+	if b.fail {
+		return errBackend
+	}
+	return nil
+}
+
+// checkUnchanged fails the test unless d holds exactly what before, taken
+// with encodeSnapshot, did and its indexes are current.
+func checkUnchanged(t *testing.T, d *dataset, before []byte, when string) {
+	t.Helper()
+	after, err := encodeSnapshot(d, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Fatalf("%s: dataset changed\nbefore: %s\n after: %s", when, before, after)
+	}
+	checkIndexes(t, d, when)
+}
+
+func TestFailedCommitRestoresDataset(t *testing.T) {
+	s := NewMemoryStorage()
+	backend := &failingBackend{}
+	s.backend = backend
+
+	aliceID := createTestUser(t, s, "alice")
+	bobID := createTestUser(t, s, "bob")
+	imageID, err := s.CreateImage(aliceID, "/static/uploads/a.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CreateLike(bobID, imageID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.CreateComment(imageID, bobID, "nice"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.CreateSession(aliceID, "alice-session", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.CreateAPIToken(aliceID, "cli", "alice-token", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	before, err := encodeSnapshot(s.data, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend.fail = true
+
+	changes := []struct {
+		name string
+		run  func() error
+	}{
+		{"create user", func() error {
+			_, err := s.CreateUser("carol", "carol@example.com", "hash", "", time.Now().Add(time.Hour))
+			return err
+		}},
+		{"rename user", func() error { return s.UpdateUser(aliceID, "alice2", "alice2@example.com") }},
+		{"change password", func() error { return s.UpdateUserPassword(aliceID, "new-hash", 0) }},
+		{"like", func() error { return s.CreateLike(aliceID, imageID) }},
+		{"comment", func() error {
+			_, err := s.CreateComment(imageID, aliceID, "thanks")
+			return err
+		}},
+		{"delete image", func() error { return s.DeleteImage(imageID) }},
+		{"delete sessions", func() error { return s.DeleteUserSessions(aliceID) }},
+		{"delete user", func() error {
+			_, err := s.DeleteUser(bobID, true)
+			return err
+		}},
+		{"delete user and their content", func() error {
+			_, err := s.DeleteUser(aliceID, false)
+			return err
+		}},
+	}
+	for _, change := range changes {
+		if err := change.run(); !errors.Is(err, errBackend) {
+			t.Fatalf("%s: got %v, want the backend's error", change.name, err)
+		}
+		checkUnchanged(t, s.data, before, change.name)
+	}
+
+	// Lookups through the indexes still find the old records.
+	if user, err := s.GetUserByUsernameOrEmail("alice"); err != nil || user.ID != aliceID {
+		t.Fatalf("alice: %+v, %v", user, err)
+	}
+	if _, err := s.GetUserByUsernameOrEmail("alice2"); err == nil {
+		t.Fatal("the failed rename is visible")
+	}
+	if liked, _ := s.LikeExists(bobID, imageID); !liked {
+		t.Fatal("bob's like is gone")
+	}
+	if session, err := s.GetSessionByToken("alice-session"); err != nil || session.UserID != aliceID {
+		t.Fatalf("alice's session: %+v, %v", session, err)
+	}
+
+	// Once the backend recovers, the same changes go through.
+	backend.fail = false
+	if err := s.UpdateUser(aliceID, "alice2", "alice2@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	checkIndexes(t, s.data, "after recovery")
+}
+
+func TestFailedApplyRestoresDataset(t *testing.T) {
+	s := NewMemoryStorage()
+	userID := createTestUser(t, s, "alice")
+	before, err := encodeSnapshot(s.data, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first op applies, the second cannot be, so the first is undone
+	// before the backend ever sees either.
+	s.mu.Lock()
+	tx := s.begin()
+	tx.put(usersFile, userID, &userRecord{ID: userID, Username: "alice2", Email: "alice2@example.com"})
+	tx.remove("unknown.json", 1)
+	err = tx.commit()
+	s.mu.Unlock()
+	if err == nil {
+		t.Fatal("commit succeeded")
+	}
+	checkUnchanged(t, s.data, before, "failed apply")
+}
@@ -2,6 +2,14 @@ package models
 
 import "time"
 
+// Roles, from least to most privileged. Moderators can remove any content;
+// admins can also manage accounts.
+const (
+	RoleUser      = "user"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
 type User struct {
 	ID                   int
 	Username             string
@@ -9,10 +17,20 @@ type User struct {
 	PasswordHash         string
 	Verified             bool
 	VerificationToken    string
+	VerificationExpires  *time.Time
+	VerificationSentAt   *time.Time
 	ResetToken           string
 	ResetExpires         *time.Time
 	CommentNotifications bool
 	CreatedAt            time.Time
+	TOTPSecret           string
+	TOTPPendingSecret    string
+	RecoveryCodesLeft    int
+	PendingEmail         string
+	Role                 string
+	Suspended            bool
+	MagicLinkDisabled    bool
+	OIDCSubject          string
 }
 
 type Image struct {
@@ -35,6 +53,70 @@ type Comment struct {
 	CreatedAt time.Time `json:"createdAt"`
 }
 
+type Like struct {
+	ID        int       `json:"id"`
+	UserID    int       `json:"user_id"`
+	ImageID   int       `json:"image_id"`
+	Author    string    `json:"author"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// UserActivity is everything a user has created or received, as gathered
+// for a data export.
+type UserActivity struct {
+	Images           []Image   `json:"images"`
+	Comments         []Comment `json:"comments"`
+	LikesGiven       []Like    `json:"likes_given"`
+	CommentsReceived []Comment `json:"comments_received"`
+	LikesReceived    []Like    `json:"likes_received"`
+}
+
+type Session struct {
+	ID        int       `json:"id"`
+	UserID    int       `json:"user_id"`
+	UserAgent string    `json:"user_agent"`
+	IP        string    `json:"ip"`
+	CreatedAt time.Time `json:"createdAt"`
+	LastSeen  time.Time `json:"lastSeen"`
+	Current   bool      `json:"current"`
+}
+
+type APIToken struct {
+	ID        int        `json:"id"`
+	UserID    int        `json:"user_id"`
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	CreatedAt time.Time  `json:"createdAt"`
+	ExpiresAt *time.Time `json:"expiresAt"`
+	LastUsed  *time.Time `json:"lastUsed"`
+}
+
+// Invite lets people register while registration is invite-only. The code
+// itself is only shown to its creator when the invite is made.
+type Invite struct {
+	ID         int        `json:"id"`
+	CreatedBy  int        `json:"created_by"`
+	Creator    string     `json:"creator"`
+	MaxUses    int        `json:"max_uses"`
+	Uses       int        `json:"uses"`
+	RedeemedBy []string   `json:"redeemed_by"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	ExpiresAt  *time.Time `json:"expiresAt"`
+}
+
+type Stats struct {
+	Users          int `json:"users"`
+	VerifiedUsers  int `json:"verified_users"`
+	SuspendedUsers int `json:"suspended_users"`
+	Moderators     int `json:"moderators"`
+	Admins         int `json:"admins"`
+	Images         int `json:"images"`
+	Comments       int `json:"comments"`
+	Likes          int `json:"likes"`
+	Sessions       int `json:"sessions"`
+	APITokens      int `json:"api_tokens"`
+}
+
 type Asset struct {
 	ID   int    `json:"id"`
 	Name string `json:"name"`
@@ -0,0 +1,239 @@
+// Package oidc implements the relying-party side of OpenID Connect: the
+// authorization code flow with PKCE, and verification of the ID token it
+// returns against the provider's published keys.
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Config struct {
+	Issuer       string // e.g. https://login.example.com/realms/team
+	ClientID     string
+	ClientSecret string // empty for public clients, which rely on PKCE alone
+	RedirectURL  string
+	Scopes       []string // "openid" is always requested
+}
+
+// Claims are the parts of a verified ID token the application uses.
+type Claims struct {
+	Subject           string `json:"sub"`
+	Email             string `json:"email"`
+	EmailVerified     bool   `json:"email_verified"`
+	PreferredUsername string `json:"preferred_username"`
+	Name              string `json:"name"`
+}
+
+type discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// Provider talks to one OpenID provider. Its discovery document is fetched
+// on first use, so the application can start while the provider is down.
+type Provider struct {
+	config Config
+	client *http.Client
+
+	mu        sync.Mutex
+	discovery *discovery
+	keys      *keySet
+}
+
+func NewProvider(config Config) (*Provider, error) {
+	if config.Issuer == "" || config.ClientID == "" || config.RedirectURL == "" {
+		return nil, fmt.Errorf("OIDC issuer, client ID and redirect URL are required")
+	}
+	config.Issuer = strings.TrimSuffix(config.Issuer, "/")
+	return &Provider{
+		config: config,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+// Issuer identifies the provider. Subjects are only unique per issuer.
+func (p *Provider) Issuer() string {
+	return p.config.Issuer
+}
+
+// AuthRequest is a sign-in that has been sent to the provider. Its fields
+// must be kept, out of the browser's reach, until the provider redirects
+// back.
+type AuthRequest struct {
+	State    string
+	Nonce    string
+	Verifier string
+	URL      string
+	// Fresh requires the user to have authenticated at the provider after
+	// Started, rather than riding on a session they already had there.
+	Fresh   bool
+	Started time.Time
+}
+
+// AuthCodeURL starts a sign-in, returning where to send the browser.
+func (p *Provider) AuthCodeURL(ctx context.Context) (*AuthRequest, error) {
+	return p.authCodeURL(ctx, false)
+}
+
+// ReauthCodeURL starts a sign-in that makes the user authenticate at the
+// provider again, to confirm it is still them before a sensitive change.
+func (p *Provider) ReauthCodeURL(ctx context.Context) (*AuthRequest, error) {
+	return p.authCodeURL(ctx, true)
+}
+
+func (p *Provider) authCodeURL(ctx context.Context, fresh bool) (*AuthRequest, error) {
+	d, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &AuthRequest{Fresh: fresh, Started: time.Now()}
+	for _, field := range []*string{&req.State, &req.Nonce, &req.Verifier} {
+		if *field, err = randomString(); err != nil {
+			return nil, err
+		}
+	}
+	challenge := sha256.Sum256([]byte(req.Verifier))
+
+	scopes := []string{"openid"}
+	for _, scope := range p.config.Scopes {
+		if scope != "openid" {
+			scopes = append(scopes, scope)
+		}
+	}
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.config.ClientID},
+		"redirect_uri":          {p.config.RedirectURL},
+		"scope":                 {strings.Join(scopes, " ")},
+		"state":                 {req.State},
+		"nonce":                 {req.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	if fresh {
+		query.Set("prompt", "login")
+		query.Set("max_age", "0")
+	}
+	separator := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	req.URL = d.AuthorizationEndpoint + separator + query.Encode()
+	return req, nil
+}
+
+// Exchange redeems the code the provider redirected back with and returns
+// the claims of the verified ID token.
+func (p *Provider) Exchange(ctx context.Context, req *AuthRequest, code string) (*Claims, error) {
+	d, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.config.RedirectURL},
+		"client_id":     {p.config.ClientID},
+		"code_verifier": {req.Verifier},
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	httpReq.Header.Set("Accept", "application/json")
+	if p.config.ClientSecret != "" {
+		httpReq.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.config.ClientSecret))
+	}
+
+	resp, err := p.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token endpoint: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var token struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.Unmarshal(body, &token); err != nil {
+		return nil, fmt.Errorf("token endpoint: %v", err)
+	}
+	if token.IDToken == "" {
+		return nil, fmt.Errorf("token endpoint returned no ID token")
+	}
+
+	return p.verify(ctx, d, token.IDToken, req)
+}
+
+// discover fetches the provider's configuration once. Failures are not
+// cached, so a provider that was down is retried on the next sign-in.
+func (p *Provider) discover(ctx context.Context) (*discovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	var d discovery
+	if err := p.getJSON(ctx, p.config.Issuer+"/.well-known/openid-configuration", &d); err != nil {
+		return nil, fmt.Errorf("OIDC discovery: %v", err)
+	}
+	if strings.TrimSuffix(d.Issuer, "/") != p.config.Issuer {
+		return nil, fmt.Errorf("OIDC discovery: issuer %q does not match %q", d.Issuer, p.config.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, fmt.Errorf("OIDC discovery: incomplete provider configuration")
+	}
+
+	p.discovery = &d
+	p.keys = &keySet{uri: d.JWKSURI}
+	return p.discovery, nil
+}
+
+func (p *Provider) getJSON(ctx context.Context, uri string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", uri, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", uri, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+func randomString() (string, error) {
+	bytes := make([]byte, 32)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(bytes), nil
+}
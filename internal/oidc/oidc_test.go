@@ -0,0 +1,248 @@
+package oidc
+
+import (
+	"camagru/internal/oidc/mockidp"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testEnv struct {
+	t        *testing.T
+	idp      *mockidp.IdP
+	provider *Provider
+	// tamper, if set, may change the ID token the token endpoint returns.
+	tamper func(idToken string) string
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	t.Helper()
+	idp, err := mockidp.New("", "camagru")
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp.SetUser(mockidp.User{Subject: "alice-1", Email: "alice@example.com", EmailVerified: true})
+
+	e := &testEnv{t: t, idp: idp}
+	srv := httptest.NewServer(http.HandlerFunc(e.serve))
+	t.Cleanup(srv.Close)
+	idp.Issuer = srv.URL
+
+	e.provider, err = NewProvider(Config{
+		Issuer:      srv.URL,
+		ClientID:    "camagru",
+		RedirectURL: "http://localhost:8080/login/oidc/callback",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+// serve passes requests to the provider, applying tamper to its tokens.
+func (e *testEnv) serve(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/token" || e.tamper == nil {
+		e.idp.ServeHTTP(w, r)
+		return
+	}
+	rec := httptest.NewRecorder()
+	e.idp.ServeHTTP(rec, r)
+	var body map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err == nil {
+		if token, ok := body["id_token"].(string); ok {
+			body["id_token"] = e.tamper(token)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(rec.Code)
+	json.NewEncoder(w).Encode(body)
+}
+
+// authorize sends req to the provider as a browser would, and returns the
+// code it redirects back with.
+func (e *testEnv) authorize(req *AuthRequest) string {
+	e.t.Helper()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(req.URL)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	resp.Body.Close()
+	callback, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil || resp.StatusCode != http.StatusFound {
+		e.t.Fatalf("authorize: status %d", resp.StatusCode)
+	}
+	if state := callback.Query().Get("state"); state != req.State {
+		e.t.Fatalf("authorize: state %q, want %q", state, req.State)
+	}
+	return callback.Query().Get("code")
+}
+
+// signIn runs a whole sign-in and returns the outcome of Exchange.
+func (e *testEnv) signIn(fresh bool) (*Claims, error) {
+	e.t.Helper()
+	start := e.provider.AuthCodeURL
+	if fresh {
+		start = e.provider.ReauthCodeURL
+	}
+	req, err := start(context.Background())
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	code := e.authorize(req)
+	return e.provider.Exchange(context.Background(), req, code)
+}
+
+func TestSignIn(t *testing.T) {
+	e := newTestEnv(t)
+	claims, err := e.signIn(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Subject != "alice-1" || claims.Email != "alice@example.com" || !claims.EmailVerified {
+		t.Fatalf("claims = %+v", claims)
+	}
+}
+
+func TestReauthAsksForAFreshSignIn(t *testing.T) {
+	e := newTestEnv(t)
+	req, err := e.provider.ReauthCodeURL(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	query, _ := url.ParseQuery(req.URL[strings.Index(req.URL, "?")+1:])
+	if query.Get("prompt") != "login" || query.Get("max_age") != "0" {
+		t.Fatalf("reauth URL %s does not ask for a fresh sign-in", req.URL)
+	}
+	if _, err := e.provider.Exchange(context.Background(), req, e.authorize(req)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRejectedIDTokens(t *testing.T) {
+	tests := []struct {
+		name   string
+		fresh  bool
+		claims func(claims map[string]interface{})
+		tamper func(idToken string) string
+		want   string
+	}{
+		{
+			name: "bad signature",
+			tamper: func(idToken string) string {
+				// Keep the provider's signature, but claim to be someone
+				// else.
+				parts := strings.Split(idToken, ".")
+				data, _ := base64.RawURLEncoding.DecodeString(parts[1])
+				var claims map[string]interface{}
+				json.Unmarshal(data, &claims)
+				claims["sub"] = "mallory-1"
+				data, _ = json.Marshal(claims)
+				return parts[0] + "." + base64.RawURLEncoding.EncodeToString(data) + "." + parts[2]
+			},
+			want: "invalid ID token signature",
+		},
+		{
+			name: "unsigned",
+			tamper: func(idToken string) string {
+				parts := strings.Split(idToken, ".")
+				return parts[0] + "." + parts[1] + "."
+			},
+			want: "invalid ID token signature",
+		},
+		{
+			name:   "wrong issuer",
+			claims: func(c map[string]interface{}) { c["iss"] = "https://evil.example.com" },
+			want:   "ID token from issuer",
+		},
+		{
+			name:   "wrong audience",
+			claims: func(c map[string]interface{}) { c["aud"] = "someone-else" },
+			want:   "not for this client",
+		},
+		{
+			name: "several audiences without azp",
+			claims: func(c map[string]interface{}) {
+				c["aud"] = []string{"camagru", "someone-else"}
+			},
+			want: "not for this client",
+		},
+		{
+			name:   "expired",
+			claims: func(c map[string]interface{}) { c["exp"] = time.Now().Add(-time.Hour).Unix() },
+			want:   "ID token expired",
+		},
+		{
+			name:   "issued in the future",
+			claims: func(c map[string]interface{}) { c["iat"] = time.Now().Add(time.Hour).Unix() },
+			want:   "issued in the future",
+		},
+		{
+			name:   "nonce mismatch",
+			claims: func(c map[string]interface{}) { c["nonce"] = "replayed" },
+			want:   "nonce mismatch",
+		},
+		{
+			name:   "stale sign-in on reauth",
+			fresh:  true,
+			claims: func(c map[string]interface{}) { c["auth_time"] = time.Now().Add(-time.Hour).Unix() },
+			want:   "fresh sign-in",
+		},
+		{
+			name:   "no subject",
+			claims: func(c map[string]interface{}) { c["sub"] = "" },
+			want:   "no subject",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := newTestEnv(t)
+			e.idp.EditClaims = test.claims
+			e.tamper = test.tamper
+			claims, err := e.signIn(test.fresh)
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Fatalf("got %+v, %v; want error containing %q", claims, err, test.want)
+			}
+		})
+	}
+}
+
+func TestStaleSignInIsFineWithoutReauth(t *testing.T) {
+	e := newTestEnv(t)
+	e.idp.EditClaims = func(c map[string]interface{}) {
+		c["auth_time"] = time.Now().Add(-time.Hour).Unix()
+	}
+	if _, err := e.signIn(false); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPKCEMismatch(t *testing.T) {
+	e := newTestEnv(t)
+	req, err := e.provider.AuthCodeURL(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := e.authorize(req)
+
+	// A code intercepted on its way back is useless without the verifier.
+	stolen := *req
+	stolen.Verifier = "attacker-" + req.Verifier
+	if _, err := e.provider.Exchange(context.Background(), &stolen, code); err == nil ||
+		!strings.Contains(err.Error(), "invalid_grant") {
+		t.Fatalf("wrong verifier: %v", err)
+	}
+	// And a code can only be redeemed once.
+	if _, err := e.provider.Exchange(context.Background(), req, code); err == nil {
+		t.Fatal("code redeemed twice")
+	}
+}
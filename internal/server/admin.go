@@ -0,0 +1,297 @@
+package server
+
+import (
+	"camagru/internal/models"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// roleRank orders roles by privilege. Accounts created before roles existed
+// have an empty role and count as users.
+var roleRank = map[string]int{
+	"":                   0,
+	models.RoleUser:      0,
+	models.RoleModerator: 1,
+	models.RoleAdmin:     2,
+}
+
+func hasRole(user *models.User, role string) bool {
+	return roleRank[user.Role] >= roleRank[role]
+}
+
+// RequireRole is RequireAuth for routes that also need the user to hold at
+// least the given role.
+func (s *Server) RequireRole(role string, next http.HandlerFunc, scopes ...string) http.HandlerFunc {
+	return s.RequireAuth(func(w http.ResponseWriter, r *http.Request) {
+		user, err := s.GetCurrentUser(r)
+		if err != nil || !hasRole(user, role) {
+			s.SendJSON(w, http.StatusForbidden, models.APIResponse{
+				Success: false,
+				Message: "Insufficient permissions",
+			})
+			return
+		}
+		next(w, r)
+	}, scopes...)
+}
+
+type adminUser struct {
+	ID        int       `json:"id"`
+	Username  string    `json:"username"`
+	Email     string    `json:"email"`
+	Role      string    `json:"role"`
+	Verified  bool      `json:"verified"`
+	Suspended bool      `json:"suspended"`
+	TwoFactor bool      `json:"two_factor"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func (s *Server) HandleAdminUsers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	page, _ := strconv.Atoi(query.Get("page"))
+	if page < 1 {
+		page = 1
+	}
+	limit := pageLimit(r, 20)
+
+	users, total, err := s.DB.ListUsers(strings.TrimSpace(query.Get("q")), page, limit)
+	if err != nil {
+		s.SendJSON(w, http.StatusInternalServerError, models.APIResponse{
+			Success: false,
+			Message: "Failed to load users",
+		})
+		return
+	}
+
+	items := make([]adminUser, 0, len(users))
+	for _, user := range users {
+		role := user.Role
+		if role == "" {
+			role = models.RoleUser
+		}
+		items = append(items, adminUser{
+			ID:        user.ID,
+			Username:  user.Username,
+			Email:     user.Email,
+			Role:      role,
+			Verified:  user.Verified,
+			Suspended: user.Suspended,
+			TwoFactor: user.TOTPSecret != "",
+			CreatedAt: user.CreatedAt,
+		})
+	}
+
+	s.SendJSON(w, http.StatusOK, models.APIResponse{
+		Success: true,
+		Data: map[string]interface{}{
+			"items":       items,
+			"total":       total,
+			"currentPage": page,
+			"hasMore":     (page-1)*limit+len(items) < total,
+		},
+	})
+}
+
+// adminTarget reads the user_id form field for the account-management
+// endpoints, refusing the caller's own account so that an admin cannot lock
+// themselves out.
+func (s *Server) adminTarget(w http.ResponseWriter, r *http.Request) (*models.User, bool) {
+	admin, err := s.GetCurrentUser(r)
+	if err != nil {
+		s.SendJSON(w, http.StatusUnauthorized, models.APIResponse{
+			Success: false,
+			Message: "Authentication required",
+		})
+		return nil, false
+	}
+
+	userID, _ := strconv.Atoi(r.FormValue("user_id"))
+	user, err := s.DB.GetUserByID(userID)
+	if err != nil {
+		s.SendJSON(w, http.StatusNotFound, models.APIResponse{
+			Success: false,
+			Message: "User not found",
+		})
+		return nil, false
+	}
+	if user.ID == admin.ID {
+		s.SendJSON(w, http.StatusBadRequest, models.APIResponse{
+			Success: false,
+			Message: "You cannot change your own account here",
+		})
+		return nil, false
+	}
+	return user, true
+}
+
+func (s *Server) HandleAdminVerifyUser(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, ok := s.adminTarget(w, r)
+	if !ok {
+		return
+	}
+
+	if err := s.DB.MarkUserVerified(user.ID); err != nil {
+		s.SendJSON(w, http.StatusInternalServerError, models.APIResponse{
+			Success: false,
+			Message: "Failed to verify user",
+		})
+		return
+	}
+
+	s.SendJSON(w, http.StatusOK, models.APIResponse{
+		Success: true,
+		Message: "User verified",
+	})
+}
+
+func (s *Server) HandleAdminSuspendUser(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, ok := s.adminTarget(w, r)
+	if !ok {
+		return
+	}
+
+	suspended := r.FormValue("suspended") != "false"
+	if err := s.DB.SetUserSuspended(user.ID, suspended); err != nil {
+		s.SendJSON(w, http.StatusInternalServerError, models.APIResponse{
+			Success: false,
+			Message: "Failed to update user",
+		})
+		return
+	}
+	if suspended {
+		s.challenges.dropUser(user.ID)
+	}
+
+	message := "User reinstated"
+	if suspended {
+		message = "User suspended"
+	}
+	s.SendJSON(w, http.StatusOK, models.APIResponse{
+		Success: true,
+		Message: message,
+	})
+}
+
+func (s *Server) HandleAdminSetRole(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, ok := s.adminTarget(w, r)
+	if !ok {
+		return
+	}
+
+	role := r.FormValue("role")
+	if role != models.RoleUser && role != models.RoleModerator && role != models.RoleAdmin {
+		s.SendJSON(w, http.StatusBadRequest, models.APIResponse{
+			Success: false,
+			Message: "Role must be user, moderator or admin",
+		})
+		return
+	}
+
+	if err := s.DB.SetUserRole(user.ID, role); err != nil {
+		s.SendJSON(w, http.StatusInternalServerError, models.APIResponse{
+			Success: false,
+			Message: "Failed to update user",
+		})
+		return
+	}
+
+	s.SendJSON(w, http.StatusOK, models.APIResponse{
+		Success: true,
+		Message: "Role updated",
+	})
+}
+
+func (s *Server) HandleAdminDeleteImage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	imageID, _ := strconv.Atoi(r.FormValue("image_id"))
+	img, err := s.DB.GetImageByID(imageID)
+	if err != nil {
+		s.SendJSON(w, http.StatusNotFound, models.APIResponse{
+			Success: false,
+			Message: "Image not found",
+		})
+		return
+	}
+
+	if err := s.DB.DeleteImage(img.ID); err != nil {
+		s.SendJSON(w, http.StatusInternalServerError, models.APIResponse{
+			Success: false,
+			Message: "Failed to delete image",
+		})
+		return
+	}
+	s.deleteImageBlob(img.Path)
+
+	s.SendJSON(w, http.StatusOK, models.APIResponse{
+		Success: true,
+		Message: "Image deleted",
+	})
+}
+
+func (s *Server) HandleAdminDeleteComment(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	commentID, _ := strconv.Atoi(r.FormValue("comment_id"))
+	if err := s.DB.DeleteComment(commentID); err != nil {
+		s.SendJSON(w, http.StatusNotFound, models.APIResponse{
+			Success: false,
+			Message: "Comment not found",
+		})
+		return
+	}
+
+	s.SendJSON(w, http.StatusOK, models.APIResponse{
+		Success: true,
+		Message: "Comment deleted",
+	})
+}
+
+func (s *Server) HandleAdminStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	stats, err := s.DB.GetStats()
+	if err != nil {
+		s.SendJSON(w, http.StatusInternalServerError, models.APIResponse{
+			Success: false,
+			Message: "Failed to load statistics",
+		})
+		return
+	}
+
+	s.SendJSON(w, http.StatusOK, models.APIResponse{
+		Success: true,
+		Data:    stats,
+	})
+}
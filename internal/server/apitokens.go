@@ -0,0 +1,262 @@
+package server
+
+import (
+	"camagru/internal/auth"
+	"camagru/internal/models"
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Scopes a personal access token can be granted. Routes that accept tokens
+// name the scope they need in RequireAuth; every other route only accepts
+// the session cookie.
+const (
+	scopeRead         = "read"
+	scopeCompose      = "compose"
+	scopeGalleryWrite = "gallery:write"
+)
+
+var tokenScopes = []string{scopeRead, scopeCompose, scopeGalleryWrite}
+
+const (
+	// apiTokenPrefix marks personal access tokens so that they are easy to
+	// recognise, for example by secret scanners.
+	apiTokenPrefix  = "cmg_"
+	maxAPITokenName = 64
+	maxAPITokenDays = 365
+)
+
+var (
+	errInvalidAPIToken = errors.New("invalid or expired API token")
+	errMissingScope    = errors.New("API token lacks the required scope")
+)
+
+type contextKey int
+
+// userContextKey carries the user RequireAuth authenticated with an API
+// token, for GetCurrentUser to find.
+const userContextKey contextKey = iota
+
+func bearerToken(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return "", false
+	}
+	return strings.TrimSpace(strings.TrimPrefix(header, "Bearer ")), true
+}
+
+// apiTokenUser resolves a bearer token to its user, provided the token has
+// one of scopes.
+func (s *Server) apiTokenUser(token string, scopes []string) (*models.User, error) {
+	apiToken, err := s.DB.GetAPITokenByToken(token)
+	if err != nil {
+		return nil, errInvalidAPIToken
+	}
+	now := time.Now()
+	if apiToken.ExpiresAt != nil && now.After(*apiToken.ExpiresAt) {
+		return nil, errInvalidAPIToken
+	}
+
+	granted := false
+	for _, scope := range scopes {
+		for _, have := range apiToken.Scopes {
+			if have == scope {
+				granted = true
+			}
+		}
+	}
+	if !granted {
+		return nil, errMissingScope
+	}
+
+	user, err := s.DB.GetUserByID(apiToken.UserID)
+	if err != nil || !user.Verified || user.Suspended {
+		return nil, errInvalidAPIToken
+	}
+
+	if apiToken.LastUsed == nil || now.Sub(*apiToken.LastUsed) > sessionTouchInterval {
+		s.DB.TouchAPIToken(apiToken.ID, now)
+	}
+	return user, nil
+}
+
+// requireAPIToken authenticates a request that carries a bearer token and
+// passes it on with the token's user attached.
+func (s *Server) requireAPIToken(w http.ResponseWriter, r *http.Request, token string, scopes []string, next http.HandlerFunc) {
+	if len(scopes) == 0 {
+		s.SendJSON(w, http.StatusForbidden, models.APIResponse{
+			Success: false,
+			Message: "API tokens cannot be used here",
+		})
+		return
+	}
+
+	user, err := s.apiTokenUser(token, scopes)
+	if errors.Is(err, errMissingScope) {
+		s.SendJSON(w, http.StatusForbidden, models.APIResponse{
+			Success: false,
+			Message: "API token lacks the required scope",
+		})
+		return
+	}
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		s.SendJSON(w, http.StatusUnauthorized, models.APIResponse{
+			Success: false,
+			Message: "Invalid or expired API token",
+		})
+		return
+	}
+	next(w, r.WithContext(context.WithValue(r.Context(), userContextKey, user)))
+}
+
+func (s *Server) HandleAPITokens(w http.ResponseWriter, r *http.Request) {
+	user, err := s.GetCurrentUser(r)
+	if err != nil {
+		s.SendJSON(w, http.StatusUnauthorized, models.APIResponse{
+			Success: false,
+			Message: "Authentication required",
+		})
+		return
+	}
+
+	if r.Method == "GET" {
+		tokens, err := s.DB.GetUserAPITokens(user.ID)
+		if err != nil {
+			s.SendJSON(w, http.StatusInternalServerError, models.APIResponse{
+				Success: false,
+				Message: "Failed to load API tokens",
+			})
+			return
+		}
+		s.SendJSON(w, http.StatusOK, models.APIResponse{
+			Success: true,
+			Data:    tokens,
+		})
+		return
+	}
+
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" || len(name) > maxAPITokenName {
+		s.SendJSON(w, http.StatusBadRequest, models.APIResponse{
+			Success: false,
+			Message: "Token name must be 1 to 64 characters",
+		})
+		return
+	}
+
+	r.ParseForm()
+	var scopes []string
+	for _, value := range r.Form["scopes"] {
+		for _, scope := range strings.Split(value, ",") {
+			scope = strings.TrimSpace(scope)
+			if scope == "" {
+				continue
+			}
+			known := false
+			for _, candidate := range tokenScopes {
+				if scope == candidate {
+					known = true
+				}
+			}
+			if !known {
+				s.SendJSON(w, http.StatusBadRequest, models.APIResponse{
+					Success: false,
+					Message: "Unknown scope: " + scope,
+				})
+				return
+			}
+			scopes = append(scopes, scope)
+		}
+	}
+	if len(scopes) == 0 {
+		s.SendJSON(w, http.StatusBadRequest, models.APIResponse{
+			Success: false,
+			Message: "Choose at least one scope",
+		})
+		return
+	}
+
+	var expiresAt *time.Time
+	if value := r.FormValue("expires_in_days"); value != "" {
+		days, err := strconv.Atoi(value)
+		if err != nil || days < 1 || days > maxAPITokenDays {
+			s.SendJSON(w, http.StatusBadRequest, models.APIResponse{
+				Success: false,
+				Message: "Expiry must be between 1 and 365 days",
+			})
+			return
+		}
+		expires := time.Now().Add(time.Duration(days) * 24 * time.Hour)
+		expiresAt = &expires
+	}
+
+	secret, err := auth.GenerateToken()
+	if err != nil {
+		s.SendJSON(w, http.StatusInternalServerError, models.APIResponse{
+			Success: false,
+			Message: "Failed to create API token",
+		})
+		return
+	}
+	token := apiTokenPrefix + secret
+	tokenID, err := s.DB.CreateAPIToken(user.ID, name, token, scopes, expiresAt)
+	if err != nil {
+		s.SendJSON(w, http.StatusInternalServerError, models.APIResponse{
+			Success: false,
+			Message: "Failed to create API token",
+		})
+		return
+	}
+
+	s.SendJSON(w, http.StatusOK, models.APIResponse{
+		Success: true,
+		Message: "API token created. Copy it now, it will not be shown again.",
+		Data: map[string]interface{}{
+			"id":        tokenID,
+			"token":     token,
+			"name":      name,
+			"scopes":    scopes,
+			"expiresAt": expiresAt,
+		},
+	})
+}
+
+func (s *Server) HandleRevokeAPIToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := s.GetCurrentUser(r)
+	if err != nil {
+		s.SendJSON(w, http.StatusUnauthorized, models.APIResponse{
+			Success: false,
+			Message: "Authentication required",
+		})
+		return
+	}
+
+	tokenID, _ := strconv.Atoi(r.FormValue("token_id"))
+	if err := s.DB.DeleteAPIToken(user.ID, tokenID); err != nil {
+		s.SendJSON(w, http.StatusNotFound, models.APIResponse{
+			Success: false,
+			Message: "API token not found",
+		})
+		return
+	}
+
+	s.SendJSON(w, http.StatusOK, models.APIResponse{
+		Success: true,
+		Message: "API token revoked",
+	})
+}
@@ -2,7 +2,9 @@ package server
 
 import (
 	"camagru/internal/auth"
+	"camagru/internal/database"
 	"camagru/internal/models"
+	"errors"
 	"fmt"
 	"net/http"
 	"regexp"
@@ -10,6 +12,14 @@ import (
 	"time"
 )
 
+const (
+	// verificationTTL is how long a verification link works.
+	verificationTTL = 24 * time.Hour
+	// verificationResendCooldown is how long after one verification email
+	// another can be requested.
+	verificationResendCooldown = 2 * time.Minute
+)
+
 func (s *Server) HandleLogin(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		return
@@ -28,52 +38,87 @@ func (s *Server) HandleLogin(w http.ResponseWriter, r *http.Request) {
 
 	user, err := s.DB.GetUserByUsernameOrEmail(username)
 	if err != nil {
-		s.SendJSON(w, http.StatusUnauthorized, models.APIResponse{
-			Success: false,
-			Message: "Invalid username/password combination, sorry! (🇨🇦)",
-		})
+		user = nil
+	}
+
+	limits := s.limits.get()
+	ip := clientIP(r)
+	account := accountKey(user, username)
+	if !s.checkLimits(w, limits.loginChecks(ip, account)) {
 		return
 	}
 
-	if !auth.CheckPassword(password, user.PasswordHash) {
+	var ok, outdated bool
+	if user != nil {
+		ok, outdated = auth.CheckPassword(password, user.PasswordHash)
+	}
+	if !ok {
+		s.recordLoginFailure(ip, account, user)
 		s.SendJSON(w, http.StatusUnauthorized, models.APIResponse{
 			Success: false,
 			Message: "Invalid username/password combination, sorry! (🇨🇦)",
 		})
 		return
 	}
+	if outdated {
+		if hash, err := auth.HashPassword(password); err == nil {
+			s.DB.RehashPassword(user.ID, user.PasswordHash, hash)
+		}
+	}
 
 	if !user.Verified {
 		s.SendJSON(w, http.StatusForbidden, models.APIResponse{
 			Success: false,
 			Message: "Account not verified. Please check your email.",
+			Data:    map[string]interface{}{"verification_required": true},
 		})
 		return
 	}
-	sessionToken, err := auth.GenerateToken()
-	if err != nil {
-		s.SendJSON(w, http.StatusInternalServerError, models.APIResponse{
+
+	if user.Suspended {
+		s.SendJSON(w, http.StatusForbidden, models.APIResponse{
 			Success: false,
-			Message: "Failed to create session",
+			Message: "This account has been suspended.",
+		})
+		return
+	}
+
+	if user.TOTPSecret == "" {
+		limits.loginSucceeded(ip, account)
+	}
+	s.finishLogin(w, r, user)
+}
+
+// finishLogin signs in a user who has proven who they are, or, if they have
+// two-factor authentication enabled, asks for their code first.
+func (s *Server) finishLogin(w http.ResponseWriter, r *http.Request, user *models.User) {
+	if user.TOTPSecret != "" {
+		token, err := s.challenges.start(user.ID)
+		if err != nil {
+			s.SendJSON(w, http.StatusInternalServerError, models.APIResponse{
+				Success: false,
+				Message: "Failed to create session",
+			})
+			return
+		}
+		s.SendJSON(w, http.StatusOK, models.APIResponse{
+			Success: true,
+			Message: "Enter the code from your authenticator app",
+			Data: map[string]interface{}{
+				"two_factor_required": true,
+				"token":               token,
+			},
 		})
 		return
 	}
 
-	if err := s.DB.UpdateUserSessionToken(user.ID, sessionToken); err != nil {
+	if err := s.startSession(w, r, user.ID); err != nil {
 		s.SendJSON(w, http.StatusInternalServerError, models.APIResponse{
 			Success: false,
 			Message: "Failed to create session",
 		})
 		return
 	}
-	http.SetCookie(w, &http.Cookie{
-		Name:     "session",
-		Value:    sessionToken,
-		Path:     "/",
-		HttpOnly: true,
-		SameSite: http.SameSiteStrictMode,
-		MaxAge:   86400 * 7,
-	})
 
 	s.SendJSON(w, http.StatusOK, models.APIResponse{
 		Success: true,
@@ -86,6 +131,24 @@ func (s *Server) HandleRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	inviteCode := strings.TrimSpace(r.FormValue("invite"))
+	switch s.Registration {
+	case RegistrationClosed:
+		s.SendJSON(w, http.StatusForbidden, models.APIResponse{
+			Success: false,
+			Message: "Registration is closed",
+		})
+		return
+	case RegistrationInvite:
+		if inviteCode == "" {
+			s.SendJSON(w, http.StatusForbidden, models.APIResponse{
+				Success: false,
+				Message: "An invite code is required to register",
+			})
+			return
+		}
+	}
+
 	username := strings.TrimSpace(r.FormValue("username"))
 	email := strings.TrimSpace(r.FormValue("email"))
 	password := r.FormValue("password")
@@ -137,6 +200,13 @@ func (s *Server) HandleRegister(w http.ResponseWriter, r *http.Request) {
 		})
 		return
 	}
+	if !s.emailDomainAllowed(email) {
+		s.SendJSON(w, http.StatusBadRequest, models.APIResponse{
+			Success: false,
+			Message: "Email addresses at that domain are not allowed",
+		})
+		return
+	}
 	if password == "" {
 		s.SendJSON(w, http.StatusBadRequest, models.APIResponse{
 			Success: false,
@@ -215,7 +285,18 @@ func (s *Server) HandleRegister(w http.ResponseWriter, r *http.Request) {
 		})
 		return
 	}
-	_, err = s.DB.CreateUser(username, email, passwordHash, verificationToken)
+	if s.Registration == RegistrationInvite {
+		_, err = s.DB.CreateInvitedUser(username, email, passwordHash, verificationToken, time.Now().Add(verificationTTL), inviteCode)
+	} else {
+		_, err = s.DB.CreateUser(username, email, passwordHash, verificationToken, time.Now().Add(verificationTTL))
+	}
+	if errors.Is(err, database.ErrInvalidInvite) {
+		s.SendJSON(w, http.StatusBadRequest, models.APIResponse{
+			Success: false,
+			Message: "Invalid or expired invite code",
+		})
+		return
+	}
 	if err != nil {
 		s.SendJSON(w, http.StatusInternalServerError, models.APIResponse{
 			Success: false,
@@ -233,18 +314,19 @@ func (s *Server) HandleRegister(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) HandleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
 	cookie, err := r.Cookie("session")
 	if err == nil {
-		s.DB.ClearUserSessionToken(cookie.Value)
+		if session, err := s.DB.GetSessionByToken(cookie.Value); err == nil {
+			s.DB.DeleteSession(session.ID)
+		}
 	}
 
-	http.SetCookie(w, &http.Cookie{
-		Name:     "session",
-		Value:    "",
-		Path:     "/",
-		HttpOnly: true,
-		MaxAge:   -1,
-	})
+	clearSessionCookie(w)
 
 	http.Redirect(w, r, "/gallery", http.StatusFound)
 }
@@ -257,6 +339,10 @@ func (s *Server) HandleVerify(w http.ResponseWriter, r *http.Request) {
 	}
 
 	err := s.DB.VerifyUser(token)
+	if err == database.ErrVerificationExpired {
+		http.Redirect(w, r, "/login?verification_expired=1", http.StatusFound)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Invalid verification token", http.StatusBadRequest)
 		return
@@ -293,6 +379,19 @@ func (s *Server) HandleForgotPassword(w http.ResponseWriter, r *http.Request) {
 
 	user, err := s.DB.GetUserByUsernameOrEmail(email)
 	if err != nil {
+		user = nil
+	}
+
+	limits := s.limits.get()
+	ip := clientIP(r)
+	account := accountKey(user, email)
+	if !s.checkLimits(w, map[*auth.Limiter]string{limits.mailIP: ip, limits.mailAccount: account}) {
+		return
+	}
+	limits.mailIP.Record(ip)
+	limits.mailAccount.Record(account)
+
+	if user == nil {
 		s.SendJSON(w, http.StatusOK, models.APIResponse{
 			Success: true,
 			Message: "If the email exists, a password reset link has been sent.",
@@ -359,15 +458,13 @@ func (s *Server) HandleResetPassword(w http.ResponseWriter, r *http.Request) {
 		})
 		return
 	}
-	user, err := s.DB.GetUserByResetToken(token)
-	if err != nil {
+	if _, err := s.DB.GetUserByResetToken(token); err != nil {
 		s.SendJSON(w, http.StatusBadRequest, models.APIResponse{
 			Success: false,
 			Message: "Invalid or expired reset token",
 		})
 		return
 	}
-	userID := user.ID
 	passwordHash, err := auth.HashPassword(password)
 	if err != nil {
 		s.SendJSON(w, http.StatusInternalServerError, models.APIResponse{
@@ -376,15 +473,18 @@ func (s *Server) HandleResetPassword(w http.ResponseWriter, r *http.Request) {
 		})
 		return
 	}
-	err = s.DB.UpdateUserPassword(userID, passwordHash)
-
+	// ResetPassword checks the token again and consumes it in the same
+	// change, so two requests racing with one link cannot both succeed.
+	user, err := s.DB.ResetPassword(token, passwordHash)
 	if err != nil {
-		s.SendJSON(w, http.StatusInternalServerError, models.APIResponse{
+		s.SendJSON(w, http.StatusBadRequest, models.APIResponse{
 			Success: false,
-			Message: "Failed to reset password",
+			Message: "Invalid or expired reset token",
 		})
 		return
 	}
+	s.challenges.dropUser(user.ID)
+	go s.SendPasswordChangedEmail(user.Email, user.Username)
 
 	s.SendJSON(w, http.StatusOK, models.APIResponse{
 		Success: true,
@@ -401,30 +501,47 @@ func (s *Server) HandleResendVerification(w http.ResponseWriter, r *http.Request
 
 	user, err := s.DB.GetUserByUsernameOrEmail(username)
 	if err != nil {
-		s.SendJSON(w, http.StatusOK, models.APIResponse{
-			Success: true,
-			Message: "If the account exists, a verification email has been sent.",
-		})
+		user = nil
+	}
+
+	limits := s.limits.get()
+	ip := clientIP(r)
+	account := accountKey(user, username)
+	if !s.checkLimits(w, map[*auth.Limiter]string{limits.mailIP: ip, limits.mailAccount: account}) {
 		return
 	}
+	limits.mailIP.Record(ip)
+	limits.mailAccount.Record(account)
 
-	if user.VerificationToken == "" {
-		s.SendJSON(w, http.StatusBadRequest, models.APIResponse{
+	// Unknown, already verified and recently emailed accounts all get the
+	// same answer, so that this cannot be used to probe for accounts.
+	sent := models.APIResponse{
+		Success: true,
+		Message: "If the account exists and is not verified yet, a verification email has been sent.",
+	}
+	if user == nil || user.Verified {
+		s.SendJSON(w, http.StatusOK, sent)
+		return
+	}
+	if user.VerificationSentAt != nil && time.Since(*user.VerificationSentAt) < verificationResendCooldown {
+		s.SendJSON(w, http.StatusOK, sent)
+		return
+	}
+
+	token, err := auth.GenerateToken()
+	if err == nil {
+		err = s.DB.SetVerificationToken(user.ID, token, time.Now().Add(verificationTTL))
+	}
+	if err != nil {
+		s.SendJSON(w, http.StatusInternalServerError, models.APIResponse{
 			Success: false,
-			Message: "Account already verified",
+			Message: "Failed to send verification email",
 		})
 		return
 	}
 
-	email := user.Email
-	usernameVal := user.Username
-	token := user.VerificationToken
-
 	verificationURL := fmt.Sprintf("http://localhost:8080/verify?token=%s", token)
-	go s.SendVerificationEmail(email, usernameVal, verificationURL)
+	go s.SendVerificationEmail(user.Email, user.Username, verificationURL)
 
-	s.SendJSON(w, http.StatusOK, models.APIResponse{
-		Success: true,
-		Message: "Verification email sent. Please check your inbox.",
-	})
+	s.SendJSON(w, http.StatusOK, sent)
 }
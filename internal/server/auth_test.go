@@ -0,0 +1,126 @@
+package server
+
+import (
+	"camagru/internal/auth"
+	"camagru/internal/database"
+	"camagru/internal/models"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// usePasswordConfig switches password hashing to config for the rest of
+// the test.
+func usePasswordConfig(t *testing.T, config auth.PasswordConfig) {
+	t.Helper()
+	if err := auth.SetPasswordConfig(config); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { auth.SetPasswordConfig(auth.DefaultPasswordConfig) })
+}
+
+func TestLoginRehashesOutdatedPasswords(t *testing.T) {
+	t.Setenv("LOCKOUT_EMAIL", "false")
+	config := auth.DefaultPasswordConfig
+	config.Argon2Memory = 1024
+	config.Argon2Time = 1
+	usePasswordConfig(t, config)
+
+	db := database.NewMemoryStorage()
+	db.InitDB()
+	s := &Server{DB: db}
+	userID, _ := passwordSession(t, s, db, "alice", "correct horse")
+	user, _ := db.GetUserByID(userID)
+	old := user.PasswordHash
+
+	config.Argon2Memory = 2048
+	usePasswordConfig(t, config)
+
+	form := url.Values{"username": {"alice"}, "password": {"wrong"}}
+	postForm(s.HandleLogin, form)
+	if user, _ := db.GetUserByID(userID); user.PasswordHash != old {
+		t.Fatal("a failed login rehashed the password")
+	}
+
+	form.Set("password", "correct horse")
+	if code, resp := postForm(s.HandleLogin, form); code != http.StatusOK {
+		t.Fatalf("login: %d %+v", code, resp)
+	}
+	user, _ = db.GetUserByID(userID)
+	if user.PasswordHash == old || !strings.Contains(user.PasswordHash, "m=2048") {
+		t.Fatalf("hash not upgraded: %s", user.PasswordHash)
+	}
+	if ok, outdated := auth.CheckPassword("correct horse", user.PasswordHash); !ok || outdated {
+		t.Fatalf("new hash: CheckPassword = %v, %v", ok, outdated)
+	}
+}
+
+func TestLoginBacksOff(t *testing.T) {
+	t.Setenv("LOCKOUT_EMAIL", "false")
+	config := auth.DefaultPasswordConfig
+	config.Argon2Memory = 1024
+	config.Argon2Time = 1
+	usePasswordConfig(t, config)
+
+	db := database.NewMemoryStorage()
+	db.InitDB()
+	s := &Server{DB: db}
+	passwordSession(t, s, db, "alice", "correct horse")
+
+	// The account gets five free attempts; the sixth failure starts the
+	// backoff.
+	form := url.Values{"username": {"alice"}, "password": {"wrong"}}
+	for i := 1; i <= 6; i++ {
+		if code, _ := postForm(s.HandleLogin, form); code != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: status %d", i, code)
+		}
+	}
+
+	// Even the right password has to wait.
+	form.Set("password", "correct horse")
+	if code, resp := postForm(s.HandleLogin, form); code != http.StatusTooManyRequests {
+		t.Fatalf("during backoff: %d %+v", code, resp)
+	}
+	// Names that match no account are throttled the same way.
+	form.Set("username", "nobody")
+	for i := 1; i <= 6; i++ {
+		postForm(s.HandleLogin, form)
+	}
+	if code, _ := postForm(s.HandleLogin, form); code != http.StatusTooManyRequests {
+		t.Fatalf("unknown account: status %d", code)
+	}
+}
+
+func TestLoginLockoutIsPerAddress(t *testing.T) {
+	t.Setenv("LOCKOUT_EMAIL", "false")
+	s := &Server{}
+	limits := s.limits.get()
+	user := &models.User{ID: 1, Username: "alice"}
+	account := accountKey(user, "alice")
+
+	for i := 0; i < 10; i++ {
+		s.recordLoginFailure("192.0.2.1", account, user)
+	}
+
+	// The address that made the failures is locked out...
+	wait := longestWait(limits.loginChecks("192.0.2.1", account))
+	if wait <= time.Minute || wait > loginLockout {
+		t.Fatalf("from the guessing address: wait %v, want the lockout", wait)
+	}
+	// ...but the owner elsewhere only waits out the account's backoff.
+	if wait := longestWait(limits.loginChecks("198.51.100.7", account)); wait > time.Minute {
+		t.Fatalf("from another address: wait %v", wait)
+	}
+}
+
+func longestWait(checks map[*auth.Limiter]string) time.Duration {
+	var longest time.Duration
+	for limiter, key := range checks {
+		if wait, ok := limiter.Check(key); !ok && wait > longest {
+			longest = wait
+		}
+	}
+	return longest
+}
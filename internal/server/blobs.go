@@ -0,0 +1,91 @@
+package server
+
+import (
+	"camagru/internal/blob"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const uploadsURLPrefix = "/static/uploads/"
+
+// blobKey extracts the blob key from an image path as stored in the
+// database.
+func blobKey(path string) (string, bool) {
+	key, ok := strings.CutPrefix(path, uploadsURLPrefix)
+	return key, ok && key != ""
+}
+
+// HandleUpload serves a stored image from the blob store.
+func (s *Server) HandleUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	key, ok := blobKey(r.URL.Path)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	data, contentType, err := s.Blobs.Get(key)
+	if errors.Is(err, blob.ErrNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to load image", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	if r.Method == "GET" {
+		w.Write(data)
+	}
+}
+
+// saveImage stores data as an image of userID and returns its path. It holds
+// blobsMu from storing the blob until the image record refers to it, so
+// deleteImageBlob cannot see the blob unused in between and remove it.
+func (s *Server) saveImage(userID int, data []byte, contentType string) (string, error) {
+	s.blobsMu.Lock()
+	defer s.blobsMu.Unlock()
+
+	key, err := s.Blobs.Put(data, contentType)
+	if err != nil {
+		return "", err
+	}
+	path := s.Blobs.URL(key)
+	if _, err := s.DB.CreateImage(userID, path); err != nil {
+		s.deleteUnusedBlob(path)
+		return "", err
+	}
+	return path, nil
+}
+
+// deleteImageBlob removes the blob behind an image path once no image
+// record refers to it any more. Blobs are content-addressed, so two images
+// with identical content share one.
+func (s *Server) deleteImageBlob(path string) {
+	s.blobsMu.Lock()
+	defer s.blobsMu.Unlock()
+	s.deleteUnusedBlob(path)
+}
+
+// deleteUnusedBlob is deleteImageBlob for callers holding blobsMu.
+func (s *Server) deleteUnusedBlob(path string) {
+	key, ok := blobKey(path)
+	if !ok {
+		return
+	}
+	if inUse, err := s.DB.ImagePathInUse(path); err != nil || inUse {
+		return
+	}
+	if err := s.Blobs.Delete(key); err != nil {
+		fmt.Printf("Failed to delete blob %s: %v\n", key, err)
+	}
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"camagru/internal/blob"
+	"camagru/internal/database"
+	"testing"
+	"time"
+)
+
+// pausingStore calls afterPut, when set, between storing a blob and
+// returning its key.
+type pausingStore struct {
+	blob.Store
+	afterPut func()
+}
+
+func (p *pausingStore) Put(data []byte, contentType string) (string, error) {
+	key, err := p.Store.Put(data, contentType)
+	if p.afterPut != nil {
+		p.afterPut()
+	}
+	return key, err
+}
+
+func TestDeletingABlobWhileItIsSavedAgain(t *testing.T) {
+	db := database.NewMemoryStorage()
+	db.InitDB()
+	local, err := blob.NewLocalStore(t.TempDir(), uploadsURLPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobs := &pausingStore{Store: local}
+	s := &Server{DB: db, Blobs: blobs}
+	userID, err := db.CreateUser("alice", "alice@example.com", "hash", "", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("the same picture")
+
+	path, err := s.saveImage(userID, data, "image/jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	images, _, _ := db.GetUserImages(userID, "", 1)
+	if err := db.DeleteImage(images[0].ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first image's blob is deleted just as the same content is saved
+	// again, after the blob is stored but before the new image refers to
+	// it.
+	deleted := make(chan bool)
+	blobs.afterPut = func() {
+		go func() {
+			s.deleteImageBlob(path)
+			close(deleted)
+		}()
+		time.Sleep(50 * time.Millisecond)
+	}
+	if _, err := s.saveImage(userID, data, "image/jpeg"); err != nil {
+		t.Fatal(err)
+	}
+	<-deleted
+
+	key, _ := blobKey(path)
+	if _, _, err := blobs.Get(key); err != nil {
+		t.Fatalf("the new image lost its blob: %v", err)
+	}
+}
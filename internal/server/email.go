@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net/smtp"
 	"os"
+	"time"
 )
 
 func (s *Server) SendVerificationEmail(to, username, url string) {
@@ -16,6 +17,8 @@ Thank you for registering with Camagru!
 Please verify your account by clicking the following link:
 %s
 
+This link will expire in 24 hours.
+
 If you did not create this account, please ignore this email.
 
 Best regards,
@@ -25,6 +28,26 @@ Camagru Team
 	s.SendEmail(to, subject, body)
 }
 
+func (s *Server) SendMagicLinkEmail(to, username, url string) {
+	subject := "Your Camagru sign-in link"
+	body := fmt.Sprintf(`
+Hello %s,
+
+Click the following link to sign in to Camagru:
+%s
+
+This link will expire in 15 minutes and can only be used once.
+
+If you did not request this, please ignore this email. You can turn off
+sign-in links in your profile settings.
+
+Best regards,
+Camagru Team
+`, username, url)
+
+	s.SendEmail(to, subject, body)
+}
+
 func (s *Server) SendPasswordResetEmail(to, username, url string) {
 	subject := "Reset your Camagru password"
 	body := fmt.Sprintf(`
@@ -44,6 +67,85 @@ Camagru Team
 	s.SendEmail(to, subject, body)
 }
 
+func (s *Server) SendEmailChangeConfirmation(to, username, url string) {
+	subject := "Confirm your new Camagru email address"
+	body := fmt.Sprintf(`
+Hello %s,
+
+You asked to use this address for your Camagru account. Confirm it by
+clicking the following link:
+%s
+
+This link will expire in 24 hours. Until then your old address stays in use.
+
+If you did not request this, please ignore this email.
+
+Best regards,
+Camagru Team
+`, username, url)
+
+	s.SendEmail(to, subject, body)
+}
+
+func (s *Server) SendEmailChangedNotice(to, username, newEmail, url string) {
+	subject := "Your Camagru email address was changed"
+	body := fmt.Sprintf(`
+Hello %s,
+
+The email address of your Camagru account was changed to %s.
+
+If you did not make this change, click the following link to restore this
+address and sign out every device:
+%s
+
+This link will expire in 7 days. If someone else made this change, also
+reset your password from the login page.
+
+Best regards,
+Camagru Team
+`, username, newEmail, url)
+
+	s.SendEmail(to, subject, body)
+}
+
+func (s *Server) SendPasswordChangedEmail(to, username string) {
+	subject := "Your Camagru password was changed"
+	body := fmt.Sprintf(`
+Hello %s,
+
+The password for your Camagru account was just changed. Every other
+device signed in to your account has been signed out, and your API tokens
+have been revoked.
+
+If you did not make this change, reset your password right away using
+"Forgot your password?" on the login page.
+
+Best regards,
+Camagru Team
+`, username)
+
+	s.SendEmail(to, subject, body)
+}
+
+func (s *Server) SendLockoutEmail(to, username string, lockout time.Duration) {
+	subject := "Your Camagru account has been locked"
+	body := fmt.Sprintf(`
+Hello %s,
+
+There were too many failed attempts to sign in to your account, so sign-in
+from the network they came from has been blocked for the next %d minutes.
+
+If this was you, wait and try again, or reset your password from the login
+page. If it was not you, someone may be trying to guess your password;
+consider changing it once you can sign in.
+
+Best regards,
+Camagru Team
+`, username, int(lockout.Minutes()))
+
+	s.SendEmail(to, subject, body)
+}
+
 func (s *Server) SendCommentNotification(to, author, comment string) {
 	subject := "New comment on your image"
 	body := fmt.Sprintf(`
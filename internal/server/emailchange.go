@@ -0,0 +1,63 @@
+package server
+
+import (
+	"camagru/internal/auth"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	// emailChangeTTL is how long the link confirming a new address works.
+	emailChangeTTL = 24 * time.Hour
+	// emailUndoTTL is how long the old address can take the account back.
+	emailUndoTTL = 7 * 24 * time.Hour
+)
+
+// HandleConfirmEmail completes an email change from the link sent to the new
+// address, and tells the old address how to undo it.
+func (s *Server) HandleConfirmEmail(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	undoToken, err := auth.GenerateToken()
+	if err != nil {
+		http.Error(w, "Failed to confirm email", http.StatusInternalServerError)
+		return
+	}
+	user, oldEmail, err := s.DB.ConfirmEmailChange(r.URL.Query().Get("token"), undoToken, time.Now().Add(emailUndoTTL))
+	if err != nil {
+		http.Error(w, "Invalid or expired confirmation link", http.StatusBadRequest)
+		return
+	}
+
+	undoURL := fmt.Sprintf("http://localhost:8080/undo-email?token=%s", undoToken)
+	go s.SendEmailChangedNotice(oldEmail, user.Username, user.Email, undoURL)
+
+	if current, err := s.GetCurrentUser(r); err == nil && current.ID == user.ID {
+		http.Redirect(w, r, "/user?email_changed=1", http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, "/login?email_changed=1", http.StatusFound)
+}
+
+// HandleUndoEmail restores the previous address from the link sent to it,
+// signing the account out everywhere.
+func (s *Server) HandleUndoEmail(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := s.DB.UndoEmailChange(r.URL.Query().Get("token"))
+	if err != nil {
+		http.Error(w, "Invalid or expired undo link", http.StatusBadRequest)
+		return
+	}
+	s.challenges.dropUser(user.ID)
+
+	clearSessionCookie(w)
+	http.Redirect(w, r, "/login?email_restored=1", http.StatusFound)
+}
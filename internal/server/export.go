@@ -0,0 +1,330 @@
+package server
+
+import (
+	"archive/zip"
+	"camagru/internal/auth"
+	"camagru/internal/blob"
+	"camagru/internal/models"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const exportTTL = 24 * time.Hour
+
+const (
+	exportPending = "pending"
+	exportReady   = "ready"
+	exportFailed  = "failed"
+)
+
+type exportJob struct {
+	userID  int
+	status  string
+	expires time.Time
+}
+
+// exportJobs tracks takeout archives by download token. Archives are built
+// in the background and deleted once they expire. The zero value is ready
+// to use.
+type exportJobs struct {
+	mu   sync.Mutex
+	jobs map[string]*exportJob
+}
+
+type exportProfile struct {
+	ID                   int       `json:"id"`
+	Username             string    `json:"username"`
+	Email                string    `json:"email"`
+	Verified             bool      `json:"verified"`
+	CommentNotifications bool      `json:"comment_notifications"`
+	TwoFactorEnabled     bool      `json:"two_factor_enabled"`
+	MagicLinks           bool      `json:"magic_links"`
+	CreatedAt            time.Time `json:"createdAt"`
+}
+
+func exportPath(dir, token string) string {
+	return filepath.Join(dir, token+".zip")
+}
+
+// purge drops expired jobs along with any archive in dir left behind by an
+// earlier run of the server. Callers hold e.mu.
+func (e *exportJobs) purge(dir string) {
+	now := time.Now()
+	for token, job := range e.jobs {
+		if now.After(job.expires) {
+			delete(e.jobs, token)
+			os.Remove(exportPath(dir, token))
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		token := strings.TrimSuffix(strings.TrimSuffix(entry.Name(), ".partial"), ".zip")
+		if _, exists := e.jobs[token]; exists {
+			continue
+		}
+		info, err := entry.Info()
+		if err == nil && now.Sub(info.ModTime()) > exportTTL {
+			os.Remove(filepath.Join(dir, entry.Name()))
+		}
+	}
+}
+
+func (e *exportJobs) lookup(dir, token string, userID int) (*exportJob, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.purge(dir)
+	job, exists := e.jobs[token]
+	if !exists || job.userID != userID {
+		return nil, false
+	}
+	copied := *job
+	return &copied, true
+}
+
+// setStatus records how a build went, and reports false if the job has
+// been dropped in the meantime.
+func (e *exportJobs) setStatus(token, status string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	job, exists := e.jobs[token]
+	if exists {
+		job.status = status
+	}
+	return exists
+}
+
+// dropUser forgets the user's exports and deletes their archives from dir,
+// for when the account is deleted. An archive still being built is deleted
+// once its build finds the job gone.
+func (e *exportJobs) dropUser(dir string, userID int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for token, job := range e.jobs {
+		if job.userID == userID {
+			delete(e.jobs, token)
+			os.Remove(exportPath(dir, token))
+		}
+	}
+}
+
+// PurgeExports deletes expired takeout archives. Requests for exports purge
+// them too, but an idle server needs calling this now and then.
+func (s *Server) PurgeExports() {
+	s.exports.mu.Lock()
+	defer s.exports.mu.Unlock()
+
+	s.exports.purge(s.ExportDir)
+}
+
+func (s *Server) HandleExport(w http.ResponseWriter, r *http.Request) {
+	user, err := s.GetCurrentUser(r)
+	if err != nil {
+		s.SendJSON(w, http.StatusUnauthorized, models.APIResponse{
+			Success: false,
+			Message: "Authentication required",
+		})
+		return
+	}
+
+	if r.Method == "GET" {
+		job, exists := s.exports.lookup(s.ExportDir, r.URL.Query().Get("token"), user.ID)
+		if !exists {
+			s.SendJSON(w, http.StatusNotFound, models.APIResponse{
+				Success: false,
+				Message: "Export not found or expired",
+			})
+			return
+		}
+		s.SendJSON(w, http.StatusOK, models.APIResponse{
+			Success: true,
+			Data: map[string]interface{}{
+				"status":     job.status,
+				"expires_at": job.expires,
+			},
+		})
+		return
+	}
+
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token, err := auth.GenerateToken()
+	if err != nil {
+		s.SendJSON(w, http.StatusInternalServerError, models.APIResponse{
+			Success: false,
+			Message: "Failed to start export",
+		})
+		return
+	}
+
+	s.exports.mu.Lock()
+	s.exports.purge(s.ExportDir)
+	for existing, job := range s.exports.jobs {
+		if job.userID == user.ID && job.status == exportPending {
+			s.exports.mu.Unlock()
+			s.SendJSON(w, http.StatusAccepted, models.APIResponse{
+				Success: true,
+				Message: "Export already in progress",
+				Data:    map[string]interface{}{"token": existing, "status": job.status, "expires_at": job.expires},
+			})
+			return
+		}
+	}
+	if s.exports.jobs == nil {
+		s.exports.jobs = make(map[string]*exportJob)
+	}
+	job := &exportJob{userID: user.ID, status: exportPending, expires: time.Now().Add(exportTTL)}
+	s.exports.jobs[token] = job
+	s.exports.mu.Unlock()
+
+	go func() {
+		if err := s.buildExport(user, exportPath(s.ExportDir, token)); err != nil {
+			fmt.Printf("Export for user %d failed: %v\n", user.ID, err)
+			s.exports.setStatus(token, exportFailed)
+			return
+		}
+		if !s.exports.setStatus(token, exportReady) {
+			// The account was deleted while the archive was built.
+			os.Remove(exportPath(s.ExportDir, token))
+		}
+	}()
+
+	s.SendJSON(w, http.StatusAccepted, models.APIResponse{
+		Success: true,
+		Message: "Export started",
+		Data:    map[string]interface{}{"token": token, "status": job.status, "expires_at": job.expires},
+	})
+}
+
+func (s *Server) HandleExportDownload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := s.GetCurrentUser(r)
+	if err != nil {
+		http.Error(w, "Authentication required", http.StatusUnauthorized)
+		return
+	}
+
+	token := r.URL.Query().Get("token")
+	job, exists := s.exports.lookup(s.ExportDir, token, user.ID)
+	if !exists {
+		http.Error(w, "Export not found or expired", http.StatusNotFound)
+		return
+	}
+	if job.status != exportReady {
+		http.Error(w, "Export is not ready", http.StatusConflict)
+		return
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="camagru-%s.zip"`, user.Username))
+	http.ServeFile(w, r, exportPath(s.ExportDir, token))
+}
+
+// buildExport writes the user's profile, activity and uploaded images to a
+// zip at path. The archive appears under its final name only once complete.
+func (s *Server) buildExport(user *models.User, path string) error {
+	activity, err := s.DB.GetUserActivity(user.ID)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	partial := path + ".partial"
+	f, err := os.Create(partial)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(partial)
+
+	zw := zip.NewWriter(f)
+	err = writeExport(zw, s.Blobs, user, activity)
+	if closeErr := zw.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(partial, path)
+}
+
+func writeExport(zw *zip.Writer, blobs blob.Store, user *models.User, activity *models.UserActivity) error {
+	documents := []struct {
+		name string
+		v    interface{}
+	}{
+		{"profile.json", exportProfile{
+			ID:                   user.ID,
+			Username:             user.Username,
+			Email:                user.Email,
+			Verified:             user.Verified,
+			CommentNotifications: user.CommentNotifications,
+			TwoFactorEnabled:     user.TOTPSecret != "",
+			MagicLinks:           !user.MagicLinkDisabled,
+			CreatedAt:            user.CreatedAt,
+		}},
+		{"images.json", activity.Images},
+		{"comments.json", activity.Comments},
+		{"likes_given.json", activity.LikesGiven},
+		{"comments_received.json", activity.CommentsReceived},
+		{"likes_received.json", activity.LikesReceived},
+	}
+	for _, doc := range documents {
+		data, err := json.MarshalIndent(doc.v, "", "  ")
+		if err != nil {
+			return err
+		}
+		out, err := zw.Create(doc.name)
+		if err != nil {
+			return err
+		}
+		if _, err := out.Write(data); err != nil {
+			return err
+		}
+	}
+
+	for _, img := range activity.Images {
+		key, ok := blobKey(img.Path)
+		if !ok {
+			continue
+		}
+		data, _, err := blobs.Get(key)
+		if errors.Is(err, blob.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		out, err := zw.Create("images/" + key)
+		if err != nil {
+			return err
+		}
+		if _, err := out.Write(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"camagru/internal/auth"
+	"camagru/internal/database"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDeleteAccountRemovesExports(t *testing.T) {
+	config := auth.DefaultPasswordConfig
+	config.Argon2Memory = 1024
+	config.Argon2Time = 1
+	usePasswordConfig(t, config)
+
+	db := database.NewMemoryStorage()
+	db.InitDB()
+	s := &Server{DB: db, ExportDir: t.TempDir()}
+	userID, session := passwordSession(t, s, db, "alice", "correct horse")
+
+	code, resp := postForm(s.HandleExport, nil, session)
+	if code != http.StatusAccepted {
+		t.Fatalf("export: %d %+v", code, resp)
+	}
+	token := resp.Data.(map[string]interface{})["token"].(string)
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if job, ok := s.exports.lookup(s.ExportDir, token, userID); ok && job.status == exportReady {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("export never finished")
+		}
+	}
+	if _, err := os.Stat(exportPath(s.ExportDir, token)); err != nil {
+		t.Fatal(err)
+	}
+
+	form := url.Values{"password": {"correct horse"}}
+	if code, resp := postForm(s.HandleDeleteAccount, form, session); code != http.StatusOK {
+		t.Fatalf("delete: %d %+v", code, resp)
+	}
+	if _, err := os.Stat(exportPath(s.ExportDir, token)); !os.IsNotExist(err) {
+		t.Fatalf("archive left behind: %v", err)
+	}
+	if _, exists := s.exports.lookup(s.ExportDir, token, userID); exists {
+		t.Fatal("export job left behind")
+	}
+}
+
+func TestPurgeExports(t *testing.T) {
+	s := &Server{ExportDir: t.TempDir()}
+	write := func(name string, age time.Duration) string {
+		path := filepath.Join(s.ExportDir, name)
+		if err := os.WriteFile(path, []byte("zip"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		modified := time.Now().Add(-age)
+		os.Chtimes(path, modified, modified)
+		return path
+	}
+
+	s.exports.jobs = map[string]*exportJob{
+		"expired": {userID: 1, status: exportReady, expires: time.Now().Add(-time.Minute)},
+		"current": {userID: 1, status: exportReady, expires: time.Now().Add(time.Hour)},
+	}
+	expired := write("expired.zip", time.Hour)
+	current := write("current.zip", time.Hour)
+	// Left behind by an earlier run of the server.
+	orphan := write("orphan.zip", exportTTL+time.Hour)
+	partial := write("crashed.zip.partial", exportTTL+time.Hour)
+	recent := write("recent.zip", time.Minute)
+
+	s.PurgeExports()
+
+	for _, path := range []string{expired, orphan, partial} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s not purged: %v", path, err)
+		}
+	}
+	for _, path := range []string{current, recent} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("%s purged: %v", path, err)
+		}
+	}
+	if _, exists := s.exports.jobs["expired"]; exists {
+		t.Fatal("expired job kept")
+	}
+}
@@ -2,11 +2,14 @@ package server
 
 import (
 	"camagru/internal/auth"
+	"camagru/internal/database"
 	"camagru/internal/models"
+	"errors"
+	"fmt"
 	"net/http"
-	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
 func (s *Server) HandleHome(w http.ResponseWriter, r *http.Request) {
@@ -76,6 +79,30 @@ func (s *Server) HandleUnauthorizedPage(w http.ResponseWriter, r *http.Request)
 	http.ServeFile(w, r, "./web/static/pages/unauthorized.html")
 }
 
+func (s *Server) HandleCSRFToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token, err := auth.CSRFToken(w, r)
+	if err != nil {
+		s.SendJSON(w, http.StatusInternalServerError, models.APIResponse{
+			Success: false,
+			Message: "Failed to create CSRF token",
+		})
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	s.SendJSON(w, http.StatusOK, models.APIResponse{
+		Success: true,
+		Data: map[string]interface{}{
+			"token": token,
+		},
+	})
+}
+
 func (s *Server) HandleCurrentUser(w http.ResponseWriter, r *http.Request) {
 	user, err := s.GetCurrentUser(r)
 	if err != nil {
@@ -88,9 +115,12 @@ func (s *Server) HandleCurrentUser(w http.ResponseWriter, r *http.Request) {
 	s.SendJSON(w, http.StatusOK, models.APIResponse{
 		Success: true,
 		Data: map[string]interface{}{
-			"username": user.Username,
-			"email":    user.Email,
-			"id":       user.ID,
+			"username":      user.Username,
+			"email":         user.Email,
+			"pending_email": user.PendingEmail,
+			"role":          user.Role,
+			"has_password":  user.PasswordHash != "",
+			"id":            user.ID,
 		},
 	})
 }
@@ -111,20 +141,76 @@ func (s *Server) HandleAssets(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-func (s *Server) HandleGallery(w http.ResponseWriter, r *http.Request) {
-	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
-	if page < 1 {
-		page = 1
+const maxPageLimit = 50
+
+// pageLimit reads the limit query parameter, falling back to def and
+// capping it at maxPageLimit.
+func pageLimit(r *http.Request, def int) int {
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit < 1 {
+		return def
 	}
-	limit := 12
-	images, total, err := s.DB.GetImagesPaginated(page, limit)
-	if err != nil {
-		s.SendJSON(w, http.StatusInternalServerError, models.APIResponse{
-			Success: false,
-			Message: "Failed to load gallery",
-		})
-		return
+	if limit > maxPageLimit {
+		return maxPageLimit
+	}
+	return limit
+}
+
+// HandleGallery serves the gallery newest first. With a cursor parameter
+// (empty for the first page) it pages by cursor and returns next_cursor;
+// otherwise it falls back to numbered pages.
+func (s *Server) HandleGallery(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	limit := pageLimit(r, 12)
+
+	var images []models.Image
+	data := map[string]interface{}{}
+	if query.Has("cursor") {
+		var next string
+		var err error
+		images, next, err = s.DB.GetImagesByCursor(query.Get("cursor"), limit)
+		if errors.Is(err, database.ErrInvalidCursor) {
+			s.SendJSON(w, http.StatusBadRequest, models.APIResponse{
+				Success: false,
+				Message: "Invalid cursor",
+			})
+			return
+		}
+		if err != nil {
+			s.SendJSON(w, http.StatusInternalServerError, models.APIResponse{
+				Success: false,
+				Message: "Failed to load gallery",
+			})
+			return
+		}
+		data["hasMore"] = next != ""
+		data["next_cursor"] = next
+	} else {
+		page, _ := strconv.Atoi(query.Get("page"))
+		if page < 1 {
+			page = 1
+		}
+		var total int
+		var err error
+		images, total, err = s.DB.GetImagesPaginated(page, limit)
+		if err != nil {
+			s.SendJSON(w, http.StatusInternalServerError, models.APIResponse{
+				Success: false,
+				Message: "Failed to load gallery",
+			})
+			return
+		}
+
+		totalPages := (total + limit - 1) / limit
+		if totalPages == 0 {
+			totalPages = 1
+		}
+		data["hasMore"] = (page-1)*limit+len(images) < total
+		data["totalPages"] = totalPages
+		data["currentPage"] = page
+		data["total"] = total
 	}
+
 	user, _ := s.GetCurrentUser(r)
 	if user != nil && len(images) > 0 {
 		imageIDs := make([]int, 0, len(images))
@@ -145,21 +231,11 @@ func (s *Server) HandleGallery(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	hasMore := (page-1)*limit+len(images) < total
-	totalPages := (total + limit - 1) / limit
-	if totalPages == 0 {
-		totalPages = 1
-	}
+	data["items"] = images
 
 	s.SendJSON(w, http.StatusOK, models.APIResponse{
 		Success: true,
-		Data: map[string]interface{}{
-			"items":       images,
-			"hasMore":     hasMore,
-			"totalPages":  totalPages,
-			"currentPage": page,
-			"total":       total,
-		},
+		Data:    data,
 	})
 }
 
@@ -346,11 +422,7 @@ func (s *Server) HandleDeleteImage(w http.ResponseWriter, r *http.Request) {
 		})
 		return
 	}
-	if path != "" && strings.HasPrefix(path, "/static/uploads/") {
-		filename := strings.TrimPrefix(path, "/static/uploads/")
-		filePath := "./data/uploads/" + filename
-		os.Remove(filePath)
-	}
+	s.deleteImageBlob(path)
 
 	s.SendJSON(w, http.StatusOK, models.APIResponse{
 		Success: true,
@@ -364,7 +436,7 @@ func (s *Server) HandleUpdateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := s.GetCurrentUser(r)
+	user, session, err := s.currentSession(r)
 	if err != nil {
 		s.SendJSON(w, http.StatusUnauthorized, models.APIResponse{
 			Success: false,
@@ -404,6 +476,20 @@ func (s *Server) HandleUpdateUser(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if email != "" && email != user.Email {
+		if !auth.IsValidEmail(email) {
+			s.SendJSON(w, http.StatusBadRequest, models.APIResponse{
+				Success: false,
+				Message: "Invalid email address",
+			})
+			return
+		}
+		if !s.emailDomainAllowed(email) {
+			s.SendJSON(w, http.StatusBadRequest, models.APIResponse{
+				Success: false,
+				Message: "Email addresses at that domain are not allowed",
+			})
+			return
+		}
 		_, emailExists, err := s.DB.UserExists("", email)
 		if err != nil {
 			s.SendJSON(w, http.StatusInternalServerError, models.APIResponse{
@@ -445,18 +531,66 @@ func (s *Server) HandleUpdateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = s.DB.UpdateUser(user.ID, updateUsername, updateEmail, updatePassword)
-	if err != nil {
-		s.SendJSON(w, http.StatusInternalServerError, models.APIResponse{
-			Success: false,
-			Message: "Failed to update profile",
-		})
-		return
+	if updateEmail != "" || updatePassword != "" {
+		if !s.reauthenticate(r, user, r.FormValue("current_password")) {
+			s.sendReauthRequired(w, user, "Enter your current password to change your email or password")
+			return
+		}
+	}
+
+	if updateUsername != "" {
+		if err := s.DB.UpdateUser(user.ID, updateUsername, ""); err != nil {
+			s.SendJSON(w, http.StatusInternalServerError, models.APIResponse{
+				Success: false,
+				Message: "Failed to update profile",
+			})
+			return
+		}
+	}
+
+	message := "Profile updated"
+	if updateEmail != "" {
+		// The new address only replaces the old one once it is confirmed.
+		token, err := auth.GenerateToken()
+		if err == nil {
+			err = s.DB.SetPendingEmail(user.ID, updateEmail, token, time.Now().Add(emailChangeTTL))
+		}
+		if errors.Is(err, database.ErrEmailUndoPending) {
+			s.SendJSON(w, http.StatusConflict, models.APIResponse{
+				Success: false,
+				Message: "Your last email change can still be undone from your old address. Try again once that link has expired.",
+			})
+			return
+		}
+		if err != nil {
+			s.SendJSON(w, http.StatusInternalServerError, models.APIResponse{
+				Success: false,
+				Message: "Failed to update profile",
+			})
+			return
+		}
+		confirmURL := fmt.Sprintf("http://localhost:8080/confirm-email?token=%s", token)
+		go s.SendEmailChangeConfirmation(updateEmail, user.Username, confirmURL)
+		message = fmt.Sprintf("Profile updated. Check %s to confirm your new email address.", updateEmail)
+	}
+
+	if updatePassword != "" {
+		// Changing the password signs out every other device.
+		if err := s.DB.UpdateUserPassword(user.ID, updatePassword, session.ID); err != nil {
+			s.SendJSON(w, http.StatusInternalServerError, models.APIResponse{
+				Success: false,
+				Message: "Failed to update profile",
+			})
+			return
+		}
+		s.challenges.dropUser(user.ID)
+		go s.SendPasswordChangedEmail(user.Email, user.Username)
 	}
 
 	s.SendJSON(w, http.StatusOK, models.APIResponse{
 		Success: true,
-		Message: "Profile updated",
+		Message: message,
+		Data:    map[string]interface{}{"pending_email": updateEmail},
 	})
 }
 
@@ -475,6 +609,7 @@ func (s *Server) HandleUserPreferences(w http.ResponseWriter, r *http.Request) {
 			Success: true,
 			Data: map[string]interface{}{
 				"comment_notifications": user.CommentNotifications,
+				"magic_link":            !user.MagicLinkDisabled,
 			},
 		})
 		return
@@ -491,7 +626,11 @@ func (s *Server) HandleUserPreferences(w http.ResponseWriter, r *http.Request) {
 		}
 
 		notifications := r.FormValue("comment_notifications") == "true"
-		err = s.DB.UpdateUserPreferences(user.ID, notifications)
+		magicLinks := !user.MagicLinkDisabled
+		if value := r.FormValue("magic_link"); value != "" {
+			magicLinks = value == "true"
+		}
+		err = s.DB.UpdateUserPreferences(user.ID, notifications, magicLinks)
 		if err != nil {
 			s.SendJSON(w, http.StatusInternalServerError, models.APIResponse{
 				Success: false,
@@ -510,6 +649,53 @@ func (s *Server) HandleUserPreferences(w http.ResponseWriter, r *http.Request) {
 	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 }
 
+func (s *Server) HandleDeleteAccount(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := s.GetCurrentUser(r)
+	if err != nil {
+		s.SendJSON(w, http.StatusUnauthorized, models.APIResponse{
+			Success: false,
+			Message: "Authentication required",
+		})
+		return
+	}
+
+	if !s.reauthenticate(r, user, r.FormValue("password")) {
+		s.sendReauthRequired(w, user, "Incorrect password")
+		return
+	}
+
+	anonymize := r.FormValue("anonymize_comments") == "true"
+	paths, err := s.DB.DeleteUser(user.ID, anonymize)
+	if err != nil {
+		s.SendJSON(w, http.StatusInternalServerError, models.APIResponse{
+			Success: false,
+			Message: "Failed to delete account",
+		})
+		return
+	}
+	for _, path := range paths {
+		s.deleteImageBlob(path)
+	}
+	s.exports.dropUser(s.ExportDir, user.ID)
+	s.challenges.dropUser(user.ID)
+	s.reauths.dropUser(user.ID)
+
+	clearSessionCookie(w)
+
+	s.SendJSON(w, http.StatusOK, models.APIResponse{
+		Success: true,
+		Message: "Account deleted",
+	})
+}
+
+// HandleUserImages lists the user's own images, newest first. Without a
+// cursor or limit parameter it returns the newest 20 as a plain array, as it
+// always has; with either it pages by cursor like HandleGallery.
 func (s *Server) HandleUserImages(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "GET" {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -524,7 +710,16 @@ func (s *Server) HandleUserImages(w http.ResponseWriter, r *http.Request) {
 		})
 		return
 	}
-	userImages, err := s.DB.GetUserImages(user.ID, 20)
+	query := r.URL.Query()
+	paged := query.Has("cursor") || query.Has("limit")
+	userImages, next, err := s.DB.GetUserImages(user.ID, query.Get("cursor"), pageLimit(r, 20))
+	if errors.Is(err, database.ErrInvalidCursor) {
+		s.SendJSON(w, http.StatusBadRequest, models.APIResponse{
+			Success: false,
+			Message: "Invalid cursor",
+		})
+		return
+	}
 	if err != nil {
 		s.SendJSON(w, http.StatusInternalServerError, models.APIResponse{
 			Success: false,
@@ -542,8 +737,19 @@ func (s *Server) HandleUserImages(w http.ResponseWriter, r *http.Request) {
 		})
 	}
 
+	if !paged {
+		s.SendJSON(w, http.StatusOK, models.APIResponse{
+			Success: true,
+			Data:    images,
+		})
+		return
+	}
 	s.SendJSON(w, http.StatusOK, models.APIResponse{
 		Success: true,
-		Data:    images,
+		Data: map[string]interface{}{
+			"items":       images,
+			"hasMore":     next != "",
+			"next_cursor": next,
+		},
 	})
 }
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"camagru/internal/database"
+	"camagru/internal/models"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestUserImagesKeepsItsArrayResponse(t *testing.T) {
+	db := database.NewMemoryStorage()
+	db.InitDB()
+	s := &Server{DB: db}
+	userID, session := passwordSession(t, s, db, "alice", "correct horse")
+	for i := 0; i < 3; i++ {
+		db.CreateImage(userID, "/static/uploads/a.png")
+	}
+
+	get := func(target string) interface{} {
+		req := httptest.NewRequest("GET", target, nil)
+		req.AddCookie(session)
+		rec := httptest.NewRecorder()
+		s.HandleUserImages(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: status %d", target, rec.Code)
+		}
+		var resp models.APIResponse
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		return resp.Data
+	}
+
+	if images, ok := get("/api/user/images").([]interface{}); !ok || len(images) != 3 {
+		t.Fatalf("without paging parameters: %#v", images)
+	}
+	for _, target := range []string{"/api/user/images?cursor=", "/api/user/images?limit=2"} {
+		page, ok := get(target).(map[string]interface{})
+		if !ok || page["items"] == nil {
+			t.Fatalf("%s: %#v", target, page)
+		}
+	}
+	page := get("/api/user/images?limit=2").(map[string]interface{})
+	if len(page["items"].([]interface{})) != 2 || page["hasMore"] != true || page["next_cursor"] == "" {
+		t.Fatalf("first page: %#v", page)
+	}
+}
@@ -1,8 +1,8 @@
 package server
 
 import (
+	"bytes"
 	"camagru/internal/models"
-	"fmt"
 	"image"
 	"image/color"
 	"image/draw"
@@ -10,9 +10,7 @@ import (
 	_ "image/png"
 	"net/http"
 	"os"
-	"path/filepath"
 	"strconv"
-	"time"
 )
 
 func (s *Server) HandleCompose(w http.ResponseWriter, r *http.Request) {
@@ -188,21 +186,8 @@ func (s *Server) HandleCompose(w http.ResponseWriter, r *http.Request) {
 	} else {
 		drawOverlay(canvas, overlayImg, finalX, finalY)
 	}
-	uploadDir := "./data/uploads"
-	os.MkdirAll(uploadDir, 0755)
-	filename = fmt.Sprintf("%d_%s_%d.jpg", user.ID, user.Username, time.Now().Unix())
-	filePath := filepath.Join(uploadDir, filename)
-
-	outFile, err := os.Create(filePath)
-	if err != nil {
-		s.SendJSON(w, http.StatusInternalServerError, models.APIResponse{
-			Success: false,
-			Message: "Failed to save image",
-		})
-		return
-	}
-	defer outFile.Close()
-	err = jpeg.Encode(outFile, canvas, &jpeg.Options{Quality: 90})
+	var encoded bytes.Buffer
+	err = jpeg.Encode(&encoded, canvas, &jpeg.Options{Quality: 90})
 	if err != nil {
 		s.SendJSON(w, http.StatusInternalServerError, models.APIResponse{
 			Success: false,
@@ -210,14 +195,11 @@ func (s *Server) HandleCompose(w http.ResponseWriter, r *http.Request) {
 		})
 		return
 	}
-	imagePath := "/static/uploads/" + filename
-	_, err = s.DB.CreateImage(user.ID, imagePath)
-
+	imagePath, err := s.saveImage(user.ID, encoded.Bytes(), "image/jpeg")
 	if err != nil {
-		os.Remove(filePath)
 		s.SendJSON(w, http.StatusInternalServerError, models.APIResponse{
 			Success: false,
-			Message: "Failed to save image record",
+			Message: "Failed to save image",
 		})
 		return
 	}
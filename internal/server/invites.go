@@ -0,0 +1,203 @@
+package server
+
+import (
+	"camagru/internal/auth"
+	"camagru/internal/models"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Registration modes.
+const (
+	RegistrationOpen   = "open"
+	RegistrationInvite = "invite"
+	RegistrationClosed = "closed"
+)
+
+const (
+	maxInviteUses     = 100
+	maxInviteDays     = 90
+	defaultInviteDays = 7
+)
+
+// emailDomainAllowed reports whether accounts may use email. Domains must
+// match exactly, so allowing example.com does not allow mail.example.com.
+func (s *Server) emailDomainAllowed(email string) bool {
+	if len(s.EmailDomains) == 0 {
+		return true
+	}
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return false
+	}
+	domain := strings.ToLower(email[at+1:])
+	for _, allowed := range s.EmailDomains {
+		if domain == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// HandleInvites lists the user's invites, or makes a new one. Invites only
+// matter while registration is invite-only, but can be made beforehand.
+func (s *Server) HandleInvites(w http.ResponseWriter, r *http.Request) {
+	user, err := s.GetCurrentUser(r)
+	if err != nil {
+		s.SendJSON(w, http.StatusUnauthorized, models.APIResponse{
+			Success: false,
+			Message: "Authentication required",
+		})
+		return
+	}
+
+	if r.Method == "GET" {
+		invites, err := s.DB.GetUserInvites(user.ID)
+		if err != nil {
+			s.SendJSON(w, http.StatusInternalServerError, models.APIResponse{
+				Success: false,
+				Message: "Failed to load invites",
+			})
+			return
+		}
+		s.SendJSON(w, http.StatusOK, models.APIResponse{
+			Success: true,
+			Data: map[string]interface{}{
+				"registration": s.registrationMode(),
+				"invites":      invites,
+			},
+		})
+		return
+	}
+
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	maxUses := 1
+	if value := r.FormValue("max_uses"); value != "" {
+		maxUses, err = strconv.Atoi(value)
+		if err != nil || maxUses < 1 || maxUses > maxInviteUses {
+			s.SendJSON(w, http.StatusBadRequest, models.APIResponse{
+				Success: false,
+				Message: "Uses must be between 1 and 100",
+			})
+			return
+		}
+	}
+
+	days := defaultInviteDays
+	if value := r.FormValue("expires_in_days"); value != "" {
+		days, err = strconv.Atoi(value)
+		if err != nil || days < 1 || days > maxInviteDays {
+			s.SendJSON(w, http.StatusBadRequest, models.APIResponse{
+				Success: false,
+				Message: "Expiry must be between 1 and 90 days",
+			})
+			return
+		}
+	}
+	expiresAt := time.Now().Add(time.Duration(days) * 24 * time.Hour)
+
+	code, err := auth.GenerateToken()
+	if err != nil {
+		s.SendJSON(w, http.StatusInternalServerError, models.APIResponse{
+			Success: false,
+			Message: "Failed to create invite",
+		})
+		return
+	}
+	inviteID, err := s.DB.CreateInvite(user.ID, code, maxUses, &expiresAt)
+	if err != nil {
+		s.SendJSON(w, http.StatusInternalServerError, models.APIResponse{
+			Success: false,
+			Message: "Failed to create invite",
+		})
+		return
+	}
+
+	s.SendJSON(w, http.StatusOK, models.APIResponse{
+		Success: true,
+		Message: "Invite created. Copy the link now, it will not be shown again.",
+		Data: map[string]interface{}{
+			"id":        inviteID,
+			"code":      code,
+			"url":       fmt.Sprintf("http://localhost:8080/register?invite=%s", code),
+			"max_uses":  maxUses,
+			"expiresAt": expiresAt,
+		},
+	})
+}
+
+// HandleRevokeInvite deletes an invite. Admins can revoke anyone's.
+func (s *Server) HandleRevokeInvite(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := s.GetCurrentUser(r)
+	if err != nil {
+		s.SendJSON(w, http.StatusUnauthorized, models.APIResponse{
+			Success: false,
+			Message: "Authentication required",
+		})
+		return
+	}
+
+	inviteID, _ := strconv.Atoi(r.FormValue("invite_id"))
+	invite, err := s.DB.GetInviteByID(inviteID)
+	if err != nil || (invite.CreatedBy != user.ID && !hasRole(user, models.RoleAdmin)) {
+		s.SendJSON(w, http.StatusNotFound, models.APIResponse{
+			Success: false,
+			Message: "Invite not found",
+		})
+		return
+	}
+
+	if err := s.DB.DeleteInvite(inviteID); err != nil {
+		s.SendJSON(w, http.StatusInternalServerError, models.APIResponse{
+			Success: false,
+			Message: "Failed to revoke invite",
+		})
+		return
+	}
+
+	s.SendJSON(w, http.StatusOK, models.APIResponse{
+		Success: true,
+		Message: "Invite revoked",
+	})
+}
+
+// HandleAdminInvites lists every user's invites and who used them.
+func (s *Server) HandleAdminInvites(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	invites, err := s.DB.ListInvites()
+	if err != nil {
+		s.SendJSON(w, http.StatusInternalServerError, models.APIResponse{
+			Success: false,
+			Message: "Failed to load invites",
+		})
+		return
+	}
+
+	s.SendJSON(w, http.StatusOK, models.APIResponse{
+		Success: true,
+		Data:    invites,
+	})
+}
+
+func (s *Server) registrationMode() string {
+	if s.Registration == "" {
+		return RegistrationOpen
+	}
+	return s.Registration
+}
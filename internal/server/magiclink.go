@@ -0,0 +1,109 @@
+package server
+
+import (
+	"camagru/internal/auth"
+	"camagru/internal/models"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// magicLinkTTL is how long an emailed sign-in link works.
+const magicLinkTTL = 15 * time.Minute
+
+// HandleMagicLinkRequest emails a single-use sign-in link to the account
+// with the given address, for users who would rather not type a password.
+func (s *Server) HandleMagicLinkRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	email := strings.TrimSpace(r.FormValue("email"))
+	if !auth.IsValidEmail(email) {
+		s.SendJSON(w, http.StatusBadRequest, models.APIResponse{
+			Success: false,
+			Message: "Invalid email address",
+		})
+		return
+	}
+
+	user, err := s.DB.GetUserByUsernameOrEmail(email)
+	if err != nil {
+		user = nil
+	}
+
+	limits := s.limits.get()
+	ip := clientIP(r)
+	account := accountKey(user, email)
+	if !s.checkLimits(w, map[*auth.Limiter]string{limits.mailIP: ip, limits.mailAccount: account}) {
+		return
+	}
+	limits.mailIP.Record(ip)
+	limits.mailAccount.Record(account)
+
+	sent := models.APIResponse{
+		Success: true,
+		Message: "If sign-in links are enabled for that address, one has been sent.",
+	}
+	if user == nil || !user.Verified || user.Suspended || user.MagicLinkDisabled {
+		s.SendJSON(w, http.StatusOK, sent)
+		return
+	}
+
+	token, err := auth.GenerateToken()
+	if err == nil {
+		err = s.DB.SetMagicLinkToken(user.ID, token, time.Now().Add(magicLinkTTL))
+	}
+	if err != nil {
+		s.SendJSON(w, http.StatusInternalServerError, models.APIResponse{
+			Success: false,
+			Message: "Failed to send sign-in link",
+		})
+		return
+	}
+
+	// The link opens the login page, which posts the token back. Mail
+	// scanners that fetch links ahead of the user therefore do not use it
+	// up.
+	signInURL := fmt.Sprintf("http://localhost:8080/login?magic_token=%s", token)
+	go s.SendMagicLinkEmail(user.Email, user.Username, signInURL)
+
+	s.SendJSON(w, http.StatusOK, sent)
+}
+
+// HandleMagicLinkLogin signs in the holder of a link sent by
+// HandleMagicLinkRequest. Users with two-factor authentication still have
+// to enter a code.
+func (s *Server) HandleMagicLinkLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	limits := s.limits.get()
+	ip := clientIP(r)
+	if !s.checkLimits(w, map[*auth.Limiter]string{limits.loginIP: ip}) {
+		return
+	}
+
+	user, err := s.DB.ConsumeMagicLink(r.FormValue("token"))
+	if err != nil {
+		limits.loginIP.Record(ip)
+		s.SendJSON(w, http.StatusUnauthorized, models.APIResponse{
+			Success: false,
+			Message: "This sign-in link is invalid or has expired",
+		})
+		return
+	}
+	if !user.Verified || user.Suspended {
+		s.SendJSON(w, http.StatusForbidden, models.APIResponse{
+			Success: false,
+			Message: "This account cannot sign in",
+		})
+		return
+	}
+
+	s.finishLogin(w, r, user)
+}
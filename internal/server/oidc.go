@@ -0,0 +1,286 @@
+package server
+
+import (
+	"camagru/internal/auth"
+	"camagru/internal/models"
+	"camagru/internal/oidc"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// oidcLoginTTL is how long a user has to sign in at the identity
+	// provider.
+	oidcLoginTTL = 10 * time.Minute
+	oidcCookie   = "oidc_state"
+)
+
+type oidcLogin struct {
+	request *oidc.AuthRequest
+	// reauthUser is set when a signed-in user is confirming who they are,
+	// rather than signing in.
+	reauthUser int
+	expires    time.Time
+}
+
+// oidcLogins holds sign-ins sent to the identity provider, by state. The
+// zero value is ready to use.
+type oidcLogins struct {
+	mu     sync.Mutex
+	logins map[string]*oidcLogin
+}
+
+func (l *oidcLogins) start(req *oidc.AuthRequest, reauthUser int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	for state, login := range l.logins {
+		if now.After(login.expires) {
+			delete(l.logins, state)
+		}
+	}
+	if l.logins == nil {
+		l.logins = make(map[string]*oidcLogin)
+	}
+	l.logins[req.State] = &oidcLogin{request: req, reauthUser: reauthUser, expires: now.Add(oidcLoginTTL)}
+}
+
+// finish returns the sign-in with the given state and forgets it, so that
+// the provider's answer can only be used once.
+func (l *oidcLogins) finish(state string) (*oidcLogin, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	login, exists := l.logins[state]
+	delete(l.logins, state)
+	if !exists || time.Now().After(login.expires) {
+		return nil, false
+	}
+	return login, true
+}
+
+// setOIDCStateCookie ties a sign-in to the browser that started it. The
+// state must come back to that browser, or someone could sign a victim in
+// to the attacker's account. Lax, because the provider's redirect back is a
+// cross-site navigation.
+func setOIDCStateCookie(w http.ResponseWriter, state string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcCookie,
+		Value:    state,
+		Path:     "/login/oidc",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   int(oidcLoginTTL.Seconds()),
+	})
+}
+
+// HandleLoginOptions tells the login and registration pages which sign-in
+// methods to offer and who may register.
+func (s *Server) HandleLoginOptions(w http.ResponseWriter, r *http.Request) {
+	s.SendJSON(w, http.StatusOK, models.APIResponse{
+		Success: true,
+		Data: map[string]interface{}{
+			"oidc":         s.OIDC != nil,
+			"oidc_name":    s.OIDCName,
+			"registration": s.registrationMode(),
+		},
+	})
+}
+
+// HandleOIDCLogin sends the browser to the identity provider.
+func (s *Server) HandleOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	if s.OIDC == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	req, err := s.OIDC.AuthCodeURL(r.Context())
+	if err != nil {
+		fmt.Printf("OIDC login failed: %v\n", err)
+		http.Redirect(w, r, "/login?oidc_error=failed", http.StatusFound)
+		return
+	}
+	s.oidcLogins.start(req, 0)
+	setOIDCStateCookie(w, req.State)
+	http.Redirect(w, r, req.URL, http.StatusFound)
+}
+
+// HandleOIDCCallback completes a sign-in at the identity provider. The
+// identity is matched to an account by the provider's subject, then by
+// verified email address, and otherwise a new account is created.
+func (s *Server) HandleOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	if s.OIDC == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	fail := func(reason string) {
+		http.Redirect(w, r, "/login?oidc_error="+reason, http.StatusFound)
+	}
+
+	http.SetCookie(w, &http.Cookie{Name: oidcCookie, Path: "/login/oidc", MaxAge: -1})
+	query := r.URL.Query()
+	state := query.Get("state")
+	cookie, err := r.Cookie(oidcCookie)
+	if err != nil || state == "" || cookie.Value != state {
+		fail("failed")
+		return
+	}
+	login, ok := s.oidcLogins.finish(state)
+	if ok && login.reauthUser != 0 {
+		fail = func(string) {
+			http.Redirect(w, r, "/user?reauth_error=1", http.StatusFound)
+		}
+	}
+	if !ok || query.Get("error") != "" {
+		fail("failed")
+		return
+	}
+
+	claims, err := s.OIDC.Exchange(r.Context(), login.request, query.Get("code"))
+	if err != nil {
+		fmt.Printf("OIDC sign-in failed: %v\n", err)
+		fail("failed")
+		return
+	}
+	subject := s.OIDC.Issuer() + " " + claims.Subject
+	if login.reauthUser != 0 {
+		s.finishOIDCReauth(w, r, login.reauthUser, subject)
+		return
+	}
+	email := strings.TrimSpace(claims.Email)
+
+	user, err := s.DB.GetUserByOIDCSubject(subject)
+	if err != nil {
+		if !auth.IsValidEmail(email) {
+			fail("no_email")
+			return
+		}
+		user, err = s.DB.GetUserByUsernameOrEmail(email)
+		if err == nil && user.Email == email {
+			// Only the provider's word that the address is theirs lets
+			// someone into an existing account. If that account was never
+			// verified, whoever registered it may not own the address, so
+			// linking drops its password and everything signed in with it.
+			if !claims.EmailVerified {
+				fail("email_unverified")
+				return
+			}
+			if err := s.DB.LinkOIDCSubject(user.ID, subject); err != nil {
+				fail("failed")
+				return
+			}
+			user, err = s.DB.GetUserByID(user.ID)
+		} else {
+			// Invites cannot be passed through the provider, so only open
+			// registration creates accounts this way.
+			if s.registrationMode() != RegistrationOpen {
+				fail("registration_closed")
+				return
+			}
+			if !s.emailDomainAllowed(email) {
+				fail("domain")
+				return
+			}
+			user, err = s.createOIDCUser(claims, email, subject)
+		}
+		if err != nil {
+			fmt.Printf("OIDC sign-in failed: %v\n", err)
+			fail("failed")
+			return
+		}
+	}
+
+	if user.Suspended {
+		fail("suspended")
+		return
+	}
+	if !user.Verified {
+		http.Redirect(w, r, "/login?oidc_verify=1", http.StatusFound)
+		return
+	}
+
+	if user.TOTPSecret != "" {
+		token, err := s.challenges.start(user.ID)
+		if err != nil {
+			fail("failed")
+			return
+		}
+		http.Redirect(w, r, "/login?two_factor="+token, http.StatusFound)
+		return
+	}
+	if err := s.startSession(w, r, user.ID); err != nil {
+		fail("failed")
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+var usernameUnsafe = regexp.MustCompile(`[^a-zA-Z0-9_]+`)
+
+// createOIDCUser creates an account for a first sign-in through the identity
+// provider. Addresses the provider has not verified get a verification
+// email, as with HandleRegister.
+func (s *Server) createOIDCUser(claims *oidc.Claims, email, subject string) (*models.User, error) {
+	base := usernameUnsafe.ReplaceAllString(claims.PreferredUsername, "_")
+	if len(strings.Trim(base, "_")) < 3 {
+		base = usernameUnsafe.ReplaceAllString(strings.SplitN(email, "@", 2)[0], "_")
+	}
+	if len(base) > 16 {
+		base = base[:16]
+	}
+	for len(base) < 3 {
+		base += "_"
+	}
+
+	username := ""
+	for i := 1; i < 100 && username == ""; i++ {
+		candidate := base
+		if i > 1 {
+			candidate += strconv.Itoa(i)
+		}
+		taken, _, err := s.DB.UserExists(candidate, "")
+		if err != nil {
+			return nil, err
+		}
+		if !taken {
+			username = candidate
+		}
+	}
+	if username == "" {
+		return nil, fmt.Errorf("no free username for %q", base)
+	}
+
+	verificationToken := ""
+	if !claims.EmailVerified {
+		token, err := auth.GenerateToken()
+		if err != nil {
+			return nil, err
+		}
+		verificationToken = token
+	}
+
+	userID, err := s.DB.CreateOIDCUser(username, email, subject, verificationToken, time.Now().Add(verificationTTL))
+	if err != nil {
+		return nil, err
+	}
+	if verificationToken != "" {
+		verificationURL := fmt.Sprintf("http://localhost:8080/verify?token=%s", verificationToken)
+		go s.SendVerificationEmail(email, username, verificationURL)
+	}
+	return s.DB.GetUserByID(userID)
+}
@@ -0,0 +1,362 @@
+package server
+
+import (
+	"camagru/internal/auth"
+	"camagru/internal/database"
+	"camagru/internal/models"
+	"camagru/internal/oidc"
+	"camagru/internal/oidc/mockidp"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+type oidcEnv struct {
+	t   *testing.T
+	s   *Server
+	db  *database.Storage
+	idp *mockidp.IdP
+}
+
+func newOIDCEnv(t *testing.T) *oidcEnv {
+	t.Helper()
+	// Emails are sent in the background; make them fail fast.
+	t.Setenv("SMTP_HOST", "127.0.0.1")
+	t.Setenv("SMTP_PORT", "1")
+
+	idp, err := mockidp.New("", "camagru")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(idp)
+	t.Cleanup(srv.Close)
+	idp.Issuer = srv.URL
+
+	provider, err := oidc.NewProvider(oidc.Config{
+		Issuer:      srv.URL,
+		ClientID:    "camagru",
+		RedirectURL: "http://localhost:8080/login/oidc/callback",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := database.NewMemoryStorage()
+	if err := db.InitDB(); err != nil {
+		t.Fatal(err)
+	}
+	return &oidcEnv{
+		t:   t,
+		s:   &Server{DB: db, OIDC: provider, OIDCName: "Mock"},
+		db:  db,
+		idp: idp,
+	}
+}
+
+// signIn plays the browser through a sign-in that start sends to the mock
+// provider, and returns the callback's response. cookies are sent to start
+// only: the callback is a cross-site redirect from the provider, so a
+// browser sends it the Lax state cookie but not the Strict session cookie.
+func (e *oidcEnv) signIn(start http.HandlerFunc, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	e.t.Helper()
+	req := httptest.NewRequest("GET", "/login/oidc", nil)
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	rec := httptest.NewRecorder()
+	start(rec, req)
+	if rec.Code != http.StatusFound {
+		e.t.Fatalf("start: status %d", rec.Code)
+	}
+	state := cookieNamed(rec, oidcCookie)
+	if state == nil {
+		e.t.Fatalf("start set no state cookie; redirected to %s", rec.Header().Get("Location"))
+	}
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(rec.Header().Get("Location"))
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	resp.Body.Close()
+	callback, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil || resp.StatusCode != http.StatusFound {
+		e.t.Fatalf("provider: status %d", resp.StatusCode)
+	}
+
+	req = httptest.NewRequest("GET", callback.RequestURI(), nil)
+	req.AddCookie(state)
+	rec = httptest.NewRecorder()
+	e.s.HandleOIDCCallback(rec, req)
+	return rec
+}
+
+// session signs user in at the provider and returns the session cookie.
+func (e *oidcEnv) session(user mockidp.User) *http.Cookie {
+	e.t.Helper()
+	e.idp.SetUser(user)
+	rec := e.signIn(e.s.HandleOIDCLogin)
+	if loc := rec.Header().Get("Location"); loc != "/" {
+		e.t.Fatalf("sign-in redirected to %s", loc)
+	}
+	return cookieNamed(rec, "session")
+}
+
+// reauth confirms the session's owner at the provider and returns the
+// reauth token.
+func (e *oidcEnv) reauth(session *http.Cookie) string {
+	e.t.Helper()
+	rec := e.signIn(e.s.HandleOIDCReauth, session)
+	loc, _ := url.Parse(rec.Header().Get("Location"))
+	token := loc.Query().Get("reauth")
+	if loc.Path != "/user" || token == "" {
+		e.t.Fatalf("reauth redirected to %s", loc)
+	}
+	return token
+}
+
+func cookieNamed(rec *httptest.ResponseRecorder, name string) *http.Cookie {
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == name && c.MaxAge >= 0 {
+			return c
+		}
+	}
+	return nil
+}
+
+func postForm(h http.HandlerFunc, form url.Values, cookies ...*http.Cookie) (int, models.APIResponse) {
+	req := httptest.NewRequest("POST", "/", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	rec := httptest.NewRecorder()
+	h(rec, req)
+	var resp models.APIResponse
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	return rec.Code, resp
+}
+
+var alice = mockidp.User{
+	Subject:           "alice-1",
+	Email:             "alice@example.com",
+	EmailVerified:     true,
+	PreferredUsername: "alice",
+}
+
+func TestOIDCOnlyAccountReauthenticates(t *testing.T) {
+	e := newOIDCEnv(t)
+	session := e.session(alice)
+	user, err := e.db.GetUserByUsernameOrEmail(alice.Email)
+	if err != nil || user.PasswordHash != "" {
+		t.Fatalf("expected a passwordless account, got %+v, %v", user, err)
+	}
+
+	t.Run("change email", func(t *testing.T) {
+		form := url.Values{"email": {"alice2@example.com"}}
+		code, resp := postForm(e.s.HandleUpdateUser, form, session)
+		if code != http.StatusUnauthorized || resp.Data == nil {
+			t.Fatalf("without reauth: %d %+v", code, resp)
+		}
+
+		form.Set("reauth_token", e.reauth(session))
+		if code, resp := postForm(e.s.HandleUpdateUser, form, session); code != http.StatusOK {
+			t.Fatalf("with reauth: %d %+v", code, resp)
+		}
+		// The token works once.
+		form.Set("email", "alice3@example.com")
+		if code, _ := postForm(e.s.HandleUpdateUser, form, session); code != http.StatusUnauthorized {
+			t.Fatalf("reused reauth token: %d", code)
+		}
+	})
+
+	t.Run("disable two-factor", func(t *testing.T) {
+		secret, _ := auth.GenerateTOTPSecret()
+		codes, _ := auth.GenerateRecoveryCodes(2)
+		e.db.SetPendingTOTPSecret(user.ID, secret)
+		e.db.EnableTOTP(user.ID, 0, codes)
+
+		form := url.Values{"code": {codes[0]}}
+		if code, _ := postForm(e.s.HandleTwoFactorDisable, form, session); code != http.StatusUnauthorized {
+			t.Fatalf("without reauth: %d", code)
+		}
+
+		form.Set("reauth_token", e.reauth(session))
+		if code, resp := postForm(e.s.HandleTwoFactorDisable, form, session); code != http.StatusOK {
+			t.Fatalf("with reauth: %d %+v", code, resp)
+		}
+	})
+
+	t.Run("delete account", func(t *testing.T) {
+		if code, _ := postForm(e.s.HandleDeleteAccount, url.Values{}, session); code != http.StatusUnauthorized {
+			t.Fatalf("without reauth: %d", code)
+		}
+
+		// Someone else's fresh sign-in at the provider does not count.
+		token := e.reauth(session)
+		other := e.session(mockidp.User{Subject: "bob-1", Email: "bob@example.com", EmailVerified: true})
+		form := url.Values{"reauth_token": {token}}
+		if code, _ := postForm(e.s.HandleDeleteAccount, form, other); code != http.StatusUnauthorized {
+			t.Fatalf("another user's reauth token: %d", code)
+		}
+
+		if code, resp := postForm(e.s.HandleDeleteAccount, form, session); code != http.StatusOK {
+			t.Fatalf("with reauth: %d %+v", code, resp)
+		}
+		if _, err := e.db.GetUserByID(user.ID); err == nil {
+			t.Fatal("account still exists")
+		}
+	})
+}
+
+func TestOIDCReauthRequiresTheAccountsIdentity(t *testing.T) {
+	e := newOIDCEnv(t)
+	session := e.session(alice)
+
+	// The provider now signs in someone else.
+	e.idp.SetUser(mockidp.User{Subject: "mallory-1", Email: "mallory@example.com", EmailVerified: true})
+	rec := e.signIn(e.s.HandleOIDCReauth, session)
+	if loc := rec.Header().Get("Location"); loc != "/user?reauth_error=1" {
+		t.Fatalf("redirected to %s", loc)
+	}
+}
+
+func TestOIDCReauthCallbackWithoutSessionCookie(t *testing.T) {
+	e := newOIDCEnv(t)
+	session := e.session(alice)
+	user, _ := e.db.GetUserByUsernameOrEmail(alice.Email)
+
+	// signIn sends the callback nothing but the state cookie.
+	token := e.reauth(session)
+	if userID, ok := e.s.reauths.lookup(token); !ok || userID != user.ID {
+		t.Fatalf("reauth token is for user %d, want %d", userID, user.ID)
+	}
+
+	// The token is only good together with the account's own session.
+	form := url.Values{"reauth_token": {token}}
+	if code, _ := postForm(e.s.HandleDeleteAccount, form); code != http.StatusUnauthorized {
+		t.Fatalf("without a session: %d", code)
+	}
+	if code, resp := postForm(e.s.HandleDeleteAccount, form, session); code != http.StatusOK {
+		t.Fatalf("with the session: %d %+v", code, resp)
+	}
+}
+
+func TestOIDCLinking(t *testing.T) {
+	callback := func(rec *httptest.ResponseRecorder) string {
+		return rec.Header().Get("Location")
+	}
+
+	t.Run("creates an account", func(t *testing.T) {
+		e := newOIDCEnv(t)
+		e.idp.SetUser(alice)
+		if loc := callback(e.signIn(e.s.HandleOIDCLogin)); loc != "/" {
+			t.Fatalf("redirected to %s", loc)
+		}
+		user, err := e.db.GetUserByOIDCSubject(e.s.OIDC.Issuer() + " " + alice.Subject)
+		if err != nil || user.Username != "alice" || !user.Verified || user.PasswordHash != "" {
+			t.Fatalf("got %+v, %v", user, err)
+		}
+	})
+
+	t.Run("unverified address needs verifying", func(t *testing.T) {
+		e := newOIDCEnv(t)
+		e.idp.SetUser(mockidp.User{Subject: "carol-1", Email: "carol@example.com"})
+		if loc := callback(e.signIn(e.s.HandleOIDCLogin)); loc != "/login?oidc_verify=1" {
+			t.Fatalf("redirected to %s", loc)
+		}
+		if user, err := e.db.GetUserByUsernameOrEmail("carol@example.com"); err != nil || user.Verified {
+			t.Fatalf("got %+v, %v", user, err)
+		}
+	})
+
+	t.Run("links a verified account and keeps its password", func(t *testing.T) {
+		e := newOIDCEnv(t)
+		userID, _ := passwordSession(t, e.s, e.db, "alice", "correct horse")
+		before, _ := e.db.GetUserByID(userID)
+
+		e.idp.SetUser(alice)
+		if loc := callback(e.signIn(e.s.HandleOIDCLogin)); loc != "/" {
+			t.Fatalf("redirected to %s", loc)
+		}
+		user, _ := e.db.GetUserByID(userID)
+		if user.OIDCSubject == "" || user.PasswordHash != before.PasswordHash {
+			t.Fatalf("got %+v", user)
+		}
+		if sessions, _ := e.db.GetUserSessions(userID); len(sessions) != 2 {
+			t.Fatalf("%d sessions, want the old one and the new one", len(sessions))
+		}
+	})
+
+	t.Run("hands over an unverified account clean", func(t *testing.T) {
+		e := newOIDCEnv(t)
+		// Someone registered alice's address before she did.
+		hash, _ := auth.HashPassword("squatter")
+		userID, err := e.db.CreateUser("squatter", alice.Email, hash, "token", time.Now().Add(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		e.db.CreateSession(userID, "squatter-session", "", "")
+
+		e.idp.SetUser(alice)
+		if loc := callback(e.signIn(e.s.HandleOIDCLogin)); loc != "/" {
+			t.Fatalf("redirected to %s", loc)
+		}
+		user, _ := e.db.GetUserByID(userID)
+		if user.OIDCSubject == "" || !user.Verified || user.PasswordHash != "" {
+			t.Fatalf("got %+v", user)
+		}
+		if _, err := e.db.GetSessionByToken("squatter-session"); err == nil {
+			t.Fatal("the squatter's session survived")
+		}
+	})
+
+	t.Run("refuses an address the provider has not verified", func(t *testing.T) {
+		e := newOIDCEnv(t)
+		userID, _ := passwordSession(t, e.s, e.db, "alice", "correct horse")
+
+		unverified := alice
+		unverified.EmailVerified = false
+		e.idp.SetUser(unverified)
+		if loc := callback(e.signIn(e.s.HandleOIDCLogin)); loc != "/login?oidc_error=email_unverified" {
+			t.Fatalf("redirected to %s", loc)
+		}
+		if user, _ := e.db.GetUserByID(userID); user.OIDCSubject != "" {
+			t.Fatal("account linked")
+		}
+	})
+
+	t.Run("matches by subject before email", func(t *testing.T) {
+		e := newOIDCEnv(t)
+		e.session(alice)
+		user, _ := e.db.GetUserByUsernameOrEmail(alice.Email)
+
+		renamed := alice
+		renamed.Email = "alice@elsewhere.example.com"
+		e.session(renamed)
+		if again, _ := e.db.GetUserByUsernameOrEmail(alice.Email); again == nil || again.ID != user.ID {
+			t.Fatal("a second account was created")
+		}
+	})
+
+	t.Run("follows the registration policy", func(t *testing.T) {
+		e := newOIDCEnv(t)
+		e.idp.SetUser(alice)
+		e.s.EmailDomains = []string{"example.org"}
+		if loc := callback(e.signIn(e.s.HandleOIDCLogin)); loc != "/login?oidc_error=domain" {
+			t.Fatalf("domain not allowed: redirected to %s", loc)
+		}
+		e.s.Registration = RegistrationInvite
+		if loc := callback(e.signIn(e.s.HandleOIDCLogin)); loc != "/login?oidc_error=registration_closed" {
+			t.Fatalf("invite only: redirected to %s", loc)
+		}
+		if _, err := e.db.GetUserByUsernameOrEmail(alice.Email); err == nil {
+			t.Fatal("account created")
+		}
+	})
+}
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"camagru/internal/auth"
+	"camagru/internal/models"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// loginLockout is how long an account stays locked, for the address that
+// made too many failed logins against it.
+const loginLockout = 15 * time.Minute
+
+// rateLimits throttles the endpoints that check passwords or send email.
+// The zero value is ready to use.
+type rateLimits struct {
+	once sync.Once
+
+	// Failed logins, per client address, per account and per account and
+	// address. Only the last locks out: anyone who knows a username could
+	// otherwise lock its owner out, so per account there is backoff alone.
+	loginIP      *auth.Limiter
+	loginAccount *auth.Limiter
+	loginClient  *auth.Limiter
+	// Every request that may send an email, per client address and per
+	// recipient.
+	mailIP      *auth.Limiter
+	mailAccount *auth.Limiter
+}
+
+func (l *rateLimits) get() *rateLimits {
+	l.once.Do(func() {
+		l.loginIP = auth.NewLimiter(auth.LimiterConfig{
+			Free:         20,
+			Backoff:      time.Second,
+			MaxBackoff:   time.Minute,
+			LockoutAfter: 100,
+			Lockout:      time.Hour,
+			Window:       time.Hour,
+		})
+		l.loginAccount = auth.NewLimiter(auth.LimiterConfig{
+			Free:       5,
+			Backoff:    time.Second,
+			MaxBackoff: time.Minute,
+			Window:     time.Hour,
+		})
+		l.loginClient = auth.NewLimiter(auth.LimiterConfig{
+			Free:         5,
+			Backoff:      time.Second,
+			MaxBackoff:   time.Minute,
+			LockoutAfter: 10,
+			Lockout:      loginLockout,
+			Window:       time.Hour,
+		})
+		l.mailIP = auth.NewLimiter(auth.LimiterConfig{
+			Free:       10,
+			Backoff:    time.Minute,
+			MaxBackoff: time.Hour,
+			Window:     time.Hour,
+		})
+		l.mailAccount = auth.NewLimiter(auth.LimiterConfig{
+			Free:       3,
+			Backoff:    time.Minute,
+			MaxBackoff: time.Hour,
+			Window:     time.Hour,
+		})
+	})
+	return l
+}
+
+// accountKey identifies an account for rate limiting. Attempts against
+// names that match no account are counted too, so that the responses do not
+// reveal which accounts exist.
+func accountKey(user *models.User, name string) string {
+	if user != nil {
+		return fmt.Sprintf("user:%d", user.ID)
+	}
+	return "name:" + strings.ToLower(name)
+}
+
+// loginChecks returns the limiters a login attempt from ip against account
+// must pass, for checkLimits.
+func (l *rateLimits) loginChecks(ip, account string) map[*auth.Limiter]string {
+	return map[*auth.Limiter]string{
+		l.loginIP:      ip,
+		l.loginAccount: account,
+		l.loginClient:  account + "@" + ip,
+	}
+}
+
+// loginSucceeded forgets the failed attempts against account, once someone
+// at ip has signed in to it.
+func (l *rateLimits) loginSucceeded(ip, account string) {
+	l.loginAccount.Reset(account)
+	l.loginClient.Reset(account + "@" + ip)
+}
+
+// recordLoginFailure counts a failed password or code, telling the account
+// owner when it locks their account.
+func (s *Server) recordLoginFailure(ip, account string, user *models.User) {
+	limits := s.limits.get()
+	limits.loginIP.Record(ip)
+	limits.loginAccount.Record(account)
+	if limits.loginClient.Record(account+"@"+ip) && user != nil && os.Getenv("LOCKOUT_EMAIL") != "false" {
+		go s.SendLockoutEmail(user.Email, user.Username, loginLockout)
+	}
+}
+
+// checkLimits reports whether every key may make an attempt, and otherwise
+// answers 429 with a Retry-After header for the longest wait.
+func (s *Server) checkLimits(w http.ResponseWriter, checks map[*auth.Limiter]string) bool {
+	var wait time.Duration
+	for limiter, key := range checks {
+		if d, ok := limiter.Check(key); !ok && d > wait {
+			wait = d
+		}
+	}
+	if wait == 0 {
+		return true
+	}
+
+	seconds := int((wait + time.Second - 1) / time.Second)
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	s.SendJSON(w, http.StatusTooManyRequests, models.APIResponse{
+		Success: false,
+		Message: fmt.Sprintf("Too many attempts. Please try again in %s.", retryText(seconds)),
+	})
+	return false
+}
+
+func retryText(seconds int) string {
+	if seconds == 1 {
+		return "1 second"
+	}
+	if seconds < 60 {
+		return fmt.Sprintf("%d seconds", seconds)
+	}
+	minutes := (seconds + 59) / 60
+	if minutes == 1 {
+		return "1 minute"
+	}
+	return fmt.Sprintf("%d minutes", minutes)
+}
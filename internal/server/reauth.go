@@ -0,0 +1,111 @@
+package server
+
+import (
+	"camagru/internal/auth"
+	"camagru/internal/models"
+	"fmt"
+	"net/http"
+)
+
+// reauthenticate confirms that whoever holds the session still owns the
+// account before a sensitive change. Accounts with a password give it as
+// password. Accounts created through an identity provider have none, and
+// instead sign in there again through HandleOIDCReauth, which hands them a
+// single-use reauth_token.
+func (s *Server) reauthenticate(r *http.Request, user *models.User, password string) bool {
+	if user.PasswordHash != "" {
+		ok, _ := auth.CheckPassword(password, user.PasswordHash)
+		return password != "" && ok
+	}
+
+	token := r.FormValue("reauth_token")
+	userID, ok := s.reauths.lookup(token)
+	if !ok || userID != user.ID {
+		return false
+	}
+	s.reauths.finish(token)
+	return true
+}
+
+// sendReauthRequired answers a request that failed reauthenticate with
+// message, or, for accounts without a password, with how to confirm
+// through the identity provider instead.
+func (s *Server) sendReauthRequired(w http.ResponseWriter, user *models.User, message string) {
+	if user.PasswordHash != "" {
+		s.SendJSON(w, http.StatusUnauthorized, models.APIResponse{
+			Success: false,
+			Message: message,
+		})
+		return
+	}
+	if s.OIDC == nil {
+		s.SendJSON(w, http.StatusUnauthorized, models.APIResponse{
+			Success: false,
+			Message: "Your account has no password. Set one with \"Forgot your password?\" on the login page first.",
+		})
+		return
+	}
+	s.SendJSON(w, http.StatusUnauthorized, models.APIResponse{
+		Success: false,
+		Message: fmt.Sprintf("Confirm it is you by signing in with %s again", s.OIDCName),
+		Data:    map[string]interface{}{"reauth_url": "/login/oidc/reauth"},
+	})
+}
+
+// HandleOIDCReauth sends a signed-in user without a password back to the
+// identity provider, which must make them sign in again. The callback
+// returns them to their profile with a reauth token.
+func (s *Server) HandleOIDCReauth(w http.ResponseWriter, r *http.Request) {
+	if s.OIDC == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := s.GetCurrentUser(r)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+	if user.OIDCSubject == "" {
+		http.Redirect(w, r, "/user?reauth_error=1", http.StatusFound)
+		return
+	}
+
+	req, err := s.OIDC.ReauthCodeURL(r.Context())
+	if err != nil {
+		fmt.Printf("OIDC reauthentication failed: %v\n", err)
+		http.Redirect(w, r, "/user?reauth_error=1", http.StatusFound)
+		return
+	}
+	s.oidcLogins.start(req, user.ID)
+	setOIDCStateCookie(w, req.State)
+	http.Redirect(w, r, req.URL, http.StatusFound)
+}
+
+// finishOIDCReauth completes HandleOIDCReauth, once the provider has
+// vouched for a fresh sign-in as subject. The session cookie is SameSite
+// Strict, so it does not come along on the provider's cross-site redirect;
+// the user is the one who started the sign-in, which the state cookie ties
+// to this browser. The reauth token still only works with their session.
+func (s *Server) finishOIDCReauth(w http.ResponseWriter, r *http.Request, userID int, subject string) {
+	fail := func() {
+		http.Redirect(w, r, "/user?reauth_error=1", http.StatusFound)
+	}
+
+	// The provider must have signed in the account's own identity.
+	user, err := s.DB.GetUserByID(userID)
+	if err != nil || user.Suspended || user.OIDCSubject == "" || user.OIDCSubject != subject {
+		fail()
+		return
+	}
+	token, err := s.reauths.start(user.ID)
+	if err != nil {
+		fail()
+		return
+	}
+	http.Redirect(w, r, "/user?reauth="+token, http.StatusFound)
+}
@@ -1,16 +1,35 @@
 package server
 
 import (
+	"camagru/internal/auth"
+	"camagru/internal/models"
 	"net/http"
 )
 
-func (s *Server) SetupRoutes(mux *http.ServeMux) {
-	uploadsFS := http.FileServer(http.Dir("./data/uploads"))
-	mux.Handle("/static/uploads/", http.StripPrefix("/static/uploads/", uploadsFS))
+// csrfMux applies auth.CSRFMiddleware to every handler registered on it.
+type csrfMux struct {
+	*http.ServeMux
+}
+
+func (m csrfMux) HandleFunc(pattern string, handler http.HandlerFunc) {
+	m.ServeMux.HandleFunc(pattern, auth.CSRFMiddleware(handler))
+}
+
+func (s *Server) SetupRoutes(serveMux *http.ServeMux) {
+	serveMux.HandleFunc(uploadsURLPrefix, s.HandleUpload)
 	fs := http.FileServer(http.Dir("./web/static"))
-	mux.Handle("/static/", http.StripPrefix("/static/", fs))
+	serveMux.Handle("/static/", http.StripPrefix("/static/", fs))
+
+	mux := csrfMux{serveMux}
 	mux.HandleFunc("/", s.HandleHome)
 	mux.HandleFunc("/login", s.HandleLoginPage)
+	mux.HandleFunc("/login/2fa", s.HandleLoginTwoFactor)
+	mux.HandleFunc("/login/magic", s.HandleMagicLinkRequest)
+	mux.HandleFunc("/login/magic/verify", s.HandleMagicLinkLogin)
+	mux.HandleFunc("/login/oidc", s.HandleOIDCLogin)
+	mux.HandleFunc("/login/oidc/callback", s.HandleOIDCCallback)
+	mux.HandleFunc("/login/oidc/reauth", s.RequireAuth(s.HandleOIDCReauth))
+	mux.HandleFunc("/api/login-options", s.HandleLoginOptions)
 	mux.HandleFunc("/register", s.HandleRegisterPage)
 	mux.HandleFunc("/gallery", s.HandleGalleryPage)
 	mux.HandleFunc("/editor", s.RequireAuth(s.HandleEditorPage))
@@ -19,17 +38,42 @@ func (s *Server) SetupRoutes(mux *http.ServeMux) {
 	mux.HandleFunc("/forgot-password", s.HandleForgotPasswordPage)
 	mux.HandleFunc("/unauthorized", s.HandleUnauthorizedPage)
 	mux.HandleFunc("/api/current-user", s.HandleCurrentUser)
+	mux.HandleFunc("/api/csrf-token", s.HandleCSRFToken)
 	mux.HandleFunc("/api/assets", s.HandleAssets)
-	mux.HandleFunc("/api/compose", s.RequireAuth(s.HandleCompose))
+	mux.HandleFunc("/api/compose", s.RequireAuth(s.HandleCompose, scopeCompose))
 	mux.HandleFunc("/api/gallery", s.HandleGallery)
-	mux.HandleFunc("/api/gallery/like", s.RequireAuth(s.HandleLike))
-	mux.HandleFunc("/api/gallery/comment", s.RequireAuth(s.HandleComment))
-	mux.HandleFunc("/api/gallery/delete", s.RequireAuth(s.HandleDeleteImage))
-	mux.HandleFunc("/api/user/images", s.RequireAuth(s.HandleUserImages))
+	mux.HandleFunc("/api/gallery/like", s.RequireAuth(s.HandleLike, scopeGalleryWrite))
+	mux.HandleFunc("/api/gallery/comment", s.RequireAuth(s.HandleComment, scopeGalleryWrite))
+	mux.HandleFunc("/api/gallery/delete", s.RequireAuth(s.HandleDeleteImage, scopeGalleryWrite))
+	mux.HandleFunc("/api/user/images", s.RequireAuth(s.HandleUserImages, scopeRead))
 	mux.HandleFunc("/api/user/update", s.RequireAuth(s.HandleUpdateUser))
 	mux.HandleFunc("/api/user/preferences", s.RequireAuth(s.HandleUserPreferences))
+	mux.HandleFunc("/api/user/sessions", s.RequireAuth(s.HandleSessions))
+	mux.HandleFunc("/api/user/sessions/revoke", s.RequireAuth(s.HandleRevokeSession))
+	mux.HandleFunc("/api/user/2fa", s.RequireAuth(s.HandleTwoFactor))
+	mux.HandleFunc("/api/user/2fa/setup", s.RequireAuth(s.HandleTwoFactorSetup))
+	mux.HandleFunc("/api/user/2fa/enable", s.RequireAuth(s.HandleTwoFactorEnable))
+	mux.HandleFunc("/api/user/2fa/disable", s.RequireAuth(s.HandleTwoFactorDisable))
+	mux.HandleFunc("/api/user/2fa/recovery-codes", s.RequireAuth(s.HandleRecoveryCodes))
+	mux.HandleFunc("/api/user/tokens", s.RequireAuth(s.HandleAPITokens))
+	mux.HandleFunc("/api/user/tokens/revoke", s.RequireAuth(s.HandleRevokeAPIToken))
+	mux.HandleFunc("/api/user/invites", s.RequireAuth(s.HandleInvites))
+	mux.HandleFunc("/api/user/invites/revoke", s.RequireAuth(s.HandleRevokeInvite))
+	mux.HandleFunc("/api/user/delete", s.RequireAuth(s.HandleDeleteAccount))
+	mux.HandleFunc("/api/user/export", s.RequireAuth(s.HandleExport))
+	mux.HandleFunc("/api/user/export/download", s.RequireAuth(s.HandleExportDownload))
+	mux.HandleFunc("/api/admin/users", s.RequireRole(models.RoleModerator, s.HandleAdminUsers))
+	mux.HandleFunc("/api/admin/users/verify", s.RequireRole(models.RoleAdmin, s.HandleAdminVerifyUser))
+	mux.HandleFunc("/api/admin/users/suspend", s.RequireRole(models.RoleAdmin, s.HandleAdminSuspendUser))
+	mux.HandleFunc("/api/admin/users/role", s.RequireRole(models.RoleAdmin, s.HandleAdminSetRole))
+	mux.HandleFunc("/api/admin/images/delete", s.RequireRole(models.RoleModerator, s.HandleAdminDeleteImage))
+	mux.HandleFunc("/api/admin/comments/delete", s.RequireRole(models.RoleModerator, s.HandleAdminDeleteComment))
+	mux.HandleFunc("/api/admin/invites", s.RequireRole(models.RoleAdmin, s.HandleAdminInvites))
+	mux.HandleFunc("/api/admin/stats", s.RequireRole(models.RoleAdmin, s.HandleAdminStats))
 	mux.HandleFunc("/logout", s.HandleLogout)
 	mux.HandleFunc("/verify", s.HandleVerify)
+	mux.HandleFunc("/confirm-email", s.HandleConfirmEmail)
+	mux.HandleFunc("/undo-email", s.HandleUndoEmail)
 	mux.HandleFunc("/reset-password", s.HandleResetPassword)
 	mux.HandleFunc("/resend-verification", s.HandleResendVerification)
 }
@@ -1,15 +1,42 @@
 package server
 
 import (
+	"camagru/internal/blob"
 	"camagru/internal/database"
 	"camagru/internal/models"
+	"camagru/internal/oidc"
 	"encoding/json"
 	"net/http"
 	"strings"
+	"sync"
 )
 
 type Server struct {
-	DB *database.Storage
+	DB    database.Store
+	Blobs blob.Store
+	// OIDC, when set, offers sign-in through an identity provider, shown
+	// on the login page as OIDCName.
+	OIDC     *oidc.Provider
+	OIDCName string
+	// Registration is who may create an account: RegistrationOpen, the
+	// default, RegistrationInvite or RegistrationClosed. EmailDomains, when
+	// not empty, limits the addresses accounts may use to those domains.
+	Registration string
+	EmailDomains []string
+	// ExportDir is where takeout archives are built and kept until they
+	// expire.
+	ExportDir string
+
+	// blobsMu orders saving images against deleting their blobs.
+	blobsMu sync.Mutex
+
+	exports    exportJobs
+	limits     rateLimits
+	challenges loginChallenges
+	oidcLogins oidcLogins
+	// reauths are users without a password who have just signed in at
+	// the identity provider again, by reauth token.
+	reauths loginChallenges
 }
 
 func (s *Server) SendJSON(w http.ResponseWriter, status int, resp models.APIResponse) {
@@ -19,21 +46,23 @@ func (s *Server) SendJSON(w http.ResponseWriter, status int, resp models.APIResp
 }
 
 func (s *Server) GetCurrentUser(r *http.Request) (*models.User, error) {
-	cookie, err := r.Cookie("session")
-	if err != nil {
-		return nil, err
-	}
-
-	user, err := s.DB.GetUserBySessionToken(cookie.Value)
-	if err != nil {
-		return nil, err
+	if user, ok := r.Context().Value(userContextKey).(*models.User); ok {
+		return user, nil
 	}
-
-	return user, nil
+	user, _, err := s.currentSession(r)
+	return user, err
 }
 
-func (s *Server) RequireAuth(next http.HandlerFunc) http.HandlerFunc {
+// RequireAuth lets through signed-in, verified users. Requests may instead
+// carry a personal access token in an Authorization: Bearer header, but
+// only on routes that list the scopes such a token needs.
+func (s *Server) RequireAuth(next http.HandlerFunc, scopes ...string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		if token, ok := bearerToken(r); ok {
+			s.requireAPIToken(w, r, token, scopes, next)
+			return
+		}
+
 		user, err := s.GetCurrentUser(r)
 		if err != nil || user == nil || !user.Verified {
 			if r.URL.Path == "/editor" {
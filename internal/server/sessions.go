@@ -0,0 +1,213 @@
+package server
+
+import (
+	"camagru/internal/auth"
+	"camagru/internal/models"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// sessionMaxAge is how long a session lasts after sign-in, however
+	// active it is. It matches the cookie lifetime.
+	sessionMaxAge = 7 * 24 * time.Hour
+	// sessionIdleTimeout ends sessions that have not been used for a while.
+	sessionIdleTimeout = 48 * time.Hour
+	// sessionTouchInterval limits how often last-seen is written back.
+	sessionTouchInterval = time.Minute
+)
+
+var (
+	errSessionExpired = errors.New("session expired")
+	errSuspended      = errors.New("account suspended")
+)
+
+// currentSession resolves the session cookie to its session and user,
+// enforcing idle and absolute expiry. Expired sessions are deleted, and
+// suspended users are turned away.
+func (s *Server) currentSession(r *http.Request) (*models.User, *models.Session, error) {
+	cookie, err := r.Cookie("session")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	session, err := s.DB.GetSessionByToken(cookie.Value)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	if now.Sub(session.CreatedAt) > sessionMaxAge || now.Sub(session.LastSeen) > sessionIdleTimeout {
+		s.DB.DeleteSession(session.ID)
+		return nil, nil, errSessionExpired
+	}
+
+	user, err := s.DB.GetUserByID(session.UserID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if user.Suspended {
+		return nil, nil, errSuspended
+	}
+
+	if now.Sub(session.LastSeen) > sessionTouchInterval {
+		if err := s.DB.TouchSession(session.ID, now); err == nil {
+			session.LastSeen = now
+		}
+	}
+
+	return user, session, nil
+}
+
+// startSession signs the user in on this device and sets the session
+// cookie. Expired sessions of all users are cleared out on the way.
+func (s *Server) startSession(w http.ResponseWriter, r *http.Request, userID int) error {
+	token, err := auth.GenerateToken()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	s.DB.DeleteExpiredSessions(now.Add(-sessionMaxAge), now.Add(-sessionIdleTimeout))
+	if _, err := s.DB.CreateSession(userID, token, r.UserAgent(), clientIP(r)); err != nil {
+		return err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     "session",
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+		MaxAge:   int(sessionMaxAge.Seconds()),
+	})
+	return nil
+}
+
+func clearSessionCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     "session",
+		Value:    "",
+		Path:     "/",
+		HttpOnly: true,
+		MaxAge:   -1,
+	})
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func (s *Server) HandleSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, current, err := s.currentSession(r)
+	if err != nil {
+		s.SendJSON(w, http.StatusUnauthorized, models.APIResponse{
+			Success: false,
+			Message: "Authentication required",
+		})
+		return
+	}
+
+	sessions, err := s.DB.GetUserSessions(user.ID)
+	if err != nil {
+		s.SendJSON(w, http.StatusInternalServerError, models.APIResponse{
+			Success: false,
+			Message: "Failed to load sessions",
+		})
+		return
+	}
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == current.ID
+	}
+
+	s.SendJSON(w, http.StatusOK, models.APIResponse{
+		Success: true,
+		Data:    sessions,
+	})
+}
+
+// HandleRevokeSession signs out one session (session_id) or, with
+// all=true, every session of the user including this one.
+func (s *Server) HandleRevokeSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, current, err := s.currentSession(r)
+	if err != nil {
+		s.SendJSON(w, http.StatusUnauthorized, models.APIResponse{
+			Success: false,
+			Message: "Authentication required",
+		})
+		return
+	}
+
+	if r.FormValue("all") == "true" {
+		if err := s.DB.DeleteUserSessions(user.ID); err != nil {
+			s.SendJSON(w, http.StatusInternalServerError, models.APIResponse{
+				Success: false,
+				Message: "Failed to revoke sessions",
+			})
+			return
+		}
+		clearSessionCookie(w)
+		s.SendJSON(w, http.StatusOK, models.APIResponse{
+			Success: true,
+			Message: "Signed out everywhere",
+		})
+		return
+	}
+
+	sessionID, _ := strconv.Atoi(r.FormValue("session_id"))
+	sessions, err := s.DB.GetUserSessions(user.ID)
+	if err != nil {
+		s.SendJSON(w, http.StatusInternalServerError, models.APIResponse{
+			Success: false,
+			Message: "Failed to revoke session",
+		})
+		return
+	}
+	owned := false
+	for _, session := range sessions {
+		if session.ID == sessionID {
+			owned = true
+			break
+		}
+	}
+	if !owned {
+		s.SendJSON(w, http.StatusNotFound, models.APIResponse{
+			Success: false,
+			Message: "Session not found",
+		})
+		return
+	}
+
+	if err := s.DB.DeleteSession(sessionID); err != nil {
+		s.SendJSON(w, http.StatusInternalServerError, models.APIResponse{
+			Success: false,
+			Message: "Failed to revoke session",
+		})
+		return
+	}
+	if sessionID == current.ID {
+		clearSessionCookie(w)
+	}
+
+	s.SendJSON(w, http.StatusOK, models.APIResponse{
+		Success: true,
+		Message: "Session revoked",
+	})
+}
@@ -0,0 +1,404 @@
+package server
+
+import (
+	"camagru/internal/auth"
+	"camagru/internal/models"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	totpIssuer = "Camagru"
+	// recoveryCodeCount is how many recovery codes a user is given at a
+	// time.
+	recoveryCodeCount = 10
+	// loginChallengeTTL is how long a user has to enter their code after
+	// giving the right password.
+	loginChallengeTTL = 5 * time.Minute
+	// loginChallengeAttempts is how many wrong codes a challenge survives.
+	loginChallengeAttempts = 5
+)
+
+var errInvalidCode = errors.New("invalid code")
+
+type loginChallenge struct {
+	userID   int
+	expires  time.Time
+	attempts int
+}
+
+// loginChallenges holds sign-ins that passed the password check and are
+// waiting for a second factor, by challenge token. The zero value is ready
+// to use.
+type loginChallenges struct {
+	mu         sync.Mutex
+	challenges map[string]*loginChallenge
+}
+
+func (c *loginChallenges) start(userID int) (string, error) {
+	token, err := auth.GenerateToken()
+	if err != nil {
+		return "", err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for existing, challenge := range c.challenges {
+		if now.After(challenge.expires) {
+			delete(c.challenges, existing)
+		}
+	}
+	if c.challenges == nil {
+		c.challenges = make(map[string]*loginChallenge)
+	}
+	c.challenges[token] = &loginChallenge{userID: userID, expires: now.Add(loginChallengeTTL)}
+	return token, nil
+}
+
+func (c *loginChallenges) lookup(token string) (int, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	challenge, exists := c.challenges[token]
+	if !exists || time.Now().After(challenge.expires) {
+		return 0, false
+	}
+	return challenge.userID, true
+}
+
+// fail counts a wrong code against the challenge, dropping it once it has
+// seen too many.
+func (c *loginChallenges) fail(token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if challenge, exists := c.challenges[token]; exists {
+		challenge.attempts++
+		if challenge.attempts >= loginChallengeAttempts {
+			delete(c.challenges, token)
+		}
+	}
+}
+
+// dropUser abandons the user's pending sign-ins, for example because the
+// password they started with is no longer valid.
+func (c *loginChallenges) dropUser(userID int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for token, challenge := range c.challenges {
+		if challenge.userID == userID {
+			delete(c.challenges, token)
+		}
+	}
+}
+
+func (c *loginChallenges) finish(token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.challenges, token)
+}
+
+// checkSecondFactor accepts either a current TOTP code or one of the user's
+// recovery codes, and uses it up.
+func (s *Server) checkSecondFactor(user *models.User, code string) error {
+	if user.TOTPSecret == "" || code == "" {
+		return errInvalidCode
+	}
+	if step, ok := auth.ValidateTOTP(user.TOTPSecret, code, time.Now()); ok {
+		if err := s.DB.UseTOTPStep(user.ID, step); err != nil {
+			return errInvalidCode
+		}
+		return nil
+	}
+	if err := s.DB.UseRecoveryCode(user.ID, auth.NormalizeRecoveryCode(code)); err != nil {
+		return errInvalidCode
+	}
+	return nil
+}
+
+// HandleLoginTwoFactor completes a sign-in started by HandleLogin for a user
+// with two-factor authentication enabled.
+func (s *Server) HandleLoginTwoFactor(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token := r.FormValue("token")
+	userID, exists := s.challenges.lookup(token)
+	if !exists {
+		s.SendJSON(w, http.StatusUnauthorized, models.APIResponse{
+			Success: false,
+			Message: "Sign-in expired. Please enter your password again.",
+		})
+		return
+	}
+	user, err := s.DB.GetUserByID(userID)
+	if err != nil || user.Suspended {
+		s.challenges.finish(token)
+		s.SendJSON(w, http.StatusUnauthorized, models.APIResponse{
+			Success: false,
+			Message: "Sign-in expired. Please enter your password again.",
+		})
+		return
+	}
+
+	limits := s.limits.get()
+	ip := clientIP(r)
+	account := accountKey(user, "")
+	if !s.checkLimits(w, limits.loginChecks(ip, account)) {
+		return
+	}
+
+	if err := s.checkSecondFactor(user, r.FormValue("code")); err != nil {
+		s.challenges.fail(token)
+		s.recordLoginFailure(ip, account, user)
+		s.SendJSON(w, http.StatusUnauthorized, models.APIResponse{
+			Success: false,
+			Message: "Invalid code",
+		})
+		return
+	}
+	s.challenges.finish(token)
+	limits.loginSucceeded(ip, account)
+
+	if err := s.startSession(w, r, user.ID); err != nil {
+		s.SendJSON(w, http.StatusInternalServerError, models.APIResponse{
+			Success: false,
+			Message: "Failed to create session",
+		})
+		return
+	}
+
+	s.SendJSON(w, http.StatusOK, models.APIResponse{
+		Success: true,
+		Message: "Login successful",
+	})
+}
+
+func (s *Server) HandleTwoFactor(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := s.GetCurrentUser(r)
+	if err != nil {
+		s.SendJSON(w, http.StatusUnauthorized, models.APIResponse{
+			Success: false,
+			Message: "Authentication required",
+		})
+		return
+	}
+
+	s.SendJSON(w, http.StatusOK, models.APIResponse{
+		Success: true,
+		Data: map[string]interface{}{
+			"enabled":             user.TOTPSecret != "",
+			"recovery_codes_left": user.RecoveryCodesLeft,
+		},
+	})
+}
+
+// HandleTwoFactorSetup issues a new secret for the user to add to their
+// authenticator app. It only takes effect once confirmed through
+// HandleTwoFactorEnable.
+func (s *Server) HandleTwoFactorSetup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := s.GetCurrentUser(r)
+	if err != nil {
+		s.SendJSON(w, http.StatusUnauthorized, models.APIResponse{
+			Success: false,
+			Message: "Authentication required",
+		})
+		return
+	}
+
+	if user.TOTPSecret != "" {
+		s.SendJSON(w, http.StatusBadRequest, models.APIResponse{
+			Success: false,
+			Message: "Two-factor authentication is already enabled",
+		})
+		return
+	}
+
+	secret, err := auth.GenerateTOTPSecret()
+	if err == nil {
+		err = s.DB.SetPendingTOTPSecret(user.ID, secret)
+	}
+	if err != nil {
+		s.SendJSON(w, http.StatusInternalServerError, models.APIResponse{
+			Success: false,
+			Message: "Failed to start two-factor setup",
+		})
+		return
+	}
+
+	s.SendJSON(w, http.StatusOK, models.APIResponse{
+		Success: true,
+		Data: map[string]interface{}{
+			"secret": secret,
+			"uri":    auth.TOTPURI(totpIssuer, user.Username, secret),
+		},
+	})
+}
+
+// HandleTwoFactorEnable turns on two-factor authentication once the user
+// confirms the pending secret with a code and proves they own the account.
+func (s *Server) HandleTwoFactorEnable(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := s.GetCurrentUser(r)
+	if err != nil {
+		s.SendJSON(w, http.StatusUnauthorized, models.APIResponse{
+			Success: false,
+			Message: "Authentication required",
+		})
+		return
+	}
+
+	if user.TOTPPendingSecret == "" {
+		s.SendJSON(w, http.StatusBadRequest, models.APIResponse{
+			Success: false,
+			Message: "Start two-factor setup first",
+		})
+		return
+	}
+	// Otherwise a stolen session could enrol the thief's authenticator
+	// and lock the owner out.
+	if !s.reauthenticate(r, user, r.FormValue("password")) {
+		s.sendReauthRequired(w, user, "Incorrect password")
+		return
+	}
+
+	step, ok := auth.ValidateTOTP(user.TOTPPendingSecret, r.FormValue("code"), time.Now())
+	if !ok {
+		s.SendJSON(w, http.StatusBadRequest, models.APIResponse{
+			Success: false,
+			Message: "Invalid code",
+		})
+		return
+	}
+
+	codes, err := auth.GenerateRecoveryCodes(recoveryCodeCount)
+	if err == nil {
+		err = s.DB.EnableTOTP(user.ID, step, codes)
+	}
+	if err != nil {
+		s.SendJSON(w, http.StatusInternalServerError, models.APIResponse{
+			Success: false,
+			Message: "Failed to enable two-factor authentication",
+		})
+		return
+	}
+
+	s.SendJSON(w, http.StatusOK, models.APIResponse{
+		Success: true,
+		Message: "Two-factor authentication enabled",
+		Data:    map[string]interface{}{"recovery_codes": codes},
+	})
+}
+
+func (s *Server) HandleTwoFactorDisable(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := s.GetCurrentUser(r)
+	if err != nil {
+		s.SendJSON(w, http.StatusUnauthorized, models.APIResponse{
+			Success: false,
+			Message: "Authentication required",
+		})
+		return
+	}
+
+	if user.TOTPSecret == "" {
+		s.SendJSON(w, http.StatusBadRequest, models.APIResponse{
+			Success: false,
+			Message: "Two-factor authentication is not enabled",
+		})
+		return
+	}
+
+	if !s.reauthenticate(r, user, r.FormValue("password")) {
+		s.sendReauthRequired(w, user, "Incorrect password")
+		return
+	}
+	if err := s.checkSecondFactor(user, r.FormValue("code")); err != nil {
+		s.SendJSON(w, http.StatusUnauthorized, models.APIResponse{
+			Success: false,
+			Message: "Invalid code",
+		})
+		return
+	}
+
+	if err := s.DB.DisableTOTP(user.ID); err != nil {
+		s.SendJSON(w, http.StatusInternalServerError, models.APIResponse{
+			Success: false,
+			Message: "Failed to disable two-factor authentication",
+		})
+		return
+	}
+
+	s.SendJSON(w, http.StatusOK, models.APIResponse{
+		Success: true,
+		Message: "Two-factor authentication disabled",
+	})
+}
+
+// HandleRecoveryCodes replaces the user's recovery codes with a fresh set.
+func (s *Server) HandleRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := s.GetCurrentUser(r)
+	if err != nil {
+		s.SendJSON(w, http.StatusUnauthorized, models.APIResponse{
+			Success: false,
+			Message: "Authentication required",
+		})
+		return
+	}
+
+	if err := s.checkSecondFactor(user, r.FormValue("code")); err != nil {
+		s.SendJSON(w, http.StatusUnauthorized, models.APIResponse{
+			Success: false,
+			Message: "Invalid code",
+		})
+		return
+	}
+
+	codes, err := auth.GenerateRecoveryCodes(recoveryCodeCount)
+	if err == nil {
+		err = s.DB.SetRecoveryCodes(user.ID, codes)
+	}
+	if err != nil {
+		s.SendJSON(w, http.StatusInternalServerError, models.APIResponse{
+			Success: false,
+			Message: "Failed to generate recovery codes",
+		})
+		return
+	}
+
+	s.SendJSON(w, http.StatusOK, models.APIResponse{
+		Success: true,
+		Data:    map[string]interface{}{"recovery_codes": codes},
+	})
+}
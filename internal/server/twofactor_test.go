@@ -0,0 +1,86 @@
+package server
+
+import (
+	"camagru/internal/auth"
+	"camagru/internal/database"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// passwordSession creates a verified account with password and signs it
+// in.
+func passwordSession(t *testing.T, s *Server, db *database.Storage, username, password string) (int, *http.Cookie) {
+	t.Helper()
+	hash, err := auth.HashPassword(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userID, err := db.CreateUser(username, username+"@example.com", hash, "", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.MarkUserVerified(userID)
+
+	rec := httptest.NewRecorder()
+	if err := s.startSession(rec, httptest.NewRequest("GET", "/", nil), userID); err != nil {
+		t.Fatal(err)
+	}
+	return userID, cookieNamed(rec, "session")
+}
+
+func TestEnableTwoFactorNeedsPassword(t *testing.T) {
+	db := database.NewMemoryStorage()
+	db.InitDB()
+	s := &Server{DB: db}
+	userID, session := passwordSession(t, s, db, "alice", "correct horse")
+
+	if code, resp := postForm(s.HandleTwoFactorSetup, nil, session); code != http.StatusOK {
+		t.Fatalf("setup: %d %+v", code, resp)
+	}
+	user, _ := db.GetUserByID(userID)
+	totp, _ := auth.TOTPCode(user.TOTPPendingSecret, auth.TOTPStep(time.Now()))
+
+	for _, password := range []string{"", "wrong password"} {
+		form := url.Values{"code": {totp}, "password": {password}}
+		if code, _ := postForm(s.HandleTwoFactorEnable, form, session); code != http.StatusUnauthorized {
+			t.Fatalf("password %q: status %d", password, code)
+		}
+	}
+
+	form := url.Values{"code": {totp}, "password": {"correct horse"}}
+	if code, resp := postForm(s.HandleTwoFactorEnable, form, session); code != http.StatusOK {
+		t.Fatalf("correct password: %d %+v", code, resp)
+	}
+	if user, _ := db.GetUserByID(userID); user.TOTPSecret == "" {
+		t.Fatal("two-factor authentication not enabled")
+	}
+}
+
+func TestDeleteAccountDropsLoginChallenges(t *testing.T) {
+	db := database.NewMemoryStorage()
+	db.InitDB()
+	s := &Server{DB: db}
+	userID, session := passwordSession(t, s, db, "alice", "correct horse")
+	challenge, err := s.challenges.start(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reauth, err := s.reauths.start(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	form := url.Values{"password": {"correct horse"}}
+	if code, resp := postForm(s.HandleDeleteAccount, form, session); code != http.StatusOK {
+		t.Fatalf("delete: %d %+v", code, resp)
+	}
+	if _, ok := s.challenges.lookup(challenge); ok {
+		t.Fatal("two-factor challenge outlived the account")
+	}
+	if _, ok := s.reauths.lookup(reauth); ok {
+		t.Fatal("reauth token outlived the account")
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// lockDataDir only makes sure the data directory exists. There is no flock
+// here, so nothing stops a command from running against the data directory
+// of a live server; stop the server first.
+func lockDataDir() error {
+	return os.MkdirAll(dataDir, 0755)
+}
@@ -0,0 +1,38 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// dataLock is held for as long as the process runs. See lockDataDir.
+var dataLock *os.File
+
+// lockDataDir takes an exclusive lock on the data directory, so that a
+// command cannot rewrite the files underneath a running server, nor two
+// commands each other's. The kernel releases it when the process exits.
+func lockDataDir() error {
+	if dataLock != nil {
+		return nil
+	}
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(dataDir, ".lock"), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return fmt.Errorf("%s is in use by another process; stop the server first", dataDir)
+		}
+		return err
+	}
+	dataLock = f
+	return nil
+}
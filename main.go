@@ -1,26 +1,80 @@
 package main
 
 import (
+	"camagru/internal/auth"
+	"camagru/internal/blob"
 	"camagru/internal/config"
 	"camagru/internal/database"
+	"camagru/internal/oidc"
 	"camagru/internal/server"
 	"fmt"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 )
 
+const dataDir = "./data"
+
 func main() {
 	config.LoadEnv(".env")
-	storage, err := database.NewStorage("./data")
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:]))
+	}
+	storage, err := openStorage()
 	if err != nil {
+		fmt.Printf("Storage error: %v\n", err)
 		os.Exit(1)
 	}
 	if err := storage.InitDB(); err != nil {
+		fmt.Printf("Storage error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := configurePasswords(); err != nil {
+		fmt.Printf("Password hashing error: %v\n", err)
+		os.Exit(1)
+	}
+	blobs, err := openBlobStore()
+	if err != nil {
+		fmt.Printf("Blob store error: %v\n", err)
+		os.Exit(1)
+	}
+	go backupOnSignal(storage)
+	purgeDays, err := envInt("UNVERIFIED_PURGE_DAYS", 0, 0, 3650)
+	if err != nil {
+		fmt.Printf("Configuration error: %v\n", err)
+		os.Exit(1)
+	}
+	if purgeDays > 0 {
+		go purgeUnverified(storage, time.Duration(purgeDays)*24*time.Hour)
+	}
+	registration, domains, err := registrationPolicy()
+	if err != nil {
+		fmt.Printf("Configuration error: %v\n", err)
 		os.Exit(1)
 	}
 	srv := &server.Server{
-		DB: storage,
+		DB:           storage,
+		Blobs:        blobs,
+		Registration: registration,
+		EmailDomains: domains,
+		ExportDir:    filepath.Join(dataDir, "exports"),
+	}
+	if os.Getenv("OIDC_ISSUER") != "" {
+		provider, err := openOIDC()
+		if err != nil {
+			fmt.Printf("OIDC error: %v\n", err)
+			os.Exit(1)
+		}
+		srv.OIDC = provider
+		srv.OIDCName = os.Getenv("OIDC_NAME")
+		if srv.OIDCName == "" {
+			srv.OIDCName = "Single Sign-On"
+		}
 	}
+	go purgeExports(srv)
 	mux := http.NewServeMux()
 	srv.SetupRoutes(mux)
 	handler := addMiddleware(mux)
@@ -35,15 +89,148 @@ func main() {
 	}
 }
 
+func openStorage() (*database.Storage, error) {
+	if err := lockDataDir(); err != nil {
+		return nil, err
+	}
+	switch os.Getenv("STORAGE_BACKEND") {
+	case "journal":
+		storage, err := database.NewJournalStorage(dataDir)
+		if err == nil && storage.ConvertedFromFiles() {
+			fmt.Printf("Migrated JSON collections in %s to the journal\n", dataDir)
+		}
+		return storage, err
+	default:
+		return database.NewStorage(dataDir)
+	}
+}
+
+func openBlobStore() (blob.Store, error) {
+	switch os.Getenv("BLOB_BACKEND") {
+	case "s3":
+		return blob.NewS3Store(blob.S3Config{
+			Endpoint:  os.Getenv("S3_ENDPOINT"),
+			Region:    os.Getenv("S3_REGION"),
+			Bucket:    os.Getenv("S3_BUCKET"),
+			AccessKey: os.Getenv("S3_ACCESS_KEY"),
+			SecretKey: os.Getenv("S3_SECRET_KEY"),
+		}, "/static/uploads/")
+	default:
+		return blob.NewLocalStore(dataDir+"/uploads", "/static/uploads/")
+	}
+}
+
+// configurePasswords applies the PASSWORD_HASH, ARGON2_*, BCRYPT_COST and
+// PASSWORD_PEPPER settings. Unset values keep their defaults.
+func configurePasswords() error {
+	config := auth.DefaultPasswordConfig
+	if algorithm := os.Getenv("PASSWORD_HASH"); algorithm != "" {
+		config.Algorithm = algorithm
+	}
+	config.Pepper = os.Getenv("PASSWORD_PEPPER")
+
+	memory, err := envInt("ARGON2_MEMORY", int(config.Argon2Memory), 1, 1<<22)
+	if err != nil {
+		return err
+	}
+	passes, err := envInt("ARGON2_TIME", int(config.Argon2Time), 1, 100)
+	if err != nil {
+		return err
+	}
+	threads, err := envInt("ARGON2_THREADS", int(config.Argon2Threads), 1, 255)
+	if err != nil {
+		return err
+	}
+	cost, err := envInt("BCRYPT_COST", config.BcryptCost, 1, 31)
+	if err != nil {
+		return err
+	}
+	config.Argon2Memory = uint32(memory)
+	config.Argon2Time = uint32(passes)
+	config.Argon2Threads = uint8(threads)
+	config.BcryptCost = cost
+
+	return auth.SetPasswordConfig(config)
+}
+
+// envInt reads a number between min and max from the environment, or def
+// if the variable is unset.
+func envInt(name string, def, min, max int) (int, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < min || n > max {
+		return 0, fmt.Errorf("%s must be a number between %d and %d", name, min, max)
+	}
+	return n, nil
+}
+
+// purgeUnverified deletes accounts left unverified for longer than after,
+// once at startup and then every hour, so that abandoned sign-ups do not
+// hold on to their username and email address.
+func purgeUnverified(storage *database.Storage, after time.Duration) {
+	for {
+		purged, err := storage.PurgeUnverifiedUsers(time.Now().Add(-after))
+		if err != nil {
+			fmt.Printf("Purging unverified accounts failed: %v\n", err)
+		} else if purged > 0 {
+			fmt.Printf("Purged %d unverified account(s)\n", purged)
+		}
+		time.Sleep(time.Hour)
+	}
+}
+
+// purgeExports deletes expired takeout archives every hour, so that they
+// do not wait on disk for the next export request to clean them up.
+func purgeExports(srv *server.Server) {
+	for {
+		srv.PurgeExports()
+		time.Sleep(time.Hour)
+	}
+}
+
+// registrationPolicy reads REGISTRATION_MODE and the comma-separated
+// EMAIL_DOMAINS allow-list.
+func registrationPolicy() (string, []string, error) {
+	mode := strings.ToLower(strings.TrimSpace(os.Getenv("REGISTRATION_MODE")))
+	switch mode {
+	case "":
+		mode = server.RegistrationOpen
+	case server.RegistrationOpen, server.RegistrationInvite, server.RegistrationClosed:
+	default:
+		return "", nil, fmt.Errorf("REGISTRATION_MODE must be open, invite or closed, not %q", mode)
+	}
+
+	var domains []string
+	for _, domain := range strings.Split(os.Getenv("EMAIL_DOMAINS"), ",") {
+		domain = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(domain), "@"))
+		if domain != "" {
+			domains = append(domains, domain)
+		}
+	}
+	return mode, domains, nil
+}
+
+func openOIDC() (*oidc.Provider, error) {
+	redirectURL := os.Getenv("OIDC_REDIRECT_URL")
+	if redirectURL == "" {
+		redirectURL = "http://localhost:8080/login/oidc/callback"
+	}
+	return oidc.NewProvider(oidc.Config{
+		Issuer:       os.Getenv("OIDC_ISSUER"),
+		ClientID:     os.Getenv("OIDC_CLIENT_ID"),
+		ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+		RedirectURL:  redirectURL,
+		Scopes:       strings.Fields(os.Getenv("OIDC_SCOPES")),
+	})
+}
+
 func addMiddleware(handler http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Cookie")
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(http.StatusOK)
-			return
-		}
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("X-Frame-Options", "DENY")
 		handler.ServeHTTP(w, r)
 	})
 }
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "camagru/internal/database"
+
+// backupOnSignal does nothing where there is no SIGUSR1; run the backup
+// command against a stopped server instead.
+func backupOnSignal(storage *database.Storage) {}
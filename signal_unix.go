@@ -0,0 +1,27 @@
+//go:build unix
+
+package main
+
+import (
+	"camagru/internal/database"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// backupOnSignal writes a backup from the running server whenever the
+// process receives SIGUSR1, so an instance can be backed up without
+// stopping it.
+func backupOnSignal(storage *database.Storage) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	for range signals {
+		path, err := writeBackup(storage, "")
+		if err != nil {
+			fmt.Printf("Backup failed: %v\n", err)
+			continue
+		}
+		fmt.Printf("Backup written to %s\n", path)
+	}
+}
@@ -0,0 +1,37 @@
+// Adds the CSRF token to every state-changing request made with fetch.
+// Load this before any other script on the page.
+(() => {
+  const originalFetch = window.fetch.bind(window);
+  let tokenPromise = null;
+
+  const getToken = (refresh = false) => {
+    if (!tokenPromise || refresh) {
+      tokenPromise = originalFetch('/api/csrf-token', { credentials: 'same-origin' })
+        .then(res => res.json())
+        .then(data => (data.success && data.data ? data.data.token : ''))
+        .catch(() => '');
+    }
+    return tokenPromise;
+  };
+
+  window.fetch = async (input, init = {}) => {
+    const method = (init.method || 'GET').toUpperCase();
+    if (method === 'GET' || method === 'HEAD') {
+      return originalFetch(input, init);
+    }
+
+    const send = async (refresh) => {
+      const headers = new Headers(init.headers || {});
+      headers.set('X-CSRF-Token', await getToken(refresh));
+      return originalFetch(input, { ...init, headers });
+    };
+
+    const res = await send(false);
+    // The token is tied to the session and to the server process, so fetch
+    // a fresh one and try once more if it was rejected.
+    if (res.status === 403 && res.headers.get('X-CSRF-Invalid')) {
+      return send(true);
+    }
+    return res;
+  };
+})();
@@ -5,10 +5,11 @@ document.addEventListener('DOMContentLoaded', () => {
   const statusBar = document.getElementById('gallery-status');
   const paginationContainer = document.getElementById('pagination');
 
+  // cursors[n - 1] is the cursor that loads page n. Paging by cursor keeps
+  // pages stable while new images are being posted.
+  let cursors = [''];
   let page = 1;
   let loading = false;
-  let totalPages = 1;
-  let total = 0;
 
   const setStatus = (msg) => {
     statusBar.textContent = msg;
@@ -150,23 +151,24 @@ document.addEventListener('DOMContentLoaded', () => {
   };
 
   const loadPage = async (targetPage = 1) => {
-    if (loading || targetPage < 1) return;
+    if (loading || targetPage < 1 || targetPage > cursors.length) return;
     loading = true;
     setStatus('Loading...');
     let succeeded = false;
     try {
-      const res = await fetch(`/api/gallery?page=${targetPage}`);
+      const cursor = cursors[targetPage - 1];
+      const res = await fetch(`/api/gallery?cursor=${encodeURIComponent(cursor)}`);
       const json = await res.json();
       if (!res.ok || !json.success) throw new Error(json.message || 'Failed to fetch gallery');
       
-      // Handle response structure: {success: true, data: {items: [...], hasMore: ...}}
+      // Handle response structure: {success: true, data: {items: [...], next_cursor: ...}}
       const data = json.data || {};
       const items = data.items || json.items || [];
-      totalPages = data.totalPages || 1;
-      total = data.total || 0;
+      cursors = cursors.slice(0, targetPage);
+      if (data.next_cursor) cursors.push(data.next_cursor);
       
       renderItems(items, false);
-      emptyState.classList.toggle('hidden', items.length > 0);
+      emptyState.classList.toggle('hidden', items.length > 0 || targetPage > 1);
       page = targetPage;
       succeeded = true;
       updatePagination();
@@ -179,7 +181,8 @@ document.addEventListener('DOMContentLoaded', () => {
   };
 
   const updatePagination = () => {
-    if (!paginationContainer || totalPages <= 1) {
+    if (!paginationContainer) return;
+    if (page === 1 && cursors.length === 1) {
       paginationContainer.innerHTML = '';
       return;
     }
@@ -193,42 +196,10 @@ document.addEventListener('DOMContentLoaded', () => {
       html += `<button class="pagination-btn" disabled>Previous</button>`;
     }
 
-    // Page numbers
-    const maxVisible = 7;
-    let startPage = Math.max(1, page - Math.floor(maxVisible / 2));
-    let endPage = Math.min(totalPages, startPage + maxVisible - 1);
-    
-    if (endPage - startPage < maxVisible - 1) {
-      startPage = Math.max(1, endPage - maxVisible + 1);
-    }
-
-    // First page
-    if (startPage > 1) {
-      html += `<button class="pagination-btn" data-page="1">1</button>`;
-      if (startPage > 2) {
-        html += `<span class="pagination-ellipsis">...</span>`;
-      }
-    }
-
-    // Page range
-    for (let i = startPage; i <= endPage; i++) {
-      if (i === page) {
-        html += `<button class="pagination-btn pagination-btn-active" disabled>${i}</button>`;
-      } else {
-        html += `<button class="pagination-btn" data-page="${i}">${i}</button>`;
-      }
-    }
-
-    // Last page
-    if (endPage < totalPages) {
-      if (endPage < totalPages - 1) {
-        html += `<span class="pagination-ellipsis">...</span>`;
-      }
-      html += `<button class="pagination-btn" data-page="${totalPages}">${totalPages}</button>`;
-    }
+    html += `<button class="pagination-btn pagination-btn-active" disabled>${page}</button>`;
 
     // Next button
-    if (page < totalPages) {
+    if (page < cursors.length) {
       html += `<button class="pagination-btn" data-page="${page + 1}">Next</button>`;
     } else {
       html += `<button class="pagination-btn" disabled>Next</button>`;
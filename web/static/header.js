@@ -70,6 +70,13 @@ function renderHeader(showAuthLinks = true) {
             logoutLink.href = '/logout';
             logoutLink.className = 'a-logout';
             logoutLink.textContent = 'Logout';
+            logoutLink.addEventListener('click', (e) => {
+              e.preventDefault();
+              fetch('/logout', { method: 'POST' })
+                .finally(() => {
+                  window.location.href = '/gallery';
+                });
+            });
             logoutLi.appendChild(logoutLink);
             navLinksEl.appendChild(logoutLi);
           }
@@ -7,6 +7,7 @@ document.addEventListener('DOMContentLoaded', () => {
 
   function clearErrors() {
     usernameError.textContent = '';
+    usernameError.style.color = '';
     usernameError.classList.remove('show');
     passwordError.textContent = '';
     passwordError.classList.remove('show');
@@ -14,6 +15,170 @@ document.addEventListener('DOMContentLoaded', () => {
     password.style.borderColor = '';
   }
 
+  const params = new URLSearchParams(window.location.search);
+  if (params.get('email_changed') || params.get('email_restored')) {
+    usernameError.textContent = params.get('email_changed')
+      ? 'Your new email address is confirmed. Please log in.'
+      : 'Your previous email address is restored, every device was signed out and your API tokens were revoked. Please log in and consider resetting your password.';
+    usernameError.style.color = 'green';
+    usernameError.classList.add('show');
+  }
+  if (params.get('verification_expired')) {
+    usernameError.textContent = 'This verification link has expired. Log in to request a new one.';
+    usernameError.classList.add('show');
+  }
+
+  const oidcErrors = {
+    failed: 'Signing in with your identity provider failed. Please try again.',
+    no_email: 'Your identity provider did not share an email address.',
+    email_unverified: 'An account already uses this email address. Log in with your password instead.',
+    suspended: 'This account has been suspended.',
+    registration_closed: 'No account uses this email address, and new accounts can only be created with an invite.',
+    domain: 'Accounts cannot be created with an email address at that domain.'
+  };
+  if (params.get('oidc_error')) {
+    usernameError.textContent = oidcErrors[params.get('oidc_error')] || oidcErrors.failed;
+    usernameError.classList.add('show');
+  }
+  if (params.get('oidc_verify')) {
+    usernameError.textContent = 'Please verify your email address using the link we sent you, then sign in again.';
+    usernameError.classList.add('show');
+  }
+
+  fetch('/api/login-options')
+    .then(res => res.json())
+    .then(json => {
+      if (json.success && json.data && json.data.oidc) {
+        document.getElementById('oidcLoginLink').textContent = `Sign in with ${json.data.oidc_name}`;
+        document.getElementById('oidcLogin').style.display = '';
+      }
+    })
+    .catch(() => {});
+
+  const twoFactorForm = document.getElementById('twoFactorForm');
+  const code = document.getElementById('code');
+  const codeError = document.getElementById('codeError');
+  let challengeToken = '';
+
+  function showTwoFactor(token) {
+    challengeToken = token;
+    form.style.display = 'none';
+    twoFactorForm.style.display = '';
+    code.focus();
+  }
+
+  twoFactorForm.addEventListener('submit', (e) => {
+    e.preventDefault();
+    codeError.textContent = '';
+    codeError.classList.remove('show');
+
+    const data = new URLSearchParams();
+    data.set('token', challengeToken);
+    data.set('code', code.value.trim());
+
+    fetch('/login/2fa', {
+      method: 'POST',
+      headers: { 'Content-Type': 'application/x-www-form-urlencoded' },
+      body: data.toString()
+    })
+    .then(res => res.json())
+    .then(json => {
+      if (json.success) {
+        window.location.href = '/';
+        return;
+      }
+      codeError.textContent = json.message || 'Invalid code';
+      codeError.classList.add('show');
+      code.value = '';
+    })
+    .catch(() => {
+      codeError.textContent = 'Network error. Please try again.';
+      codeError.classList.add('show');
+    });
+  });
+
+  const magicLinkForm = document.getElementById('magicLinkForm');
+  const magicEmail = document.getElementById('magicEmail');
+  const magicError = document.getElementById('magicError');
+
+  function showMagicMessage(text, color) {
+    magicError.textContent = text;
+    magicError.style.color = color || '';
+    magicError.classList.add('show');
+  }
+
+  document.getElementById('magicLinkToggle').addEventListener('click', (e) => {
+    e.preventDefault();
+    form.style.display = 'none';
+    magicLinkForm.style.display = '';
+    magicEmail.focus();
+  });
+  document.getElementById('passwordToggle').addEventListener('click', (e) => {
+    e.preventDefault();
+    magicLinkForm.style.display = 'none';
+    form.style.display = '';
+  });
+
+  magicLinkForm.addEventListener('submit', (e) => {
+    e.preventDefault();
+    magicError.classList.remove('show');
+    if (!magicEmail.value.trim()) {
+      showMagicMessage('Email is required');
+      return;
+    }
+
+    const data = new URLSearchParams();
+    data.set('email', magicEmail.value.trim());
+    fetch('/login/magic', {
+      method: 'POST',
+      headers: { 'Content-Type': 'application/x-www-form-urlencoded' },
+      body: data.toString()
+    })
+    .then(res => res.json())
+    .then(json => {
+      showMagicMessage(json.message || 'Request failed', json.success ? 'green' : '');
+    })
+    .catch(() => {
+      showMagicMessage('Network error. Please try again.');
+    });
+  });
+
+  // Identity provider sign-ins that still need a code land here
+  if (params.get('two_factor')) {
+    showTwoFactor(params.get('two_factor'));
+    history.replaceState(null, '', '/login');
+  }
+
+  // Sign-in links land here; the token is only used once posted back
+  const magicToken = params.get('magic_token');
+  if (magicToken) {
+    history.replaceState(null, '', '/login');
+    const data = new URLSearchParams();
+    data.set('token', magicToken);
+    fetch('/login/magic/verify', {
+      method: 'POST',
+      headers: { 'Content-Type': 'application/x-www-form-urlencoded' },
+      body: data.toString()
+    })
+    .then(res => res.json())
+    .then(json => {
+      if (json.success && json.data && json.data.two_factor_required) {
+        showTwoFactor(json.data.token);
+        return;
+      }
+      if (json.success) {
+        window.location.href = '/';
+        return;
+      }
+      usernameError.textContent = json.message || 'Sign-in failed';
+      usernameError.classList.add('show');
+    })
+    .catch(() => {
+      usernameError.textContent = 'Network error. Please try again.';
+      usernameError.classList.add('show');
+    });
+  }
+
   form.addEventListener('submit', (e) => {
     e.preventDefault();
     clearErrors();
@@ -46,12 +211,16 @@ document.addEventListener('DOMContentLoaded', () => {
       const text = await res.text();
       let json = { success: false, message: 'Invalid response' };
       try { json = JSON.parse(text); } catch {}
+      if (res.ok && json.success && json.data && json.data.two_factor_required) {
+        showTwoFactor(json.data.token);
+        return;
+      }
       if (res.ok && json.success) {
         window.location.href = '/';
         return;
       }
       // Handle 403 (not verified): offer resend
-      if (res.status === 403) {
+      if (res.status === 403 && json.data && json.data.verification_required) {
         const msg = 'Not verified yet. Want me to resend verification?';
         passwordError.textContent = msg;
         passwordError.classList.add('show');
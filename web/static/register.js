@@ -4,6 +4,29 @@ document.addEventListener('DOMContentLoaded', function() {
     const email = document.getElementById('email');
     const password = document.getElementById('password');
     const confirmPassword = document.getElementById('confirmPassword');
+    const invite = document.getElementById('invite');
+    const inviteGroup = document.getElementById('inviteGroup');
+
+    const params = new URLSearchParams(window.location.search);
+    if (params.get('invite')) {
+        invite.value = params.get('invite');
+    }
+
+    fetch('/api/login-options')
+        .then(response => response.json())
+        .then(data => {
+            if (!data.success || !data.data) {
+                return;
+            }
+            if (data.data.registration === 'invite') {
+                inviteGroup.style.display = '';
+                invite.required = true;
+            } else if (data.data.registration === 'closed') {
+                form.querySelectorAll('input, button').forEach(el => el.disabled = true);
+                showGenericError('Registration is closed.');
+            }
+        })
+        .catch(() => {});
 
     // Real-time validation on blur
     username.addEventListener('blur', () => validateUsername());
@@ -12,7 +35,7 @@ document.addEventListener('DOMContentLoaded', function() {
     confirmPassword.addEventListener('blur', () => validateConfirmPassword());
 
     // Clear errors on input
-    [username, email, password, confirmPassword].forEach(input => {
+    [username, email, password, confirmPassword, invite].forEach(input => {
         input.addEventListener('input', function() {
             clearError(this.id);
         });
@@ -139,7 +162,9 @@ document.addEventListener('DOMContentLoaded', function() {
                 // Display server-side validation errors
                 if (data.message) {
                     // Try to match error to specific field
-                    if (data.message.toLowerCase().includes('username')) {
+                    if (data.message.toLowerCase().includes('invite')) {
+                        showError('invite', 'inviteError', data.message);
+                    } else if (data.message.toLowerCase().includes('username')) {
                         showError('username', 'usernameError', data.message);
                     } else if (data.message.toLowerCase().includes('email')) {
                         showError('email', 'emailError', data.message);
@@ -196,7 +221,7 @@ document.addEventListener('DOMContentLoaded', function() {
     }
 
     function clearAllErrors() {
-        ['username', 'email', 'password', 'confirmPassword'].forEach(id => {
+        ['username', 'email', 'password', 'confirmPassword', 'invite'].forEach(id => {
             clearError(id);
         });
         
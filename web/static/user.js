@@ -3,11 +3,82 @@ document.addEventListener('DOMContentLoaded', () => {
   const logoutForm = document.getElementById('logoutForm');
   const profileMsg = document.getElementById('profileMsg');
   const logoutMsg = document.getElementById('logoutMsg');
+  const sessionList = document.getElementById('sessionList');
+  const sessionMsg = document.getElementById('sessionMsg');
+  const revokeAllBtn = document.getElementById('revokeAllBtn');
+  const exportForm = document.getElementById('exportForm');
+  const exportMsg = document.getElementById('exportMsg');
+  const deleteForm = document.getElementById('deleteForm');
+  const deleteMsg = document.getElementById('deleteMsg');
   const saveChangesBtn = document.getElementById('saveChangesBtn');
   
   let originalUsername = '';
   let originalEmail = '';
   let originalNotify = false;
+  let originalMagicLink = true;
+
+  function showPendingEmail(email) {
+    const pendingEmail = document.getElementById('pendingEmail');
+    if (!pendingEmail) return;
+    if (email) {
+      pendingEmail.textContent = `Waiting for you to confirm ${email} using the link sent there.`;
+      pendingEmail.style.color = 'var(--warning, #ff9800)';
+      pendingEmail.classList.add('show');
+    } else {
+      pendingEmail.textContent = '';
+      pendingEmail.classList.remove('show');
+    }
+  }
+
+  // Accounts without a password confirm sensitive changes by signing in
+  // with their identity provider again, which comes back with a single-use
+  // token.
+  const params = new URLSearchParams(window.location.search);
+  let reauthToken = params.get('reauth') || '';
+  const reauthNotice = document.getElementById('reauthNotice');
+  if (params.get('reauth') || params.get('reauth_error')) {
+    history.replaceState(null, '', '/user');
+  }
+
+  function showReauthNotice() {
+    reauthNotice.innerHTML = '';
+    if (reauthToken) {
+      reauthNotice.textContent = 'Identity confirmed. You can now make one sensitive change.';
+      reauthNotice.style.color = 'green';
+    } else {
+      reauthNotice.appendChild(document.createTextNode('Your account has no password. Changing your email, two-factor settings or password, or deleting your account, first needs you to '));
+      const link = document.createElement('a');
+      link.href = '/login/oidc/reauth';
+      link.textContent = 'confirm it is you';
+      reauthNotice.appendChild(link);
+      reauthNotice.appendChild(document.createTextNode('.'));
+      reauthNotice.style.color = '';
+    }
+    reauthNotice.style.display = '';
+  }
+
+  function withReauth(formData) {
+    if (reauthToken) formData.set('reauth_token', reauthToken);
+    return formData;
+  }
+
+  function reauthUsed() {
+    if (!reauthToken) return;
+    reauthToken = '';
+    showReauthNotice();
+  }
+
+  if (params.get('reauth_error')) {
+    profileMsg.textContent = 'Could not confirm your identity. Please try again.';
+    profileMsg.style.color = 'var(--danger)';
+    profileMsg.classList.add('show');
+  }
+
+  if (params.get('email_changed')) {
+    profileMsg.textContent = 'Your new email address is confirmed';
+    profileMsg.style.color = 'green';
+    profileMsg.classList.add('show');
+  }
 
   // Function to check if form has changes
   function checkForChanges() {
@@ -17,12 +88,14 @@ document.addEventListener('DOMContentLoaded', () => {
     const email = document.getElementById('email')?.value.trim() || '';
     const password = document.getElementById('password')?.value || '';
     const notify = document.getElementById('notify')?.checked || false;
+    const magicLink = document.getElementById('magicLink')?.checked || false;
     
     const hasChanges = 
       username !== originalUsername ||
       email !== originalEmail ||
       password !== '' ||
-      notify !== originalNotify;
+      notify !== originalNotify ||
+      magicLink !== originalMagicLink;
     
     saveChangesBtn.disabled = !hasChanges;
   }
@@ -33,6 +106,7 @@ document.addEventListener('DOMContentLoaded', () => {
     const emailInput = document.getElementById('email');
     const passwordInput = document.getElementById('password');
     const notifyCheckbox = document.getElementById('notify');
+    const magicLinkCheckbox = document.getElementById('magicLink');
     
     if (usernameInput) {
       usernameInput.addEventListener('input', checkForChanges);
@@ -50,6 +124,9 @@ document.addEventListener('DOMContentLoaded', () => {
       notifyCheckbox.addEventListener('change', checkForChanges);
       notifyCheckbox.addEventListener('click', checkForChanges);
     }
+    if (magicLinkCheckbox) {
+      magicLinkCheckbox.addEventListener('change', checkForChanges);
+    }
   }
 
   // Load current user data
@@ -63,6 +140,14 @@ document.addEventListener('DOMContentLoaded', () => {
         const emailInput = document.getElementById('email');
         if (usernameInput) usernameInput.value = originalUsername;
         if (emailInput) emailInput.value = originalEmail;
+        showPendingEmail(data.data.pending_email);
+        if (data.data.has_password === false) {
+          ['currentPasswordGroup', 'twoFactorEnablePasswordGroup', 'twoFactorPasswordGroup', 'deletePasswordGroup'].forEach(id => {
+            document.getElementById(id).style.display = 'none';
+          });
+          document.getElementById('deletePassword').required = false;
+          showReauthNotice();
+        }
         checkForChanges();
       }
     })
@@ -76,6 +161,9 @@ document.addEventListener('DOMContentLoaded', () => {
         originalNotify = data.data.comment_notifications || false;
         const notifyCheckbox = document.getElementById('notify');
         if (notifyCheckbox) notifyCheckbox.checked = originalNotify;
+        originalMagicLink = data.data.magic_link !== false;
+        const magicLinkCheckbox = document.getElementById('magicLink');
+        if (magicLinkCheckbox) magicLinkCheckbox.checked = originalMagicLink;
         checkForChanges();
       }
       // Setup listeners after data is loaded
@@ -96,6 +184,7 @@ document.addEventListener('DOMContentLoaded', () => {
       const email = document.getElementById('email').value.trim();
       const password = document.getElementById('password')?.value || '';
       const notify = document.getElementById('notify').checked;
+      const magicLink = document.getElementById('magicLink').checked;
 
       // Check if profile fields changed
       const profileChanged = 
@@ -104,7 +193,7 @@ document.addEventListener('DOMContentLoaded', () => {
         password !== '';
 
       // Check if preferences changed
-      const preferencesChanged = notify !== originalNotify;
+      const preferencesChanged = notify !== originalNotify || magicLink !== originalMagicLink;
 
       // If nothing changed, don't submit
       if (!profileChanged && !preferencesChanged) {
@@ -123,6 +212,9 @@ document.addEventListener('DOMContentLoaded', () => {
         if (username) formData.set('username', username);
         if (email) formData.set('email', email);
         if (password) formData.set('password', password);
+        const currentPassword = document.getElementById('currentPassword')?.value || '';
+        if (currentPassword) formData.set('current_password', currentPassword);
+        withReauth(formData);
 
         profilePromise = fetch('/api/user/update', {
           method: 'POST',
@@ -136,6 +228,7 @@ document.addEventListener('DOMContentLoaded', () => {
       if (preferencesChanged) {
         const prefData = new URLSearchParams();
         prefData.set('comment_notifications', notify.toString());
+        prefData.set('magic_link', magicLink.toString());
         preferencesPromise = fetch('/api/user/preferences', {
           method: 'POST',
           headers: { 'Content-Type': 'application/x-www-form-urlencoded' },
@@ -148,20 +241,27 @@ document.addEventListener('DOMContentLoaded', () => {
       Promise.all([profilePromise, preferencesPromise])
         .then(([profileData, prefData]) => {
           if (profileData.success && prefData.success) {
-            profileMsg.textContent = 'Changes saved successfully';
+            profileMsg.textContent = profileData.message || 'Changes saved successfully';
             profileMsg.style.color = 'green';
             profileMsg.classList.add('show');
             
             // Update original values and disable button
             if (profileChanged) {
+              if (email !== originalEmail || password) reauthUsed();
               originalUsername = username;
-              originalEmail = email;
+              // A new email only applies once confirmed
+              if (profileData.data && profileData.data.pending_email) {
+                document.getElementById('email').value = originalEmail;
+                showPendingEmail(profileData.data.pending_email);
+              }
               if (password) {
                 document.getElementById('password').value = '';
               }
+              document.getElementById('currentPassword').value = '';
             }
             if (preferencesChanged) {
               originalNotify = notify;
+              originalMagicLink = magicLink;
             }
             checkForChanges();
           } else {
@@ -192,5 +292,465 @@ document.addEventListener('DOMContentLoaded', () => {
         });
     });
   }
+
+  function showSessionError(text) {
+    sessionMsg.textContent = text;
+    sessionMsg.classList.add('show');
+  }
+
+  function revokeSessions(params) {
+    return fetch('/api/user/sessions/revoke', {
+      method: 'POST',
+      headers: { 'Content-Type': 'application/x-www-form-urlencoded' },
+      body: new URLSearchParams(params).toString()
+    }).then(res => res.json());
+  }
+
+  function loadSessions() {
+    fetch('/api/user/sessions')
+      .then(res => res.json())
+      .then(data => {
+        if (!data.success || !Array.isArray(data.data)) return;
+        sessionList.innerHTML = '';
+        data.data.forEach(session => {
+          const li = document.createElement('li');
+          const info = document.createElement('span');
+          const device = session.user_agent || 'Unknown device';
+          info.textContent = `${device} — ${session.ip || 'unknown IP'}, last active ${new Date(session.lastSeen).toLocaleString()}` +
+            (session.current ? ' (this device)' : '');
+          li.appendChild(info);
+
+          const btn = document.createElement('button');
+          btn.type = 'button';
+          btn.className = 'btn-logout';
+          btn.textContent = 'Revoke';
+          btn.addEventListener('click', () => {
+            revokeSessions({ session_id: session.id })
+              .then(result => {
+                if (!result.success) {
+                  showSessionError(result.message || 'Failed to revoke session');
+                } else if (session.current) {
+                  window.location.href = '/login';
+                } else {
+                  loadSessions();
+                }
+              })
+              .catch(() => showSessionError('Network error'));
+          });
+          li.appendChild(btn);
+          sessionList.appendChild(li);
+        });
+      })
+      .catch(() => {});
+  }
+
+  if (sessionList) {
+    loadSessions();
+  }
+
+  if (revokeAllBtn) {
+    revokeAllBtn.addEventListener('click', () => {
+      if (!confirm('Sign out of every device, including this one?')) return;
+      revokeSessions({ all: 'true' })
+        .then(result => {
+          if (result.success) {
+            window.location.href = '/login';
+          } else {
+            showSessionError(result.message || 'Failed to revoke sessions');
+          }
+        })
+        .catch(() => showSessionError('Network error'));
+    });
+  }
+
+  const twoFactorSection = document.getElementById('twoFactorSection');
+
+  if (twoFactorSection) {
+    const status = document.getElementById('twoFactorStatus');
+    const setupBtn = document.getElementById('twoFactorSetupBtn');
+    const enableForm = document.getElementById('twoFactorEnableForm');
+    const manageForm = document.getElementById('twoFactorManageForm');
+    const recoveryCodesBtn = document.getElementById('recoveryCodesBtn');
+    const recoveryCodes = document.getElementById('recoveryCodes');
+    const twoFactorMsg = document.getElementById('twoFactorMsg');
+
+    function showTwoFactorMessage(text, color) {
+      twoFactorMsg.textContent = text;
+      twoFactorMsg.style.color = color;
+      twoFactorMsg.classList.add('show');
+    }
+
+    function postTwoFactor(path, params) {
+      return fetch(path, {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/x-www-form-urlencoded' },
+        body: new URLSearchParams(params).toString()
+      }).then(res => res.json());
+    }
+
+    function showRecoveryCodes(codes) {
+      recoveryCodes.innerHTML = '';
+      codes.forEach(code => {
+        const li = document.createElement('li');
+        li.textContent = code;
+        recoveryCodes.appendChild(li);
+      });
+      showTwoFactorMessage('Save these recovery codes somewhere safe. Each one works once, and they will not be shown again.', 'green');
+    }
+
+    function loadTwoFactor() {
+      fetch('/api/user/2fa')
+        .then(res => res.json())
+        .then(data => {
+          if (!data.success) return;
+          enableForm.style.display = 'none';
+          if (data.data.enabled) {
+            status.textContent = `Enabled. ${data.data.recovery_codes_left} recovery codes left.`;
+            setupBtn.style.display = 'none';
+            manageForm.style.display = '';
+          } else {
+            status.textContent = 'Not enabled.';
+            setupBtn.style.display = '';
+            manageForm.style.display = 'none';
+          }
+        })
+        .catch(() => {});
+    }
+
+    setupBtn.addEventListener('click', () => {
+      postTwoFactor('/api/user/2fa/setup', {})
+        .then(data => {
+          if (!data.success) {
+            showTwoFactorMessage(data.message || 'Failed to start setup', 'var(--danger)');
+            return;
+          }
+          document.getElementById('twoFactorSecret').value = data.data.secret;
+          document.getElementById('twoFactorURI').href = data.data.uri;
+          setupBtn.style.display = 'none';
+          enableForm.style.display = '';
+        })
+        .catch(() => showTwoFactorMessage('Network error', 'var(--danger)'));
+    });
+
+    enableForm.addEventListener('submit', (e) => {
+      e.preventDefault();
+      const codeInput = document.getElementById('twoFactorEnableCode');
+      const passwordInput = document.getElementById('twoFactorEnablePassword');
+      const params = withReauth(new URLSearchParams({ code: codeInput.value.trim(), password: passwordInput.value }));
+      postTwoFactor('/api/user/2fa/enable', params)
+        .then(data => {
+          if (!data.success) {
+            showTwoFactorMessage(data.message || 'Invalid code', 'var(--danger)');
+            return;
+          }
+          reauthUsed();
+          codeInput.value = '';
+          passwordInput.value = '';
+          loadTwoFactor();
+          showRecoveryCodes(data.data.recovery_codes);
+        })
+        .catch(() => showTwoFactorMessage('Network error', 'var(--danger)'));
+    });
+
+    recoveryCodesBtn.addEventListener('click', () => {
+      const codeInput = document.getElementById('twoFactorCode');
+      postTwoFactor('/api/user/2fa/recovery-codes', { code: codeInput.value.trim() })
+        .then(data => {
+          if (!data.success) {
+            showTwoFactorMessage(data.message || 'Invalid code', 'var(--danger)');
+            return;
+          }
+          codeInput.value = '';
+          loadTwoFactor();
+          showRecoveryCodes(data.data.recovery_codes);
+        })
+        .catch(() => showTwoFactorMessage('Network error', 'var(--danger)'));
+    });
+
+    manageForm.addEventListener('submit', (e) => {
+      e.preventDefault();
+      const codeInput = document.getElementById('twoFactorCode');
+      const passwordInput = document.getElementById('twoFactorPassword');
+      const params = withReauth(new URLSearchParams({ code: codeInput.value.trim(), password: passwordInput.value }));
+      postTwoFactor('/api/user/2fa/disable', params)
+        .then(data => {
+          if (!data.success) {
+            showTwoFactorMessage(data.message || 'Failed to disable', 'var(--danger)');
+            return;
+          }
+          reauthUsed();
+          codeInput.value = '';
+          passwordInput.value = '';
+          recoveryCodes.innerHTML = '';
+          loadTwoFactor();
+          showTwoFactorMessage(data.message, 'green');
+        })
+        .catch(() => showTwoFactorMessage('Network error', 'var(--danger)'));
+    });
+
+    loadTwoFactor();
+  }
+
+  const tokenList = document.getElementById('tokenList');
+  const tokenForm = document.getElementById('tokenForm');
+  const tokenMsg = document.getElementById('tokenMsg');
+
+  function showTokenMessage(text, color) {
+    tokenMsg.textContent = text;
+    tokenMsg.style.color = color;
+    tokenMsg.classList.add('show');
+  }
+
+  function loadTokens() {
+    fetch('/api/user/tokens')
+      .then(res => res.json())
+      .then(data => {
+        if (!data.success || !Array.isArray(data.data)) return;
+        tokenList.innerHTML = '';
+        data.data.forEach(token => {
+          const li = document.createElement('li');
+          const info = document.createElement('span');
+          const expires = token.expiresAt ? `expires ${new Date(token.expiresAt).toLocaleDateString()}` : 'never expires';
+          const used = token.lastUsed ? `last used ${new Date(token.lastUsed).toLocaleString()}` : 'never used';
+          info.textContent = `${token.name} (${token.scopes.join(', ')}) — ${expires}, ${used}`;
+          li.appendChild(info);
+
+          const btn = document.createElement('button');
+          btn.type = 'button';
+          btn.className = 'btn-logout';
+          btn.textContent = 'Revoke';
+          btn.addEventListener('click', () => {
+            fetch('/api/user/tokens/revoke', {
+              method: 'POST',
+              headers: { 'Content-Type': 'application/x-www-form-urlencoded' },
+              body: new URLSearchParams({ token_id: token.id }).toString()
+            })
+              .then(res => res.json())
+              .then(result => {
+                if (result.success) {
+                  loadTokens();
+                } else {
+                  showTokenMessage(result.message || 'Failed to revoke token', 'var(--danger)');
+                }
+              })
+              .catch(() => showTokenMessage('Network error', 'var(--danger)'));
+          });
+          li.appendChild(btn);
+          tokenList.appendChild(li);
+        });
+      })
+      .catch(() => {});
+  }
+
+  if (tokenForm) {
+    loadTokens();
+
+    tokenForm.addEventListener('submit', (e) => {
+      e.preventDefault();
+      const formData = new URLSearchParams();
+      formData.set('name', document.getElementById('tokenName').value.trim());
+      tokenForm.querySelectorAll('input[name="scopes"]:checked').forEach(box => {
+        formData.append('scopes', box.value);
+      });
+      const expiry = document.getElementById('tokenExpiry').value;
+      if (expiry) formData.set('expires_in_days', expiry);
+
+      fetch('/api/user/tokens', {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/x-www-form-urlencoded' },
+        body: formData.toString()
+      })
+        .then(res => res.json())
+        .then(data => {
+          if (!data.success) {
+            showTokenMessage(data.message || 'Failed to create token', 'var(--danger)');
+            return;
+          }
+          showTokenMessage(`${data.message} ${data.data.token}`, 'green');
+          tokenForm.reset();
+          loadTokens();
+        })
+        .catch(() => showTokenMessage('Network error', 'var(--danger)'));
+    });
+  }
+
+  const inviteList = document.getElementById('inviteList');
+  const inviteForm = document.getElementById('inviteForm');
+  const inviteMsg = document.getElementById('inviteMsg');
+
+  function showInviteMessage(text, color) {
+    inviteMsg.textContent = text;
+    inviteMsg.style.color = color;
+    inviteMsg.classList.add('show');
+  }
+
+  function loadInvites() {
+    fetch('/api/user/invites')
+      .then(res => res.json())
+      .then(data => {
+        if (!data.success || !data.data || !Array.isArray(data.data.invites)) return;
+        if (data.data.registration !== 'invite' && !inviteMsg.classList.contains('show')) {
+          showInviteMessage('Registration is currently ' + data.data.registration + '; invites only take effect while it is invite-only.', 'inherit');
+        }
+        inviteList.innerHTML = '';
+        data.data.invites.forEach(invite => {
+          const li = document.createElement('li');
+          const info = document.createElement('span');
+          const expires = invite.expiresAt ? `expires ${new Date(invite.expiresAt).toLocaleDateString()}` : 'never expires';
+          const used = invite.redeemed_by.length ? `used by ${invite.redeemed_by.join(', ')}` : 'not used yet';
+          info.textContent = `Invite #${invite.id} (${invite.uses}/${invite.max_uses} uses) — ${expires}, ${used}`;
+          li.appendChild(info);
+
+          const btn = document.createElement('button');
+          btn.type = 'button';
+          btn.className = 'btn-logout';
+          btn.textContent = 'Revoke';
+          btn.addEventListener('click', () => {
+            fetch('/api/user/invites/revoke', {
+              method: 'POST',
+              headers: { 'Content-Type': 'application/x-www-form-urlencoded' },
+              body: new URLSearchParams({ invite_id: invite.id }).toString()
+            })
+              .then(res => res.json())
+              .then(result => {
+                if (result.success) {
+                  loadInvites();
+                } else {
+                  showInviteMessage(result.message || 'Failed to revoke invite', 'var(--danger)');
+                }
+              })
+              .catch(() => showInviteMessage('Network error', 'var(--danger)'));
+          });
+          li.appendChild(btn);
+          inviteList.appendChild(li);
+        });
+      })
+      .catch(() => {});
+  }
+
+  if (inviteForm) {
+    loadInvites();
+
+    inviteForm.addEventListener('submit', (e) => {
+      e.preventDefault();
+      const formData = new URLSearchParams();
+      formData.set('max_uses', document.getElementById('inviteUses').value);
+      formData.set('expires_in_days', document.getElementById('inviteExpiry').value);
+
+      fetch('/api/user/invites', {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/x-www-form-urlencoded' },
+        body: formData.toString()
+      })
+        .then(res => res.json())
+        .then(data => {
+          if (!data.success) {
+            showInviteMessage(data.message || 'Failed to create invite', 'var(--danger)');
+            return;
+          }
+          showInviteMessage(`${data.message} ${data.data.url}`, 'green');
+          inviteForm.reset();
+          loadInvites();
+        })
+        .catch(() => showInviteMessage('Network error', 'var(--danger)'));
+    });
+  }
+
+  if (exportForm) {
+    const exportBtn = document.getElementById('exportBtn');
+
+    function showExportMessage(text, color) {
+      exportMsg.textContent = text;
+      exportMsg.style.color = color;
+      exportMsg.classList.add('show');
+    }
+
+    function pollExport(token) {
+      fetch('/api/user/export?token=' + encodeURIComponent(token))
+        .then(res => res.json())
+        .then(data => {
+          if (!data.success) {
+            showExportMessage(data.message || 'Export failed', 'var(--danger)');
+            exportBtn.disabled = false;
+          } else if (data.data.status === 'ready') {
+            exportMsg.innerHTML = '';
+            const link = document.createElement('a');
+            link.href = '/api/user/export/download?token=' + encodeURIComponent(token);
+            link.textContent = 'Download your data';
+            exportMsg.appendChild(link);
+            exportMsg.appendChild(document.createTextNode(' (available until ' + new Date(data.data.expires_at).toLocaleString() + ')'));
+            exportMsg.style.color = '';
+            exportMsg.classList.add('show');
+            exportBtn.disabled = false;
+          } else if (data.data.status === 'failed') {
+            showExportMessage('Export failed, please try again', 'var(--danger)');
+            exportBtn.disabled = false;
+          } else {
+            setTimeout(() => pollExport(token), 2000);
+          }
+        })
+        .catch(err => {
+          showExportMessage('Network error', 'var(--danger)');
+          exportBtn.disabled = false;
+        });
+    }
+
+    exportForm.addEventListener('submit', (e) => {
+      e.preventDefault();
+      exportBtn.disabled = true;
+      showExportMessage('Preparing your export...', 'green');
+
+      fetch('/api/user/export', { method: 'POST' })
+        .then(res => res.json())
+        .then(data => {
+          if (data.success) {
+            pollExport(data.data.token);
+          } else {
+            showExportMessage(data.message || 'Export failed', 'var(--danger)');
+            exportBtn.disabled = false;
+          }
+        })
+        .catch(err => {
+          showExportMessage('Network error', 'var(--danger)');
+          exportBtn.disabled = false;
+        });
+    });
+  }
+
+  if (deleteForm) {
+    deleteForm.addEventListener('submit', (e) => {
+      e.preventDefault();
+      deleteMsg.textContent = '';
+      deleteMsg.classList.remove('show');
+
+      if (!confirm('Delete your account, photos, likes and comments? This cannot be undone.')) {
+        return;
+      }
+
+      const formData = new URLSearchParams();
+      formData.set('password', document.getElementById('deletePassword').value);
+      formData.set('anonymize_comments', document.getElementById('anonymizeComments').checked.toString());
+      withReauth(formData);
+
+      fetch('/api/user/delete', {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/x-www-form-urlencoded' },
+        body: formData.toString()
+      })
+        .then(res => res.json())
+        .then(data => {
+          if (data.success) {
+            window.location.href = '/';
+          } else {
+            deleteMsg.textContent = data.message || 'Failed to delete account';
+            deleteMsg.classList.add('show');
+          }
+        })
+        .catch(err => {
+          deleteMsg.textContent = 'Network error';
+          deleteMsg.classList.add('show');
+        });
+    });
+  }
 });
 